@@ -0,0 +1,337 @@
+package filetypestats
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	pathpkg "path"
+	"time"
+
+	"github.com/Rainc1oud/filetypestats/exclude"
+	"github.com/Rainc1oud/filetypestats/types"
+	"github.com/Rainc1oud/filetypestats/utils"
+)
+
+// ArchiveOptions control the expansion of archives during scans (see ScanOptions.Archives)
+// The members of an expanded archive are classified like files and stored under FSPath(archive, name), like by ScanFS.
+// Queries only select them with paths inside their archive or with types.SumOptions.ArchiveMembers, so nothing is counted twice.
+// The watcher doesn't expand archives: the members of a changed or removed archive are deleted and only restored by the next scan.
+// Archives are read as a stream, only zips which can't be read at random (e.g. nested zips) are copied to a temp file first,
+// so the memory use doesn't grow with their size.
+type ArchiveOptions struct {
+	// Expand opens the zip, tar, tar.gz and tar.bz2 files found by the scan and stores their members
+	Expand bool
+	// MaxDepth is the number of nesting levels which are expanded,
+	// 1 (the default for <= 0) expands the archives in the tree, 2 also the archives in them, etc.
+	MaxDepth int
+	// MaxBytes is the budget of uncompressed member bytes of an archive in the tree, including its nested archives (0: no limit)
+	// The members of an archive which exceeds it are not stored, it's then only counted as a file, like an archive which can't be read
+	MaxBytes uint64
+}
+
+// the MIME types (as detected by filetype) of the archives which are expanded, the compressed files only if they contain a tar
+const (
+	mimeZip   = "application/zip"
+	mimeTar   = "application/x-tar"
+	mimeGzip  = "application/gzip"
+	mimeBzip2 = "application/x-bzip2"
+)
+
+var (
+	errArchiveBudget = errors.New("archive exceeds the size budget")
+	errNotTar        = errors.New("compressed file doesn't contain a tar archive")
+)
+
+// expandable reports whether files with the MIME type mime are expanded
+func expandable(mime string) bool {
+	switch mime {
+	case mimeZip, mimeTar, mimeGzip, mimeBzip2:
+		return true
+	}
+	return false
+}
+
+// expandArchive returns the FileStats of the members of fst if it's an archive to expand, or nil
+func (s *treeScanner) expandArchive(fst *types.FileStat) []*types.FileStat {
+	if !s.opts.Archives.Expand || !expandable(fst.MIME) {
+		return nil
+	}
+	if s.opts.Incremental {
+		if fsts := s.storedMembers(fst); fsts != nil {
+			return fsts
+		}
+	}
+	fh, err := s.open(fst.Path)
+	if err != nil {
+		s.errors.Add(1)
+		fmt.Fprintln(os.Stderr, err.Error())
+		return nil
+	}
+	defer fh.Close()
+	x := &archiveExpander{
+		maxDepth: max(s.opts.Archives.MaxDepth, 1),
+		budget:   s.opts.Archives.MaxBytes,
+		exclude:  s.opts.Exclude,
+		dirs:     make(map[string]int),
+		excluded: make(map[string]bool),
+	}
+	if err := x.expand(fst.Path, fst.MIME, fh, fst.NumBytes, 1); err != nil {
+		if !errors.Is(err, errNotTar) { // a plain compressed file
+			s.errors.Add(1)
+			fmt.Fprintf(os.Stderr, "not expanding %s: %s\n", fst.Path, err.Error())
+		}
+		return nil
+	}
+	return x.fsts
+}
+
+// storedMembers returns the stored members of the archive fst, with those of its nested archives, if it's unchanged since it was expanded,
+// or nil if it has to be expanded again. Storing them again refreshes them, so they aren't deleted as stale after the scan.
+func (s *treeScanner) storedMembers(fst *types.FileStat) []*types.FileStat {
+	stored, err := s.db.GetFileStat(fst.Path)
+	if err != nil || stored == nil || !fst.Unchanged(stored) {
+		return nil
+	}
+	if root, err := s.db.GetFileStat(FSPath(fst.Path, ".") + "/"); err != nil || root == nil || root.Archive != fst.Path {
+		return nil // not expanded yet, e.g. it exceeded the budget or the scan was cancelled
+	}
+	fsts, err := s.dumpMembers(fst.Path, 1)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return nil
+	}
+	return fsts
+}
+
+// dumpMembers returns the stored members of the archive path at nesting level depth and those of its nested archives
+func (s *treeScanner) dumpMembers(path string, depth int) ([]*types.FileStat, error) {
+	members, err := s.db.FTDumpFileStats([]string{utils.GlobEscape(FSPath(path, ".")) + "/*"})
+	if err != nil {
+		return nil, err
+	}
+	fsts := make([]*types.FileStat, 0, len(members))
+	for i := range members {
+		fsts = append(fsts, &members[i])
+		if depth >= max(s.opts.Archives.MaxDepth, 1) || !expandable(members[i].MIME) {
+			continue
+		}
+		nested, err := s.dumpMembers(members[i].Path, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		fsts = append(fsts, nested...)
+	}
+	return fsts, nil
+}
+
+// archiveExpander collects the members of an archive in the tree, including those of its nested archives
+type archiveExpander struct {
+	maxDepth     int
+	budget, used uint64
+	exclude      *exclude.Rules
+	fsts         []*types.FileStat
+	dirs         map[string]int  // the index in fsts of the stored dirs
+	excluded     map[string]bool // the excluded dirs (without trailing separator)
+}
+
+// expand adds the members of the archive path of type mime with the content r of size bytes, at nesting level depth
+func (x *archiveExpander) expand(path, mime string, r io.Reader, size uint64, depth int) error {
+	x.dir(path, FSPath(path, "."), nil)
+	switch mime {
+	case mimeZip:
+		ra, ok := r.(io.ReaderAt)
+		if !ok { // e.g. a nested zip
+			f, err := spill(r, size)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			ra = f
+		}
+		zr, err := zip.NewReader(ra, int64(size))
+		if err != nil {
+			return err
+		}
+		for _, f := range zr.File {
+			if err := x.zipMember(path, f, depth); err != nil {
+				return err
+			}
+		}
+		return nil
+	case mimeTar:
+		return x.tarMembers(path, tar.NewReader(r), depth, false)
+	case mimeGzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return x.tarMembers(path, tar.NewReader(gz), depth, true)
+	case mimeBzip2:
+		return x.tarMembers(path, tar.NewReader(bzip2.NewReader(r)), depth, true)
+	}
+	return fmt.Errorf("unsupported archive type %s", mime)
+}
+
+func (x *archiveExpander) zipMember(path string, f *zip.File, depth int) error {
+	fi := f.FileInfo()
+	if !fi.Mode().IsRegular() {
+		return x.member(path, f.Name, fi, nil, depth)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return x.member(path, f.Name, fi, rc, depth)
+}
+
+// tarMembers adds the members of the tar archive path, compressed tells that it was detected as a compressed file which may not contain a tar
+func (x *archiveExpander) tarMembers(path string, tr *tar.Reader, depth int, compressed bool) error {
+	for first := true; ; first = false {
+		hdr, err := tr.Next()
+		if err == io.EOF && !(first && compressed) {
+			return nil
+		} else if err != nil {
+			if first && compressed {
+				return errNotTar
+			}
+			return err
+		}
+		if err := x.member(path, hdr.Name, hdr.FileInfo(), tr, depth); err != nil {
+			return err
+		}
+	}
+}
+
+// member adds the member name of the archive path with the info fi and (for a regular file) the content r
+// Only dirs and regular files are stored, like by the scanner, and nested archives are expanded down to x.maxDepth
+func (x *archiveExpander) member(path, name string, fi fs.FileInfo, r io.Reader, depth int) error {
+	name = pathpkg.Clean("/" + name)[1:] // members can't escape the archive
+	if name == "" || !(fi.IsDir() || fi.Mode().IsRegular()) || !x.parents(path, name) {
+		return nil
+	}
+	mpath := FSPath(path, name)
+	if fi.IsDir() {
+		if x.exclude.ExcludedDir(mpath) {
+			x.excluded[mpath] = true
+		} else {
+			x.dir(path, mpath, fi)
+		}
+		return nil
+	}
+	if x.exclude.ExcludedEntry(mpath, false, uint64(fi.Size())) {
+		return nil
+	}
+	x.used += uint64(fi.Size())
+	if x.budget > 0 && x.used > x.budget {
+		return errArchiveBudget
+	}
+	kind, head, err := matchHeader(r)
+	if err != nil {
+		return err
+	}
+	fst := kindFTStat(mpath, fi, kind)
+	fst.Archive = path
+	x.fsts = append(x.fsts, fst)
+	if depth >= x.maxDepth || !expandable(fst.MIME) {
+		return nil
+	}
+	n := len(x.fsts)
+	err = x.expand(mpath, fst.MIME, io.MultiReader(bytes.NewReader(head), r), fst.NumBytes, depth+1)
+	if errors.Is(err, errArchiveBudget) {
+		return err
+	} else if err != nil { // the nested archive is only counted as a file
+		x.truncate(n)
+	}
+	return nil
+}
+
+// parents adds the parent dirs of the member name of the archive path which were not added yet,
+// it returns false if one of them is excluded
+func (x *archiveExpander) parents(path, name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] != '/' {
+			continue
+		}
+		dir := FSPath(path, name[:i])
+		if x.excluded[dir] {
+			return false
+		}
+		if _, ok := x.dirs[dir+"/"]; ok {
+			continue
+		}
+		if x.exclude.ExcludedDir(dir) {
+			x.excluded[dir] = true
+			return false
+		}
+		x.dir(path, dir, nil)
+	}
+	return true
+}
+
+// dir adds the dir path of the archive with the info fi, or with impliedDir if fi is nil
+// The info of a dir's own entry replaces the implied one, which is added when the dir is first seen in a member path
+func (x *archiveExpander) dir(archive, path string, fi fs.FileInfo) {
+	implied := fi == nil
+	if implied {
+		fi = impliedDir(pathpkg.Base(path))
+	}
+	fst := types.NewFileStat(path+"/", "dir", fi)
+	fst.Archive = archive
+	if i, ok := x.dirs[fst.Path]; ok {
+		if !implied {
+			x.fsts[i] = fst
+		}
+		return
+	}
+	x.dirs[fst.Path] = len(x.fsts)
+	x.fsts = append(x.fsts, fst)
+}
+
+// truncate drops all members added after the first n
+func (x *archiveExpander) truncate(n int) {
+	for dir, i := range x.dirs {
+		if i >= n {
+			delete(x.dirs, dir)
+		}
+	}
+	x.fsts = x.fsts[:n]
+}
+
+// spill copies the content r of a zip of size bytes, which can't be read at random, to a temp file, which the caller must close
+// Zips are never read into memory, since their size isn't bounded (see ArchiveOptions.MaxBytes), tars are read as a stream.
+// The file is unlinked right away, so it's also removed if the scan doesn't get to close it.
+func spill(r io.Reader, size uint64) (*os.File, error) {
+	f, err := os.CreateTemp("", "filetypestats-zip-*")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	n, err := io.Copy(f, io.LimitReader(r, int64(size)+1))
+	if err == nil && uint64(n) != size {
+		err = fmt.Errorf("archive member has %d bytes instead of %d", n, size)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// impliedDir is the FileInfo of a dir in an archive which has no entry of its own
+type impliedDir string
+
+func (d impliedDir) Name() string       { return string(d) }
+func (d impliedDir) Size() int64        { return 0 }
+func (d impliedDir) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (d impliedDir) ModTime() time.Time { return time.Time{} }
+func (d impliedDir) IsDir() bool        { return true }
+func (d impliedDir) Sys() interface{}   { return nil }
@@ -0,0 +1,264 @@
+package filetypestats
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Rainc1oud/filetypestats/store"
+	"github.com/Rainc1oud/filetypestats/types"
+	"github.com/Rainc1oud/filetypestats/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testMember is a file (or dir, with a name ending in "/") of a generated archive
+type testMember struct {
+	name    string
+	content []byte
+}
+
+func zipBytes(t testing.TB, members ...testMember) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, m := range members {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: m.name, Method: zip.Deflate, Modified: time.Unix(1600000000, 0)})
+		require.NoError(t, err)
+		_, err = w.Write(m.content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func tarBytes(t testing.TB, members ...testMember) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, m := range members {
+		hdr := &tar.Header{Name: m.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(m.content)), ModTime: time.Unix(1600000000, 0)}
+		if m.name[len(m.name)-1] == '/' {
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write(m.content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "x"})) // not stored
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func gzipBytes(t testing.TB, data []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+// genArchives creates a tree with archives in dir and returns the zip and the tar.gz in it
+func genArchives(t testing.TB, dir string) (zipPath, tgzPath string) {
+	withHeader := func(i int, n int) []byte { return append(append([]byte{}, testFileHeaders[i]...), make([]byte, n)...) }
+	nested := gzipBytes(t, tarBytes(t, testMember{"s.mp3", withHeader(2, 30)}, testMember{"sub/x.png", withHeader(0, 10)}))
+	files := map[string][]byte{
+		"t.txt":   testFileHeaders[4],
+		"img.png": withHeader(0, 5),
+		"a.zip": zipBytes(t, testMember{"docs/p.pdf", withHeader(3, 500)}, testMember{"img.png", withHeader(0, 20)},
+			testMember{"empty/", nil}, testMember{"in.tar.gz", nested}),
+		"b/c.tar.gz": gzipBytes(t, tarBytes(t, testMember{"./a/", nil}, testMember{"./a/x.png", withHeader(0, 1)},
+			testMember{"../evil.txt", testFileHeaders[4]})),
+		"plain.gz": gzipBytes(t, testFileHeaders[4]), // not a tar
+		"bad.zip":  []byte("PK\x03\x04 but not really a zip"),
+	}
+	for name, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), content, 0644))
+	}
+	return filepath.Join(dir, "a.zip"), filepath.Join(dir, "b/c.tar.gz")
+}
+
+// memberPaths returns the stored paths of the members of the archive path (at all depths), sorted
+func memberPaths(t testing.TB, fdb store.Store, path string) []string {
+	fsts, err := fdb.FTDumpFileStats([]string{utils.GlobEscape(path) + "!/*"})
+	require.NoError(t, err)
+	paths := make([]string, 0, len(fsts))
+	for _, fst := range fsts {
+		paths = append(paths, fst.Path)
+	}
+	for _, fst := range fsts {
+		if expandable(fst.MIME) {
+			paths = append(paths, memberPaths(t, fdb, fst.Path)...)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestTreeScanner_Archives(t *testing.T) {
+	dir := t.TempDir()
+	zipPath, tgzPath := genArchives(t, dir)
+	plain := tmpStore(t)
+	require.NoError(t, newTreeScanner(plain, dir, ScanOptions{}).scan(context.Background()))
+	onDisk, err := plain.FTStatsSum([]string{utils.GlobEscape(dir) + "/*"})
+	require.NoError(t, err)
+
+	for _, workers := range []int{1, 4} {
+		fdb := tmpStore(t)
+		require.NoError(t, newTreeScanner(fdb, dir, ScanOptions{Workers: workers, Archives: ArchiveOptions{Expand: true}}).scan(context.Background()))
+
+		// the members are not counted with the tree, neither from dirstats nor from fileinfo
+		got, err := fdb.FTStatsSum([]string{utils.GlobEscape(dir) + "/*"})
+		require.NoError(t, err)
+		assert.Equal(t, onDisk, got)
+		got, err = fdb.FTStatsSumWith([]string{utils.GlobEscape(dir) + "/*"}, types.SumOptions{Unique: true})
+		require.NoError(t, err)
+		assert.Equal(t, classSums(onDisk), classSums(got))
+
+		assert.Equal(t, []string{zipPath + "!/", zipPath + "!/docs/", zipPath + "!/docs/p.pdf", zipPath + "!/empty/",
+			zipPath + "!/img.png", zipPath + "!/in.tar.gz"}, memberPaths(t, fdb, zipPath), "workers %d", workers)
+		assert.Equal(t, []string{tgzPath + "!/", tgzPath + "!/a/", tgzPath + "!/a/x.png", tgzPath + "!/evil.txt"}, memberPaths(t, fdb, tgzPath))
+		assert.Empty(t, memberPaths(t, fdb, filepath.Join(dir, "plain.gz")))
+		assert.Empty(t, memberPaths(t, fdb, filepath.Join(dir, "bad.zip")))
+
+		fst, err := fdb.GetFileStat(FSPath(zipPath, "docs/p.pdf"))
+		require.NoError(t, err)
+		require.NotNil(t, fst)
+		assert.Equal(t, "application", fst.FType)
+		assert.Equal(t, uint64(len(testFileHeaders[3])+500), fst.NumBytes)
+		assert.Equal(t, time.Unix(1600000000, 0), fst.ModTime.Local())
+
+		// the expanded archives are replaced by their members
+		got, err = fdb.FTStatsSumWith([]string{utils.GlobEscape(dir) + "/*"}, types.SumOptions{ArchiveMembers: true})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]uint{"dir": 2 + 3 + 2, "image": 3, "application": 4, "other": 2, "total": 16}, fileCounts(got))
+	}
+
+	// nested archives are expanded down to MaxDepth
+	fdb := tmpStore(t)
+	require.NoError(t, newTreeScanner(fdb, dir, ScanOptions{Archives: ArchiveOptions{Expand: true, MaxDepth: 2}}).scan(context.Background()))
+	nested := FSPath(zipPath, "in.tar.gz")
+	assert.Equal(t, []string{nested + "!/", nested + "!/s.mp3", nested + "!/sub/", nested + "!/sub/x.png"}, memberPaths(t, fdb, nested))
+	got, err := fdb.FTStatsSumWith([]string{utils.GlobEscape(dir) + "/*"}, types.SumOptions{ArchiveMembers: true})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint{"dir": 2 + 3 + 2 + 2, "image": 4, "audio": 1, "application": 3, "other": 2, "total": 19}, fileCounts(got))
+
+	// an archive exceeding the budget is only counted as a file
+	fdb = tmpStore(t)
+	require.NoError(t, newTreeScanner(fdb, dir, ScanOptions{Archives: ArchiveOptions{Expand: true, MaxDepth: 2, MaxBytes: 100}}).scan(context.Background()))
+	assert.Empty(t, memberPaths(t, fdb, zipPath))
+	assert.Len(t, memberPaths(t, fdb, tgzPath), 4)
+
+	// archives in fs.FS trees are expanded too
+	fdb = tmpStore(t)
+	require.NoError(t, ScanFS(context.Background(), fdb, os.DirFS(dir), "/virtual", ScanOptions{Archives: ArchiveOptions{Expand: true}}))
+	assert.Len(t, memberPaths(t, fdb, FSPath("/virtual", "a.zip")), 6)
+}
+
+func TestTreeStatsWatcher_Archives(t *testing.T) {
+	dir := t.TempDir()
+	fdb := tmpStore(t)
+	zipPath, _ := genArchives(t, dir)
+	tsw := startWatch(t, dir, fdb, nil) // the watcher doesn't expand archives, only the scans
+	tsw.SetScanOptions(ScanOptions{Archives: ArchiveOptions{Expand: true}})
+	require.NoError(t, tsw.ScanDir(dir))
+	require.Len(t, memberPaths(t, fdb, zipPath), 6)
+
+	// the members move with the archive
+	moved := filepath.Join(dir, "moved.zip")
+	require.NoError(t, os.Rename(zipPath, moved))
+	assert.Eventually(t, func() bool { return len(memberPaths(t, fdb, moved)) == 6 }, eventTimeout, 20*time.Millisecond, "members not moved")
+	assert.Empty(t, memberPaths(t, fdb, zipPath))
+
+	// and are deleted with it
+	require.NoError(t, os.Remove(moved))
+	assert.Eventually(t, func() bool { return len(memberPaths(t, fdb, moved)) == 0 }, eventTimeout, 20*time.Millisecond, "members not deleted")
+}
+
+func TestTreeStatsWatcher_BangDirs(t *testing.T) {
+	// a dir named like an archive followed by "!" has the path of the archive's member root, but it's counted like any other dir
+	dir := t.TempDir()
+	zipPath, _ := genArchives(t, filepath.Join(dir, "wow!"))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "wow"), testFileHeaders[4], 0644))
+	fdb := tmpStore(t)
+	tsw := startWatch(t, dir, fdb, nil)
+	tsw.SetScanOptions(ScanOptions{Archives: ArchiveOptions{Expand: true}})
+	require.NoError(t, tsw.ScanDir(dir))
+	require.Len(t, memberPaths(t, fdb, zipPath), 6)
+
+	checkSums := func() {
+		t.Helper()
+		want, err := WalkStats(context.Background(), []string{dir}, WalkOptions{})
+		require.NoError(t, err)
+		got, err := fdb.FTStatsSum([]string{utils.GlobEscape(dir) + "/*"})
+		require.NoError(t, err)
+		assert.Equal(t, want.Total, got)
+		got, err = fdb.FTStatsSumWith([]string{utils.GlobEscape(dir) + "/*"}, types.SumOptions{Unique: true})
+		require.NoError(t, err)
+		assert.Equal(t, classSums(want.Total), classSums(got))
+	}
+	checkSums()
+
+	// removing the file doesn't take the dir with it, as if it were the members of an archive
+	require.NoError(t, os.Remove(filepath.Join(dir, "wow")))
+	assert.Eventually(t, func() bool {
+		fst, err := fdb.GetFileStat(filepath.Join(dir, "wow"))
+		return err == nil && fst == nil
+	}, eventTimeout, 20*time.Millisecond, "file not deleted")
+	checkSums()
+	assert.Len(t, memberPaths(t, fdb, zipPath), 6)
+}
+
+func TestTreeScanner_NestedZip(t *testing.T) {
+	// a zip in a zip can't be read at random, it's expanded from a temp file
+	dir := t.TempDir()
+	inner := zipBytes(t, testMember{"x.png", append(append([]byte{}, testFileHeaders[0]...), make([]byte, 10)...)})
+	outer := filepath.Join(dir, "outer.zip")
+	require.NoError(t, os.WriteFile(outer, zipBytes(t, testMember{"d/inner.zip", inner}), 0644))
+
+	fdb := tmpStore(t)
+	require.NoError(t, newTreeScanner(fdb, dir, ScanOptions{Archives: ArchiveOptions{Expand: true, MaxDepth: 2}}).scan(context.Background()))
+	nested := FSPath(outer, "d/inner.zip")
+	assert.Equal(t, []string{FSPath(outer, ".") + "/", FSPath(outer, "d") + "/", nested, nested + "!/", nested + "!/x.png"},
+		memberPaths(t, fdb, outer))
+	fst, err := fdb.GetFileStat(FSPath(nested, "x.png"))
+	require.NoError(t, err)
+	require.NotNil(t, fst)
+	assert.Equal(t, "image", fst.FType)
+	assert.Equal(t, nested, fst.Archive)
+}
+
+func TestTreeScanner_IncrementalArchives(t *testing.T) {
+	dir := t.TempDir()
+	zipPath, _ := genArchives(t, dir)
+	fdb := tmpStore(t)
+	scan := func(incremental bool) {
+		t.Helper()
+		tstart := time.Now()
+		opts := ScanOptions{Incremental: incremental, Archives: ArchiveOptions{Expand: true, MaxDepth: 2}}
+		require.NoError(t, newTreeScanner(fdb, dir, opts).scan(context.Background()))
+		require.NoError(t, fdb.DeleteOlderThanWithPrefix(tstart, dir))
+	}
+	scan(true)
+	members := memberPaths(t, fdb, zipPath)
+	require.Len(t, members, 6+4)
+
+	// an unchanged archive isn't read again: its members are kept although its content can't be read anymore
+	fi, err := os.Stat(zipPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(zipPath, make([]byte, fi.Size()), 0644))
+	require.NoError(t, os.Chtimes(zipPath, fi.ModTime(), fi.ModTime()))
+	scan(true)
+	assert.Equal(t, members, memberPaths(t, fdb, zipPath))
+
+	// a full scan expands it again
+	scan(false)
+	assert.Empty(t, memberPaths(t, fdb, zipPath))
+}
@@ -0,0 +1,106 @@
+package filetypestats
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/Rainc1oud/filetypestats/store"
+	"github.com/Rainc1oud/filetypestats/types"
+)
+
+// partialHashSize is the number of leading bytes hashed to find candidates for the (expensive) full hash
+const partialHashSize = 64 << 10
+
+// Dedup hashes the candidate duplicates among the files selected by paths (see ftsdb.FileTypeStatsDB.FTStatsSum) and stores the digests,
+// after which the duplicates can be queried with ftsdb.FileTypeStatsDB.Duplicates.
+// Only files with the same size as another file are read, first partially and then fully if their partial digests collide.
+// Digests stored by an earlier pass are reused for unchanged files (same size and mtime).
+// Files which can't be read are skipped, if ctx is cancelled the digests computed so far are stored and ctx.Err() is returned.
+func Dedup(ctx context.Context, fdb store.HashStore, paths []string) error {
+	if _, err := fdb.PruneFileHashes(); err != nil {
+		return err
+	}
+	groups, err := fdb.DedupCandidates(paths)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fdb.UpdateFileHashes(hashGroup(ctx, g)); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// hashGroup computes the missing digests of a group of equally sized files and returns the changed entries
+func hashGroup(ctx context.Context, g []types.FileHash) []types.FileHash {
+	changed := make(map[int]bool)
+	byPartial := make(map[string][]int)
+	for i := range g {
+		if ctx.Err() != nil {
+			break
+		}
+		if g[i].Partial == "" {
+			h, err := fileDigest(g[i].Path, partialHashSize)
+			if err != nil {
+				continue
+			}
+			g[i].Partial, g[i].Full = h, ""
+			if g[i].Size <= partialHashSize { // the partial digest covers the whole file
+				g[i].Full = h
+			}
+			changed[i] = true
+		}
+		byPartial[g[i].Partial] = append(byPartial[g[i].Partial], i)
+	}
+	for _, idx := range byPartial {
+		if len(idx) < 2 {
+			continue
+		}
+		for _, i := range idx {
+			if ctx.Err() != nil {
+				break
+			}
+			if g[i].Full != "" {
+				continue
+			}
+			h, err := fileDigest(g[i].Path, -1)
+			if err != nil {
+				continue
+			}
+			g[i].Full = h
+			changed[i] = true
+		}
+	}
+	res := make([]types.FileHash, 0, len(changed))
+	for i := range g {
+		if changed[i] {
+			res = append(res, g[i])
+		}
+	}
+	return res
+}
+
+// fileDigest returns the hex sha256 of the first n bytes of path, or of all of it if n < 0
+func fileDigest(path string, n int64) (string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	var r io.Reader = fh
+	if n >= 0 {
+		r = io.LimitReader(fh, n)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
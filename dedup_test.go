@@ -0,0 +1,71 @@
+//go:build cgo
+
+package filetypestats
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedup(t *testing.T) {
+	dir := t.TempDir()
+	big := bytes.Repeat([]byte("x"), partialHashSize+100)
+	bigOther := append(append([]byte{}, big[:partialHashSize]...), bytes.Repeat([]byte("y"), 100)...) // same partial digest
+	for name, content := range map[string][]byte{
+		"a/img1.png":   append(append([]byte{}, testFileHeaders[0]...), "same"...),
+		"b/img2.png":   append(append([]byte{}, testFileHeaders[0]...), "same"...),
+		"b/img3.png":   append(append([]byte{}, testFileHeaders[0]...), "diff"...), // same size, other content
+		"a/big1":       big,
+		"b/big2":       big,
+		"c/big3":       big,
+		"c/bigother":   bigOther,
+		"c/empty1":     nil,
+		"c/empty2":     nil,
+		"c/unique.txt": []byte("unique"),
+	} {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, content, 0644))
+	}
+	require.NoError(t, os.Link(filepath.Join(dir, "a/big1"), filepath.Join(dir, "a/big1.link")))
+
+	fdb := tmpDB(t)
+	require.NoError(t, newTreeScanner(fdb, dir, ScanOptions{}).scan(context.Background()))
+	all := []string{dir + "/*"}
+	require.NoError(t, Dedup(context.Background(), fdb, all))
+
+	groups, err := fdb.Duplicates(all)
+	require.NoError(t, err)
+	require.Len(t, groups, 2)
+	assert.Equal(t, []string{dir + "/a/big1", dir + "/a/big1.link", dir + "/b/big2", dir + "/c/big3"}, groups[0].Paths)
+	assert.Equal(t, 3, groups[0].Copies) // the hardlink doesn't count
+	assert.Equal(t, uint64(2*len(big)), groups[0].Wasted())
+	assert.Equal(t, []string{dir + "/a/img1.png", dir + "/b/img2.png"}, groups[1].Paths)
+	assert.Equal(t, "image", groups[1].FType)
+
+	wasted := groups.WastedByType()
+	assert.Equal(t, uint64(2*len(big)+len(testFileHeaders[0])+4), wasted["total"].NumBytes)
+	assert.Equal(t, uint(3), wasted["total"].FileCount)
+	assert.Equal(t, uint(1), wasted["image"].FileCount)
+
+	// the path globs limit the groups
+	groups, err = fdb.Duplicates([]string{dir + "/b/*", dir + "/c/*"})
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	assert.Equal(t, []string{dir + "/b/big2", dir + "/c/big3"}, groups[0].Paths)
+
+	// a changed file is not a duplicate anymore after the next scan and dedup pass
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b/img2.png"), append(append([]byte{}, testFileHeaders[0]...), "chng"...), 0644))
+	require.NoError(t, newTreeScanner(fdb, dir, ScanOptions{}).scan(context.Background()))
+	require.NoError(t, Dedup(context.Background(), fdb, all))
+	groups, err = fdb.Duplicates(all)
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	assert.Len(t, groups[0].Paths, 4)
+}
@@ -1,29 +1,50 @@
 package filetypestats
 
 import (
+	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/Rainc1oud/filetypestats/exclude"
 	"github.com/Rainc1oud/filetypestats/notifywatch"
+	"github.com/Rainc1oud/filetypestats/utils"
 	ggu "github.com/Rainc1oud/gogenutils"
 	"github.com/rjeczalik/notify"
 )
 
+// TDirMonitor is the watcher and scan state of one dir
+// The state is guarded by the mutex of the TDirMonitors containing it, so it must only be accessed through TDirMonitors
 type TDirMonitor struct {
-	notifywatch.NotifyWatcher // embed NotifyWatcher, because TDirMonitor is just a Watcer with added state and access/info methods
-	tstarted                  time.Time
-	tfinished                 time.Time
-	dlastscan                 time.Duration
-	dirty                     bool
+	*notifywatch.NotifyWatcher // embed NotifyWatcher, because TDirMonitor is just a Watcer with added state and access/info methods
+	tstarted                   time.Time
+	tfinished                  time.Time
+	dlastscan                  time.Duration
+	dirty                      bool
+	cancelScan                 context.CancelFunc // cancels the running scan, if any
+	excludeRules               *exclude.Rules
+	overflows                  uint64      // number of event queue overflows
+	toverflow                  time.Time   // time of the last overflow
+	rescanPending              bool        // a rescan is scheduled because events got lost
+	rescanTimer                *time.Timer // debounces the rescan after overflows
+	watchStarted               bool        // Watch() was started, it can't be started again
 }
 
 func newDirMonitor(dir string, recursive bool, handler notifywatch.NotifyHandlerFun, events ...notify.Event) *TDirMonitor {
 	dm := &TDirMonitor{
-		*notifywatch.NewNotifyWatcher(dir, recursive, handler, events...),
+		notifywatch.NewNotifyWatcher(dir, recursive, handler, events...),
 		time.Time{},
 		time.Time{},
 		time.Duration(0),
 		false,
+		nil,
+		nil,
+		0,
+		time.Time{},
+		false,
+		nil,
+		false,
 	}
 	return dm
 }
@@ -37,6 +58,7 @@ func (t *TDirMonitor) scanStart() {
 func (t *TDirMonitor) scanFinish() {
 	t.tfinished = time.Now()
 	t.dlastscan = time.Since(t.tstarted)
+	t.cancelScan = nil
 }
 func (t *TDirMonitor) scanStarted() time.Time {
 	return t.tstarted
@@ -48,20 +70,27 @@ func (t *TDirMonitor) isDirty() bool {
 	return t.dirty
 }
 
-type TDirMonitors map[string]*TDirMonitor
+// TDirMonitors is the registry of all monitored dirs, it is safe for concurrent use
+// It used to be a map[string]*TDirMonitor, use Get and Range instead of indexing and ranging over it.
+type TDirMonitors struct {
+	mu       sync.RWMutex // guards the map and the state of all its TDirMonitor items
+	monitors map[string]*TDirMonitor
+}
 
 type TDirMonitorsStatus struct {
 	Dirty            bool
 	ScanStartedLast  time.Time
 	ScanFinishedLast time.Time
 	ScanLongestLast  time.Duration // the longest duration of all last dir scans
+	Overflows        uint64        // the number of event queue overflows of all dirs
+	OverflowLast     time.Time     // the time of the last overflow
 }
 
-// TODO: this is a generic function for any map[string]interface{}, handle after generics support is here (go1.18)
+// keys returns all dirs, the caller must hold the lock
 func (dm *TDirMonitors) keys() []string {
-	s := make([]string, len(*dm))
+	s := make([]string, len(dm.monitors))
 	i := 0
-	for k := range *dm {
+	for k := range dm.monitors {
 		s[i] = k
 		i++
 	}
@@ -70,48 +99,64 @@ func (dm *TDirMonitors) keys() []string {
 
 // NewDirMonitors constructor
 func NewDirMonitors() *TDirMonitors {
-	tds := make(TDirMonitors)
-	return &tds
+	return &TDirMonitors{monitors: make(map[string]*TDirMonitor)}
 }
 
+// getItem returns the monitor for dir or an empty one, the caller must hold the lock
 func (dm *TDirMonitors) getItem(dir string) *TDirMonitor {
-	if v, ok := (*dm)[dir]; ok {
+	if v, ok := dm.monitors[dir]; ok {
 		return v
 	}
 	return &TDirMonitor{
-		notifywatch.NotifyWatcher{},
+		&notifywatch.NotifyWatcher{},
 		time.Time{},
 		time.Time{},
 		time.Duration(0),
 		false,
+		nil,
+		nil,
+		0,
+		time.Time{},
+		false,
+		nil,
+		false,
 	}
 }
 
 func (dm *TDirMonitors) Status() *TDirMonitorsStatus {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
 	dms := &TDirMonitorsStatus{
 		Dirty:            false,
 		ScanStartedLast:  time.Time{},
 		ScanFinishedLast: time.Time{},
 		ScanLongestLast:  time.Duration(0),
+		Overflows:        0,
+		OverflowLast:     time.Time{},
 	}
-	for _, k := range dm.keys() {
-		if dms.ScanStartedLast.Before((*dm)[k].scanStarted()) {
-			dms.ScanStartedLast = (*dm)[k].scanStarted()
+	for _, m := range dm.monitors {
+		if dms.ScanStartedLast.Before(m.scanStarted()) {
+			dms.ScanStartedLast = m.scanStarted()
+		}
+		if dms.ScanFinishedLast.Before(m.scanFinished()) {
+			dms.ScanFinishedLast = m.scanFinished()
 		}
-		if dms.ScanFinishedLast.Before((*dm)[k].scanFinished()) {
-			dms.ScanFinishedLast = (*dm)[k].scanFinished()
+		if dms.ScanLongestLast < m.dlastscan {
+			dms.ScanLongestLast = m.dlastscan
 		}
-		if dms.ScanLongestLast < (*dm)[k].dlastscan {
-			dms.ScanLongestLast = (*dm)[k].dlastscan
+		if dms.OverflowLast.Before(m.toverflow) {
+			dms.OverflowLast = m.toverflow
 		}
-		dms.Dirty = dms.Dirty || (*dm)[k].isDirty()
+		dms.Overflows += m.overflows
+		dms.Dirty = dms.Dirty || m.isDirty()
 	}
 	return dms
 }
 
 // overlappedDirs returns all dirs that should be removed from the set {dir, Dirs()} because they are overlapped by a parent from the set (i.e. the returned list contains all entries that are under other entries in dir hierarchy)
+// The caller must hold the lock
 func (dm *TDirMonitors) overlappedDirs(dir string) []string {
-	alldirs := append(dm.Dirs(), dir)
+	alldirs := append(dm.keys(), dir)
 	filtdirs := ggu.FilterCommonRootDirs(alldirs)
 	rmdirs := []string{}
 	for _, d := range alldirs {
@@ -124,19 +169,23 @@ func (dm *TDirMonitors) overlappedDirs(dir string) []string {
 
 // AddDir adds dir to the DirMonitors collection with a new DirMonitor instance, while removing all overlapping dirs
 func (dm *TDirMonitors) AddDir(dir string, recursive bool, handler notifywatch.NotifyHandlerFun, events ...notify.Event) *TDirMonitor {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
 	unwanted := dm.overlappedDirs(dir)
 	if ggu.InSlice(dir, unwanted) {
 		unwanted = ggu.RemoveFromStringSlice(dir, unwanted)
 	}
 	if len(unwanted) > 0 {
-		dm.RemoveDirs(unwanted...)
+		for _, d := range unwanted {
+			_ = dm.removeDir(d)
+		}
 		return nil
 	}
-	if v, ok := (*dm)[dir]; ok {
+	if v, ok := dm.monitors[dir]; ok {
 		return v // ignore if exists
 	}
-	(*dm)[dir] = newDirMonitor(dir, recursive, handler, events...)
-	return (*dm)[dir]
+	dm.monitors[dir] = newDirMonitor(dir, recursive, handler, events...)
+	return dm.monitors[dir]
 }
 
 // RemoveDirs removes dirs from the container
@@ -150,21 +199,94 @@ func (dm *TDirMonitors) RemoveDirs(dirs ...string) error {
 
 // RemoveDir removes dir from the container
 func (dm *TDirMonitors) RemoveDir(dir string) error {
-	if _, ok := (*dm)[dir]; !ok {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	return dm.removeDir(dir)
+}
+
+// removeDir stops and removes the monitor for dir, the caller must hold the lock
+func (dm *TDirMonitors) removeDir(dir string) error {
+	m, ok := dm.monitors[dir]
+	if !ok {
 		return fmt.Errorf("monitor for %s doesn't exist, watcher not removed", dir)
 	}
-	err := (*dm)[dir].Stop() // TBC: do we need to handle the error? probably not, because it's basically a warning (channel already closed)
-	delete(*dm, dir)         // no need to check existence, delete non-existing is no-op
+	if m.cancelScan != nil {
+		m.cancelScan()
+	}
+	if m.rescanTimer != nil {
+		m.rescanTimer.Stop()
+	}
+	err := m.Stop()          // TBC: do we need to handle the error? probably not, because it's basically a warning (channel already closed)
+	delete(dm.monitors, dir) // no need to check existence, delete non-existing is no-op
 	return err
 }
 
+// forget removes the monitor for dir after its watcher stopped, if it is still m (it could have been replaced in the meantime)
+func (dm *TDirMonitors) forget(dir string, m *TDirMonitor) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if dm.monitors[dir] == m {
+		_ = dm.removeDir(dir) // only an "already stopped" error
+	}
+}
+
+// Get returns the monitor for dir and whether dir is registered
+// Only its watcher methods may be used directly, its scan state is accessed through the TDirMonitors methods (e.g. ScanRunning(dir))
+func (dm *TDirMonitors) Get(dir string) (*TDirMonitor, bool) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	m, ok := dm.monitors[dir]
+	return m, ok
+}
+
+// Range calls fn for all registered dirs and their monitors (see Get) until fn returns false
+// It iterates over a copy of the registry, so fn may call other TDirMonitors methods
+func (dm *TDirMonitors) Range(fn func(dir string, m *TDirMonitor) bool) {
+	dm.mu.RLock()
+	monitors := make(map[string]*TDirMonitor, len(dm.monitors))
+	for d, m := range dm.monitors {
+		monitors[d] = m
+	}
+	dm.mu.RUnlock()
+	for d, m := range monitors {
+		if !fn(d, m) {
+			return
+		}
+	}
+}
+
+// withMonitor calls fn with the monitor for dir while holding the lock, it returns false if dir isn't registered
+// fn must not call any other TDirMonitors method
+func (dm *TDirMonitors) withMonitor(dir string, fn func(m *TDirMonitor)) bool {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	m, ok := dm.monitors[dir]
+	if ok {
+		fn(m)
+	}
+	return ok
+}
+
+// each calls fn for all monitors while holding the lock, fn must not call any other TDirMonitors method
+func (dm *TDirMonitors) each(fn func(dir string, m *TDirMonitor)) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	for d, m := range dm.monitors {
+		fn(d, m)
+	}
+}
+
 // Dirs returns a slice of all registered dirs
 func (dm *TDirMonitors) Dirs() []string {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
 	return dm.keys()
 }
 
 func (dm *TDirMonitors) hasElem(key string) bool {
-	_, ok := (*dm)[key]
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	_, ok := dm.monitors[key]
 	return ok
 }
 
@@ -175,38 +297,142 @@ func (dm *TDirMonitors) Contains(dir string) bool {
 
 // ScanRunning reports whether a ssscan on dir is currently running
 func (dm *TDirMonitors) ScanRunning(dir string) bool {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
 	return dm.getItem(dir).scanRunning()
 }
 
 // ScanFinish updates start time for dir
 func (dm *TDirMonitors) ScanStart(dir string) {
-	if v, ok := (*dm)[dir]; ok {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if v, ok := dm.monitors[dir]; ok {
 		v.scanStart()
 		v.dirty = true
 	}
 	// completely ignored if dir is not registered (= a pain for debugging?)
 }
 
+// scanStartIdle starts a scan of dir with cancel like ScanStart, unless a scan is already running, which returns false
+// Unlike separate calls of ScanRunning and ScanStart, this can't start two scans concurrently
+func (dm *TDirMonitors) scanStartIdle(dir string, cancel context.CancelFunc) bool {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	v, ok := dm.monitors[dir]
+	if !ok {
+		return true // not tracked
+	}
+	if v.scanRunning() {
+		return false
+	}
+	v.scanStart()
+	v.dirty = true
+	v.cancelScan = cancel
+	return true
+}
+
 // ScanFinish updates finished time for dir
+// dir stays dirty if a rescan is pending, because the scan might have missed changes
 func (dm *TDirMonitors) ScanFinish(dir string) {
-	if v, ok := (*dm)[dir]; ok {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if v, ok := dm.monitors[dir]; ok {
 		v.scanFinish()
-		v.dirty = false
+		v.dirty = v.rescanPending
 	}
 	// completely ignored if dir is not registered (= a pain for debugging?)
 }
 
+// ScanAbort updates finished time for dir after an incomplete scan, dir stays dirty
+func (dm *TDirMonitors) ScanAbort(dir string) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if v, ok := dm.monitors[dir]; ok {
+		v.scanFinish()
+	}
+}
+
+// CancelScan cancels the running scan of dir, returns false if no scan was running
+func (dm *TDirMonitors) CancelScan(dir string) bool {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if v, ok := dm.monitors[dir]; ok && v.cancelScan != nil && v.scanRunning() {
+		v.cancelScan()
+		return true
+	}
+	return false
+}
+
+// Overflow records an event queue overflow for dir, which marks it dirty until a rescan has finished
+func (dm *TDirMonitors) Overflow(dir string) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if v, ok := dm.monitors[dir]; ok {
+		v.overflows++
+		v.toverflow = time.Now()
+		v.rescanPending = true
+		v.dirty = true
+	}
+}
+
+// removedWhileScanning marks the registered dir containing the removed path for a rescan if a scan of it is running, and returns it
+// The scan may have stored path before it was removed, so only a rescan deletes it again
+func (dm *TDirMonitors) removedWhileScanning(path string) (string, bool) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	for dir, m := range dm.monitors {
+		if (path == dir || strings.HasPrefix(path, utils.DirTrailSep(dir))) && m.scanRunning() {
+			m.rescanPending = true
+			m.dirty = true
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// Overflows returns the number of event queue overflows for dir
+func (dm *TDirMonitors) Overflows(dir string) uint64 {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return dm.getItem(dir).overflows
+}
+
+// ExcludeRules returns the exclusion rules for dir (nil if none are set or dir isn't registered)
+func (dm *TDirMonitors) ExcludeRules(dir string) *exclude.Rules {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return dm.getItem(dir).excludeRules
+}
+
+// excludeRulesFor returns the exclusion rules of the registered dir containing path
+func (dm *TDirMonitors) excludeRulesFor(path string) *exclude.Rules {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	for dir, m := range dm.monitors {
+		if path == dir || strings.HasPrefix(path, utils.DirTrailSep(dir)) {
+			return m.excludeRules
+		}
+	}
+	return nil
+}
+
 // ScanStarted returns the time the last scan was started
 func (dm *TDirMonitors) ScanStarted(dir string) time.Time {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
 	return dm.getItem(dir).scanStarted()
 }
 
 // ScanFinished returns the time the last scan was started
 func (dm *TDirMonitors) ScanFinished(dir string) time.Time {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
 	return dm.getItem(dir).scanFinished()
 }
 
 // IsDirty reports dirty status, i.e. if the DB for dir is up to date or being updated
 func (dm *TDirMonitors) IsDirty(dir string) bool {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
 	return dm.getItem(dir).isDirty()
 }
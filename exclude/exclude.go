@@ -0,0 +1,209 @@
+package exclude
+
+// exclude implements the rules deciding which paths under a root are excluded from scanning and watching
+// Patterns have gitignore syntax (https://git-scm.com/docs/gitignore#_pattern_format):
+//   - blank lines and lines starting with "#" are ignored
+//   - a leading "!" re-includes paths excluded by an earlier pattern (the last matching pattern wins)
+//   - a trailing "/" matches only directories
+//   - a pattern with a "/" at the beginning or in the middle is anchored at the root, otherwise it matches at any level
+//   - "*" matches anything but "/", "?" matches one char but "/", "[...]" matches a char class
+//   - "**/" matches in all directories, "/**" matches everything inside, "/**/" matches zero or more directories
+// Like in git, a path under an excluded directory is always excluded, it can't be re-included
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Options is the (uncompiled) configuration of a rule set
+type Options struct {
+	Patterns      []string // gitignore syntax, relative to the root
+	ExcludeHidden bool     // exclude all files and dirs whose name starts with "."
+	MinSize       uint64   // exclude regular files smaller than MinSize
+	MaxSize       uint64   // exclude regular files larger than MaxSize (0: no limit)
+}
+
+type pattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Rules is a compiled rule set for one root, a nil *Rules excludes nothing
+type Rules struct {
+	root     string
+	patterns []pattern
+	opts     Options
+}
+
+// New compiles the rules in opts for paths under root
+func New(root string, opts Options) (*Rules, error) {
+	r := &Rules{root: filepath.Clean(root), opts: opts}
+	for _, p := range opts.Patterns {
+		pat, ok, err := compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %w", p, err)
+		}
+		if ok {
+			r.patterns = append(r.patterns, pat)
+		}
+	}
+	return r, nil
+}
+
+// Root returns the root dir the rules are relative to
+func (r *Rules) Root() string {
+	if r == nil {
+		return ""
+	}
+	return r.root
+}
+
+// Options returns the options the rules were compiled from
+func (r *Rules) Options() Options {
+	if r == nil {
+		return Options{}
+	}
+	return r.opts
+}
+
+// compile translates a gitignore pattern to a regexp matching the slash separated path relative to the root
+// ok is false for blank lines and comments
+func compile(p string) (pat pattern, ok bool, err error) {
+	p = strings.TrimRight(p, " \t\r")
+	if p == "" || strings.HasPrefix(p, "#") {
+		return pat, false, nil
+	}
+	if strings.HasPrefix(p, "!") {
+		pat.negate = true
+		p = p[1:]
+	} else if strings.HasPrefix(p, `\!`) || strings.HasPrefix(p, `\#`) {
+		p = p[1:]
+	}
+	if strings.HasSuffix(p, "/") {
+		pat.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	if p == "" {
+		return pat, false, nil
+	}
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	if !anchored {
+		sb.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; c {
+		case '*':
+			if strings.HasPrefix(p[i:], "**") {
+				atStart := i == 0 || p[i-1] == '/'
+				rest := p[i+2:]
+				if atStart && strings.HasPrefix(rest, "/") { // "**/": zero or more dirs
+					sb.WriteString("(?:.*/)?")
+					i += 2
+					continue
+				} else if atStart && rest == "" { // trailing "/**": everything inside
+					sb.WriteString(".*")
+					i++
+					continue
+				}
+			}
+			sb.WriteString("[^/]*")
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(p[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := p[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(p) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(p[i : i+1]))
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	pat.re, err = regexp.Compile(sb.String())
+	return pat, err == nil, err
+}
+
+// rel returns the slash separated path relative to the root, ok is false for the root itself and paths outside the root
+func (r *Rules) rel(path string) (string, bool) {
+	path = strings.TrimSuffix(filepath.Clean(path), string(filepath.Separator))
+	rel, err := filepath.Rel(r.root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// matchRel checks one slash separated relative path against the patterns and the hidden rule (not against its parents)
+func (r *Rules) matchRel(rel string, isDir bool) bool {
+	if r.opts.ExcludeHidden && strings.HasPrefix(rel[strings.LastIndexByte(rel, '/')+1:], ".") {
+		return true
+	}
+	excluded := false
+	for _, p := range r.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.re.MatchString(rel) {
+			excluded = !p.negate
+		}
+	}
+	return excluded
+}
+
+func (r *Rules) sizeExcluded(isDir bool, size uint64) bool {
+	return !isDir && (size < r.opts.MinSize || (r.opts.MaxSize > 0 && size > r.opts.MaxSize))
+}
+
+// ExcludedEntry reports whether path is excluded by itself, without checking its parent dirs
+// This is what a walker needs, which doesn't descend into excluded dirs anyway
+func (r *Rules) ExcludedEntry(path string, isDir bool, size uint64) bool {
+	if r == nil {
+		return false
+	}
+	rel, ok := r.rel(path)
+	if !ok {
+		return false
+	}
+	return r.matchRel(rel, isDir) || r.sizeExcluded(isDir, size)
+}
+
+// ExcludedDir reports whether the dir path is excluded by itself, without checking its parent dirs
+func (r *Rules) ExcludedDir(path string) bool {
+	return r.ExcludedEntry(path, true, 0)
+}
+
+// Excluded reports whether path is excluded by itself or because one of its parent dirs (up to the root) is excluded
+func (r *Rules) Excluded(path string, isDir bool, size uint64) bool {
+	if r == nil {
+		return false
+	}
+	rel, ok := r.rel(path)
+	if !ok {
+		return false
+	}
+	for i := 0; i < len(rel); i++ {
+		if rel[i] == '/' && r.matchRel(rel[:i], true) {
+			return true
+		}
+	}
+	return r.matchRel(rel, isDir) || r.sizeExcluded(isDir, size)
+}
@@ -0,0 +1,133 @@
+package exclude
+
+import (
+	"testing"
+)
+
+func TestRules_Excluded(t *testing.T) {
+	type check struct {
+		path  string
+		isDir bool
+		size  uint64
+		want  bool
+	}
+	tests := []struct {
+		name   string
+		opts   Options
+		checks []check
+	}{
+		{
+			name: "nil rules",
+			checks: []check{
+				{"/r/a", false, 0, false},
+			},
+		},
+		{
+			name: "unanchored names match at any level",
+			opts: Options{Patterns: []string{"@eaDir", ".snapshot", "node_modules/", "*.tmp"}},
+			checks: []check{
+				{"/r/@eaDir", true, 0, true},
+				{"/r/photos/@eaDir", true, 0, true},
+				{"/r/photos/@eaDir/thumb.jpg", false, 10, true},
+				{"/r/.snapshot/daily/file", false, 10, true},
+				{"/r/src/node_modules", true, 0, true},
+				{"/r/src/node_modules", false, 0, false}, // dir only pattern
+				{"/r/src/node_modules/x/y.js", false, 1, true},
+				{"/r/a/b.tmp", false, 1, true},
+				{"/r/a/b.tmpx", false, 1, false},
+				{"/r/a/b", false, 1, false},
+			},
+		},
+		{
+			name: "anchored patterns and globstars",
+			opts: Options{Patterns: []string{"/build", "docs/*.pdf", "**/cache/", "logs/**", "a/**/z"}},
+			checks: []check{
+				{"/r/build", true, 0, true},
+				{"/r/sub/build", true, 0, false},
+				{"/r/docs/x.pdf", false, 1, true},
+				{"/r/docs/sub/x.pdf", false, 1, false},
+				{"/r/cache", true, 0, true},
+				{"/r/x/y/cache/f", false, 1, true},
+				{"/r/logs", true, 0, false},
+				{"/r/logs/2022/app.log", false, 1, true},
+				{"/r/a/z", false, 1, true},
+				{"/r/a/b/c/z", false, 1, true},
+				{"/r/b/a/z", false, 1, false},
+			},
+		},
+		{
+			name: "negation, comments and char classes",
+			opts: Options{Patterns: []string{"# comment", "", "*.log", "!keep.log", "[Tt]humbs.db", "x[!0-9]"}},
+			checks: []check{
+				{"/r/a.log", false, 1, true},
+				{"/r/d/keep.log", false, 1, false},
+				{"/r/Thumbs.db", false, 1, true},
+				{"/r/thumbs.db", false, 1, true},
+				{"/r/xa", false, 1, true},
+				{"/r/x1", false, 1, false},
+				{"/r/# comment", false, 1, false},
+			},
+		},
+		{
+			name: "excluded parent can't be re-included",
+			opts: Options{Patterns: []string{"tmp/", "!tmp/keep"}},
+			checks: []check{
+				{"/r/tmp/keep", false, 1, true},
+			},
+		},
+		{
+			name: "hidden files and sizes",
+			opts: Options{ExcludeHidden: true, MinSize: 10, MaxSize: 100},
+			checks: []check{
+				{"/r/.git", true, 0, true},
+				{"/r/.git/config", false, 50, true},
+				{"/r/a/.hidden", false, 50, true},
+				{"/r/a/visible", false, 50, false},
+				{"/r/a/small", false, 9, true},
+				{"/r/a/large", false, 101, true},
+				{"/r/a/dir", true, 0, false}, // dirs are not size filtered
+			},
+		},
+		{
+			name: "root itself and paths outside the root are never excluded",
+			opts: Options{Patterns: []string{"*"}},
+			checks: []check{
+				{"/r", true, 0, false},
+				{"/r/", true, 0, false},
+				{"/other/x", false, 1, false},
+				{"/rx", false, 1, false},
+				{"/r/x", false, 1, true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r *Rules
+			if tt.name != "nil rules" {
+				var err error
+				if r, err = New("/r", tt.opts); err != nil {
+					t.Fatal(err.Error())
+				}
+			}
+			for _, c := range tt.checks {
+				if got := r.Excluded(c.path, c.isDir, c.size); got != c.want {
+					t.Errorf("Excluded(%q, isDir=%t, size=%d) = %t, want %t", c.path, c.isDir, c.size, got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRules_ExcludedEntry(t *testing.T) {
+	r, err := New("/r", Options{Patterns: []string{"tmp/"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !r.ExcludedDir("/r/a/tmp") {
+		t.Errorf("ExcludedDir() didn't exclude dir")
+	}
+	// the entry check doesn't look at the parents, a walker never gets there
+	if r.ExcludedEntry("/r/tmp/file", false, 1) {
+		t.Errorf("ExcludedEntry() checked parents")
+	}
+}
@@ -9,35 +9,41 @@ import (
 	"os"
 
 	"github.com/Rainc1oud/filetype"
+	filetypes "github.com/Rainc1oud/filetype/types"
 
 	"github.com/Rainc1oud/filetypestats/types"
 )
 
-func getFTStat(path string) (*types.FTypeStat, error) {
-	var (
-		err error = nil
-		fi  fs.FileInfo
-	)
-
-	if fi, err = os.Lstat(path); err != nil {
+// getFTStat returns the file type and metadata of path (without following symlinks)
+func getFTStat(path string) (*types.FileStat, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
 		return nil, err
 	}
+	return fileInfoFTStat(path, fi)
+}
 
-	fts := &types.FTypeStat{}
-
+// fileInfoFTStat returns the file type and metadata of path, with fi obtained from os.Lstat(path)
+func fileInfoFTStat(path string, fi fs.FileInfo) (*types.FileStat, error) {
 	if fi.IsDir() {
-		fts.FType = "dir"
-		fts.Path = path + "/" // add / to make filtering more consistent in SELECT queries
-		fts.FileCount = 0
-		fts.NumBytes = 0
-		return fts, nil
+		return types.NewFileStat(path+"/", "dir", fi), nil // add / to make filtering more consistent in SELECT queries
 	}
 
-	if fts.FType, err = filetype.FileClass(path); err == nil {
-		fts.Path = path
-		fts.NumBytes = uint64(fi.Size())
-		fts.FileCount = 1 // unnecessary, we may need to optimise the handling
-		return fts, nil
+	// the same classification as filetype.FileClass(), but we keep the detected kind for its MIME type
+	kind, err := filetype.MatchFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("no info could be obtained for %v", fi)
+	}
+	return kindFTStat(path, fi, kind), nil
+}
+
+// kindFTStat returns the FileStat of the regular file path whose content was matched as kind
+func kindFTStat(path string, fi fs.FileInfo, kind filetypes.Type) *types.FileStat {
+	ftype, mime := "other", types.UnknownMIME
+	if kind != filetype.Unknown {
+		ftype, mime = filetype.GetType(kind.Extension).MIME.Type, kind.MIME.Value
 	}
-	return nil, fmt.Errorf("no info could be obtained for %v", fi)
+	fst := types.NewFileStat(path, ftype, fi)
+	fst.MIME = mime
+	return fst
 }
@@ -1,86 +1,50 @@
 package filetypestats
 
 // legacy definitions for backwards compatibility
-// recommended usage through TreeFileTypeStats
+// recommended usage through TreeStatsWatcher, or WalkStats for a one-shot scan without DB
 
 import (
+	"context"
 	"fmt"
-	"io/fs"
-	"os"
-
-	"github.com/Rainc1oud/filetype"
-	"github.com/karrick/godirwalk"
+	"path/filepath"
+	"runtime"
+	"time"
 
 	"github.com/Rainc1oud/filetypestats/ftsdb"
 	"github.com/Rainc1oud/filetypestats/types"
+	"github.com/Rainc1oud/filetypestats/utils"
 	"github.com/Rainc1oud/gogenutils"
 )
 
+// WalkFileTypeStatsDB scans scanDirs into the DB in dbfile and returns their totals (see FTStatsSum)
+// Entries of an existing DB under scanDirs that were not updated by the scan (i.e. deleted since) are removed before summing.
+// For totals without DB use WalkStats
 func WalkFileTypeStatsDB(scanDirs []string, dbfile string) (types.FileTypeStats, error) {
-	var err error
-	var fdb *ftsdb.FileTypeStatsDB
-	ftStats := make(types.FileTypeStats)
-	pFtStats := &ftStats
-
-	if fdb, err = ftsdb.New(dbfile, true); err != nil {
-		return nil, err
-	}
-
 	sdirs := gogenutils.FilterCommonRootDirs(scanDirs)
 	if len(sdirs) < 1 {
 		return nil, fmt.Errorf("WalkFileTypeStats:: no scan path(s) specified")
 	}
 
-	for _, d := range sdirs {
+	fdb, err := ftsdb.New(dbfile, true)
+	if err != nil {
+		return nil, err
+	}
+	defer fdb.Close()
+
+	patterns := make([]string, len(sdirs))
+	for i, d := range sdirs {
+		tstart := time.Now()
 		if err = fileTypeStatsDB(d, fdb); err != nil {
 			return nil, err
 		}
+		if err = fdb.DeleteOlderThanWithPrefix(tstart, filepath.Clean(d)); err != nil {
+			return nil, err
+		}
+		patterns[i] = utils.GlobEscape(utils.DirTrailSep(filepath.Clean(d))) + "*"
 	}
-	// TODO: do query and return stats in result
-	fdb.Close()
-	return *pFtStats, nil
+	return fdb.FTStatsSum(patterns)
 }
 
 func fileTypeStatsDB(scanRoot string, fdb *ftsdb.FileTypeStatsDB) error {
-
-	piBuf := types.NewFTypeStatsBatch(pathInfoBatchSize)
-
-	if err := godirwalk.Walk(scanRoot, &godirwalk.Options{
-		AllowNonDirectory: true,
-		Callback: func(osPathname string, de *godirwalk.Dirent) error {
-			var (
-				err   error = nil
-				fi    fs.FileInfo
-				ftype string
-			)
-
-			if de.IsDir() {
-				ftype = "dir"
-				return fdb.UpdateFileStatsMulti(osPathname+"/", ftype, 0, piBuf) // add / to make filtering more consistent in SELECT queries
-			} else if de.IsRegular() {
-				fi, err = os.Stat(osPathname)
-				if err == nil {
-					if ftype, err = filetype.FileClass(osPathname); err == nil {
-						return fdb.UpdateFileStatsMulti(osPathname, ftype, uint64(fi.Size()), piBuf)
-					}
-				}
-			}
-
-			if err != nil {
-				fmt.Fprint(os.Stderr, err.Error())
-			}
-			return nil
-		},
-		Unsorted: true, // (optional) set true for faster yet non-deterministic enumeration (see godoc)
-		ErrorCallback: func(s string, e error) godirwalk.ErrorAction {
-			fmt.Fprintf(os.Stderr, "warning: %s reading %s\n", e.Error(), s)
-			return godirwalk.SkipNode
-		},
-	}); err != nil {
-		return err
-	}
-
-	fdb.CommitBatch(piBuf) // commit any "in-flight" batch
-
-	return nil
+	return newTreeScanner(fdb, scanRoot, ScanOptions{Workers: runtime.NumCPU()}).scan(context.Background())
 }
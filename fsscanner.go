@@ -0,0 +1,139 @@
+package filetypestats
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Rainc1oud/filetype"
+	filetypes "github.com/Rainc1oud/filetype/types"
+	"github.com/Rainc1oud/filetypestats/store"
+	"github.com/Rainc1oud/filetypestats/types"
+)
+
+// FSPathSep separates the prefix of an fs.FS tree from the paths inside it, e.g. "archive.zip!/inner/path"
+const FSPathSep = "!"
+
+// matchHeaderSize is the number of leading bytes the filetype matchers look at, like filetype.MatchReader
+const matchHeaderSize = 8192
+
+// FSPath returns the path under which the entry name of an fs.FS scanned with prefix is stored (see ScanFS)
+// The root "." is the dir prefix+"!/" in the DB, so the whole tree is selected by the pattern GlobEscape(prefix)+"!/*".
+// The entries are stored as members of prefix (see types.FileStat.Archive), so they aren't selected by the patterns selecting prefix itself.
+func FSPath(prefix, name string) string {
+	root := filepath.Clean(prefix) + FSPathSep
+	if name == "." {
+		return root
+	}
+	return root + "/" + name
+}
+
+// ScanFS scans the tree of fsys (e.g. a zip.Reader, embed.FS or fstest.MapFS) into db, with every entry stored under FSPath(prefix, name)
+// Files are classified from their header bytes like on the OS filesystem, the metadata fsys doesn't provide (e.g. inodes) is left zero.
+// The opts.Exclude rules apply to the stored paths, i.e. their root is FSPath(prefix, "."). Of the opts, Dedup has no effect,
+// since the files can't be read by their stored path.
+// Entries under the prefix that were not updated are deleted after a complete scan, like in TreeStatsWatcher.ScanDirContext.
+// If ctx is cancelled, the scan stops as soon as possible and returns ctx.Err(), the results obtained so far are still stored.
+func ScanFS(ctx context.Context, db store.Store, fsys fs.FS, prefix string, opts ScanOptions) error {
+	tstart := time.Now()
+	s := newFSScanner(db, fsys, prefix, opts)
+	if err := s.scan(ctx); err != nil {
+		return err
+	}
+	return db.DeleteOlderThanWithPrefix(tstart, s.root)
+}
+
+// newFSScanner returns a treeScanner that reads the tree from fsys and stores it under FSPath(prefix, ...)
+func newFSScanner(db scanSink, fsys fs.FS, prefix string, opts ScanOptions) *treeScanner {
+	s := newTreeScanner(db, FSPath(prefix, "."), opts)
+	s.fsys, s.archive = fsys, filepath.Clean(prefix)
+	return s
+}
+
+// fsName returns the name in s.fsys of the stored path, the inverse of FSPath
+func (s *treeScanner) fsName(path string) string {
+	if path == s.root {
+		return "."
+	}
+	return strings.TrimPrefix(path, s.root+"/")
+}
+
+// walkFS walks s.fsys and classifies all dirs and regular files, serially or with s.opts.Workers classification workers
+func (s *treeScanner) walkFS(ctx context.Context) error {
+	if s.opts.Workers <= 1 {
+		return s.walkFSTree(ctx, func(path string) {
+			for _, fst := range s.classifyAll(path) {
+				s.store(fst)
+			}
+		})
+	}
+	return s.classifyParallel(ctx, func(jobs chan<- string) error {
+		return s.walkFSTree(ctx, func(path string) { jobs <- path })
+	})
+}
+
+// walkFSTree calls visit with the stored path of every dir and regular file in s.fsys, excluded dirs are not descended into
+func (s *treeScanner) walkFSTree(ctx context.Context, visit func(path string)) error {
+	return fs.WalkDir(s.fsys, ".", func(name string, de fs.DirEntry, err error) error {
+		if cerr := ctx.Err(); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			if name == "." && de == nil { // the root itself can't be read
+				return err
+			}
+			s.errors.Add(1)
+			return nil // skip unreadable entries, like walkSerial()
+		}
+		if !(de.IsDir() || de.Type().IsRegular()) {
+			return nil
+		}
+		path := s.fsPath(name)
+		if de.IsDir() && name != "." && s.opts.Exclude.ExcludedDir(path) {
+			return fs.SkipDir
+		}
+		visit(path)
+		return nil
+	})
+}
+
+// fsPath returns the stored path of the entry name of s.fsys
+func (s *treeScanner) fsPath(name string) string {
+	if name == "." {
+		return s.root
+	}
+	return s.root + "/" + name
+}
+
+// fsFileInfoFTStat returns the file type and metadata of the entry name of fsys stored as path, with fi obtained from fs.Lstat(fsys, name)
+func fsFileInfoFTStat(fsys fs.FS, name, path string, fi fs.FileInfo) (*types.FileStat, error) {
+	if fi.IsDir() {
+		return types.NewFileStat(path+"/", "dir", fi), nil
+	}
+	fh, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	kind, _, err := matchHeader(fh)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return kindFTStat(path, fi, kind), nil
+}
+
+// matchHeader matches the leading bytes of r with the filetype matchers, it returns them too (at most matchHeaderSize)
+// Unlike filetype.MatchReader it reads the whole header, since readers of compressed entries return short reads.
+func matchHeader(r io.Reader) (filetypes.Type, []byte, error) {
+	buf := make([]byte, matchHeaderSize) // zero padded like in filetype.MatchReader
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return filetype.Unknown, nil, err
+	}
+	kind, err := filetype.Match(buf)
+	return kind, buf[:n], err
+}
@@ -0,0 +1,133 @@
+package filetypestats
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/Rainc1oud/filetypestats/exclude"
+	"github.com/Rainc1oud/filetypestats/types"
+	"github.com/Rainc1oud/filetypestats/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// zipTree writes the tree under root to the zip file zipPath, with deflated files and explicit dir entries
+func zipTree(t testing.TB, root, zipPath string) {
+	zf, err := os.Create(zipPath)
+	require.NoError(t, err)
+	defer zf.Close()
+	zw := zip.NewWriter(zf)
+	require.NoError(t, filepath.WalkDir(root, func(path string, de fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		name, _ := filepath.Rel(root, path)
+		if de.IsDir() {
+			_, err := zw.Create(name + "/")
+			return err
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate})
+		if err != nil {
+			return err
+		}
+		fh, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		_, err = io.Copy(w, fh)
+		return err
+	}))
+	require.NoError(t, zw.Close())
+}
+
+// classSums returns the counts and bytes per class of fts, without their paths
+func classSums(fts types.FileTypeStats) map[string][2]uint64 {
+	sums := make(map[string][2]uint64, len(fts))
+	for k, s := range fts {
+		sums[k] = [2]uint64{uint64(s.FileCount), s.NumBytes}
+	}
+	return sums
+}
+
+func TestScanFS(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	genTree(t, src, 2, 2, 6)
+	zipPath := filepath.Join(dir, "tree.zip")
+	zipTree(t, src, zipPath)
+	zr, err := zip.OpenReader(zipPath)
+	require.NoError(t, err)
+	defer zr.Close()
+
+	fdb := tmpStore(t)
+	require.NoError(t, newTreeScanner(fdb, src, ScanOptions{}).scan(context.Background()))
+	want, err := fdb.FTStatsSum([]string{utils.GlobEscape(src) + "/*"})
+	require.NoError(t, err)
+
+	for _, workers := range []int{1, 4} {
+		require.NoError(t, ScanFS(context.Background(), fdb, zr, zipPath, ScanOptions{Workers: workers}))
+		got, err := fdb.FTStatsSum([]string{utils.GlobEscape(zipPath) + "!/*"})
+		require.NoError(t, err)
+		assert.Equal(t, classSums(want), classSums(got), "workers %d", workers)
+	}
+	fst, err := fdb.GetFileStat(FSPath(zipPath, "dir00/file000"))
+	require.NoError(t, err)
+	require.NotNil(t, fst)
+	assert.Equal(t, zipPath+"!/dir00/file000", fst.Path)
+	assert.Equal(t, "image", fst.FType)
+	assert.Equal(t, "image/png", fst.MIME)
+	fst, err = fdb.GetFileStat(utils.DirTrailSep(FSPath(zipPath, "."))) // stored like all dirs
+	require.NoError(t, err)
+	require.NotNil(t, fst)
+	assert.Equal(t, zipPath+"!/", fst.Path)
+	assert.Equal(t, "dir", fst.FType)
+
+	// the OS filesystem through fs.FS gives the same totals
+	prefix := filepath.Join(dir, "dirfs")
+	require.NoError(t, ScanFS(context.Background(), fdb, os.DirFS(src), prefix, ScanOptions{}))
+	got, err := fdb.FTStatsSum([]string{utils.GlobEscape(prefix) + "!/*"})
+	require.NoError(t, err)
+	assert.Equal(t, classSums(want), classSums(got))
+}
+
+func TestScanFS_Rescan(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	fsys := fstest.MapFS{
+		"a/img.png":  {Data: testFileHeaders[0], ModTime: mtime},
+		"a/doc.pdf":  {Data: testFileHeaders[3], ModTime: mtime},
+		"b/text.txt": {Data: testFileHeaders[4], ModTime: mtime},
+		"excl/x.png": {Data: testFileHeaders[0], ModTime: mtime},
+	}
+	fdb := tmpStore(t)
+	prefix := "/virtual/mem[1]"
+	rules, err := exclude.New(FSPath(prefix, "."), exclude.Options{Patterns: []string{"excl/"}})
+	require.NoError(t, err)
+	opts := ScanOptions{Incremental: true, Exclude: rules}
+	require.NoError(t, ScanFS(context.Background(), fdb, fsys, prefix, opts))
+	got, err := fdb.FTStatsSum([]string{utils.GlobEscape(prefix) + "!/*"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint{"dir": 3, "image": 1, "application": 1, "other": 1, "total": 6}, fileCounts(got))
+
+	// the changed file is classified again, the excluded dir is never scanned
+	fsys["a/img.png"] = &fstest.MapFile{Data: testFileHeaders[4], ModTime: mtime}
+	require.NoError(t, ScanFS(context.Background(), fdb, fsys, prefix, opts))
+	got, err = fdb.FTStatsSum([]string{utils.GlobEscape(prefix) + "!/*"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint{"dir": 3, "application": 1, "other": 2, "total": 6}, fileCounts(got))
+
+	sub, err := fs.Sub(fsys, "missing")
+	require.NoError(t, err)
+	assert.Error(t, ScanFS(context.Background(), fdb, sub, "/virtual/missing", ScanOptions{}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, ScanFS(ctx, fdb, fsys, prefix, ScanOptions{}), context.Canceled)
+}
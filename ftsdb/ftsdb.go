@@ -2,12 +2,16 @@ package ftsdb
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/Rainc1oud/filetypestats/store"
 	"github.com/Rainc1oud/filetypestats/types"
 	"github.com/Rainc1oud/filetypestats/utils"
 	_ "github.com/mattn/go-sqlite3"
@@ -18,13 +22,29 @@ import (
 // So: init the filetypes table when creating the DB
 
 type FileTypeStatsDB struct {
-	fileName string
-	DB       *sql.DB
-	IsOpened bool
-	dbmutex  sync.Mutex
+	fileName  string
+	DB        *sql.DB
+	IsOpened  bool
+	dbmutex   sync.Mutex
+	stmts     map[string]*sql.Stmt // prepared statement cache, see stmt()
+	stmtmutex sync.Mutex
+	// retention policy applied when taking snapshots, guarded by dbmutex
+	snapRetention SnapshotRetention
 }
 
+// FileTypeStatsDB is the sqlite store, with snapshots and the duplicate detection
+var (
+	_ store.Store            = (*FileTypeStatsDB)(nil)
+	_ store.Snapshotter      = (*FileTypeStatsDB)(nil)
+	_ store.HashStore        = (*FileTypeStatsDB)(nil)
+	_ store.TopLister        = (*FileTypeStatsDB)(nil)
+	_ store.SizeHistogrammer = (*FileTypeStatsDB)(nil)
+	_ store.SnapshotReader   = (*FileTypeStatsDB)(nil)
+	_ store.DuplicateFinder  = (*FileTypeStatsDB)(nil)
+)
+
 // New returns a DB instance to the sqlite db in existing file or creates it if it doesn't exist and create==true
+// Databases with an older schema are upgraded, databases with a newer schema are refused with a *SchemaVersionError
 func New(file string, create bool) (*FileTypeStatsDB, error) {
 	var err error
 	ftdb := new(FileTypeStatsDB)
@@ -34,6 +54,11 @@ func New(file string, create bool) (*FileTypeStatsDB, error) {
 		return nil, err
 	}
 	err = ftdb.initDB()
+	var sverr *SchemaVersionError
+	if errors.As(err, &sverr) { // we must not touch a DB we don't understand
+		ftdb.DB.Close()
+		return nil, err
+	}
 	ftdb.IsOpened = true
 	return ftdb, err
 }
@@ -66,6 +91,7 @@ func openDB(dbfile string, create bool) (*sql.DB, error) {
 func (f *FileTypeStatsDB) Open() error {
 	var err error
 	if !f.IsOpened {
+		f.closeStmts() // statements are bound to the previous handle
 		if f.DB, err = sql.Open("sqlite3", f.fileName); err != nil {
 			return err
 		}
@@ -75,12 +101,13 @@ func (f *FileTypeStatsDB) Open() error {
 }
 
 func (f *FileTypeStatsDB) Close() {
+	f.closeStmts()
 	f.DB.Close()
 	f.IsOpened = false
 }
 
 func (f *FileTypeStatsDB) initDB() error {
-	if err := f.createTables(); err != nil {
+	if err := f.migrate(); err != nil {
 		return err
 	}
 
@@ -92,51 +119,22 @@ func (f *FileTypeStatsDB) initDB() error {
 }
 
 func (f *FileTypeStatsDB) initCats() error {
-	cats := types.FClassNames()
-	qryl := make([]string, len(cats)+2)
-	qryl[0] = "BEGIN TRANSACTION"
-	i := 1
-	for _, c := range cats {
-		qryl[i] = fmt.Sprintf(
-			`INSERT INTO cats(filecat) VALUES('%s')
-				ON CONFLICT(filecat) DO NOTHING`,
-			c,
-		)
-		i += 1
-	}
-	qryl[i] = "COMMIT;"
-	qry := strings.Join(qryl, ";\n")
-
-	if _, err := f.DB.Exec(qry); err != nil {
+	tx, err := f.DB.Begin()
+	if err != nil {
 		return err
 	}
-
-	return nil
-}
-
-func (f *FileTypeStatsDB) createTables() error {
-
-	// the updated field is INTEGER as unix time (sec), for efficientcy (https://stackoverflow.com/q/31667495/12771809)
-	if _, err := f.DB.Exec(
-		`CREATE TABLE IF NOT EXISTS fileinfo (
-			path TEXT NOT NULL,
-			size BIGINT,
-			catid INTEGER NOT NULL,
-			updated INTEGER,
-			PRIMARY KEY (path)
-		);`); err != nil {
+	st, err := f.txStmt(tx, qryInsertCat)
+	if err != nil {
+		tx.Rollback()
 		return err
 	}
-
-	if _, err := f.DB.Exec(
-		`CREATE TABLE IF NOT EXISTS cats (
-			id INTEGER PRIMARY KEY,
-			filecat TEXT UNIQUE
-		);`); err != nil {
-		return err
+	for _, c := range types.FClassNames() {
+		if _, err := st.Exec(c); err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
-
-	return nil
+	return tx.Commit()
 }
 
 // Paths are selected according to the following rules:
@@ -147,163 +145,525 @@ func (f *FileTypeStatsDB) createTables() error {
 // path="/my/dir*/" => count ony the contents of dirs matching /my/dir*/
 // path="/my/file" => count only "/my/file"
 // path="/my/file*" => count all files matching "/my/file*"
+// The members of expanded archives (see types.FileStat.Archive) are only counted by paths inside their archive, i.e. not selecting the archive:
+// path="/my/dir/*" doesn't count the members of "/my/dir/a.zip", path="/my/dir/a.zip!/*" counts them (but not those of archives in a.zip)
 
 // FTDumpPaths returns all paths and raw info selected by the paths argument
-// FIXME: this does not work (yet) of len(paths)>500, but this function is (should be!)
+// FIXME: this does not work (yet) of len(paths)>333, but this function is (should be!)
 // only used in the testcli, so not a real issue
 func (f *FileTypeStatsDB) FTDumpPaths(paths []string) (*[]types.FTypeStat, error) {
-	wp := f.pathsWherePredicate(paths)
 	fts := make([]types.FTypeStat, 0)
-	rs, err := f.DB.Query(fmt.Sprintf(
+	seen := newSeenPaths(paths, maxWhereCond/pathArgs)
+	err := f.pathsQuery(
 		`SELECT fileinfo.path AS Path, cats.filecat AS Category, fileinfo.size AS Size FROM fileinfo,cats
 			WHERE fileinfo.catid=cats.id AND (%s)`,
-		wp,
-	))
-	if err != nil {
-		return &fts, err
+		nil, nil, paths, maxWhereCond/pathArgs, f.pathsWherePredicate, func(rs *sql.Rows) error {
+			var (
+				path     string
+				filecat  string
+				filesize uint64
+			)
+			if err := rs.Scan(&path, &filecat, &filesize); err != nil {
+				return err
+			}
+			if seen.add(path) {
+				fts = append(fts, types.FTypeStat{Path: path, FType: filecat, NumBytes: filesize, FileCount: 0})
+			}
+			return nil
+		})
+	return &fts, err
+}
+
+// FTStatsSum returns the summary FileTypeStats for the given paths as a map of FTypeStat per File Type
+// To circumvent the limits on WHERE conditions and bound variables for long path lists, the paths are summed in chunks,
+// each with a SELECT of its own, and the chunk sums are added up with the "totals" record here (see pathsQuery)
+// Literal directories ("/my/dir/*" or "/my/dir/", also escaped with utils.GlobEscape) are answered from the pre-aggregated dirstats
+// instead, see DirStatsSum, unless another path may select the same entries; only the other paths are summed from fileinfo
+func (f *FileTypeStatsDB) FTStatsSum(paths []string) (types.FileTypeStats, error) {
+	dirs, rest := splitDirPatterns(paths)
+	if len(dirs) == 0 {
+		return f.ftStatsSum(paths, "cats.filecat", "", types.SumOptions{})
+	} else if len(paths) == 1 {
+		return f.dirStatsSum(dirs[0].dir, dirs[0].recursive, paths[0])
 	}
-	defer rs.Close()
+	sums := make(types.FileTypeStats)
+	merge := func(fts types.FileTypeStats) {
+		for fcat, s := range fts {
+			if sum, ok := sums[fcat]; ok {
+				sum.FileCount, sum.NumBytes = sum.FileCount+s.FileCount, sum.NumBytes+s.NumBytes
+			} else {
+				sums[fcat] = s
+			}
+		}
+	}
+	for _, d := range dirs {
+		fts, err := f.dirStatsSum(d.dir, d.recursive, d.pattern)
+		if err != nil {
+			return make(types.FileTypeStats), err
+		}
+		merge(fts)
+	}
+	if len(rest) > 0 {
+		fts, err := f.ftStatsSum(rest, "cats.filecat", "", types.SumOptions{})
+		if err != nil {
+			return make(types.FileTypeStats), err
+		}
+		merge(fts)
+	}
+	ftstats := make(types.FileTypeStats, len(sums))
+	for fcat, s := range sums {
+		addSum(ftstats, paths, fcat, "", s.FileCount, s.NumBytes)
+	}
+	return ftstats, nil
+}
 
-	var (
-		path     string
-		filecat  string
-		filesize uint64
-	)
+// FTStatsSumBy returns the summary FileTypeStats for the given paths (see FTStatsSum) grouped by groupBy
+// For GroupByExt and GroupByMIME, the map key and FType are the extension or MIME type ("" for files without extension
+// or not yet detected MIME type) and dirs are not counted; GroupByClass is the same as FTStatsSum
+func (f *FileTypeStatsDB) FTStatsSumBy(paths []string, groupBy types.GroupBy) (types.FileTypeStats, error) {
+	return f.FTStatsSumWith(paths, types.SumOptions{GroupBy: groupBy})
+}
 
-	for rs.Next() {
-		if err := rs.Scan(&path, &filecat, &filesize); err != nil {
-			return &fts, err
+// FTStatsSumWith returns the summary FileTypeStats for the given paths (see FTStatsSum) summed as specified by opts
+// With opts.Unique every path is counted once even if it is matched by several paths,
+// and FTypeStat.UniqueBytes counts every hardlinked inode once per group (and once in the total)
+// With opts.ArchiveMembers the expanded archives (those with a stored "archive!/" dir of their own) are replaced by their members
+func (f *FileTypeStatsDB) FTStatsSumWith(paths []string, opts types.SumOptions) (types.FileTypeStats, error) {
+	group, cond := "cats.filecat", ""
+	switch opts.GroupBy {
+	case types.GroupByExt:
+		group, cond = "IFNULL(fileinfo.ext, '')", "cats.filecat<>'dir' AND "
+	case types.GroupByMIME:
+		group, cond = "IFNULL(fileinfo.mime, '')", "cats.filecat<>'dir' AND "
+	default:
+		if !opts.Unique && !opts.Allocated && !opts.ArchiveMembers {
+			return f.FTStatsSum(paths)
 		}
-		fts = append(fts, types.FTypeStat{Path: path, FType: filecat, NumBytes: filesize, FileCount: 0})
 	}
-	return &fts, nil
+	if opts.Unique {
+		return f.ftStatsSumUnique(paths, group, cond, opts)
+	}
+	return f.ftStatsSum(paths, group, cond, opts)
 }
 
-// FTStatsSum returns the summary FileTypeStats for the given paths as a map of FTypeStat per File Type
-// To facilitate aggregation over multiple SELECTs (to circumvent the max WHERE conditions issue for >1000)
-// The strategy becomes to concatenate SELECT results with UNION ALL into a CTE (Common Table Expression),
-// then re-select from the CTE and add the "totals" record with UNION
-func (f *FileTypeStatsDB) FTStatsSum(paths []string) (types.FileTypeStats, error) {
-	const maxWhereCond = 500 // the maximum is 1000, but the where predicate has 2 conditions for each path
-	ftstats := make(types.FileTypeStats)
+// the allocated bytes of a fileinfo row, the apparent size if unknown
+const allocExpr = `IFNULL(fileinfo.alloc, fileinfo.size)`
 
-	var qryParts []string
-	for start := 0; start < len(paths); start += maxWhereCond {
-		end := start + maxWhereCond
-		if end > len(paths) {
-			end = len(paths)
-		}
-		wp := f.pathsWherePredicate(paths[start:end])
-		qryParts = append(
-			qryParts,
-			fmt.Sprintf(
-				`SELECT cats.filecat AS fcat, fileinfo.path, COUNT(fileinfo.path) AS fcatcount, SUM(fileinfo.size) AS fcatsize FROM fileinfo, cats WHERE fileinfo.catid=cats.id AND (%s) GROUP BY cats.filecat`,
-				wp),
-		)
+// the condition (ending in AND) excluding the expanded archives, which are counted by their members
+const notExpandedCond = `NOT EXISTS (SELECT 1 FROM fileinfo AS arc
+	WHERE arc.path = fileinfo.path || '` + utils.MemberSep + `' AND arc.archive = fileinfo.path) AND `
+
+// sumPredicate returns the paths predicate and the additional condition (ending in AND) for opts
+func (f *FileTypeStatsDB) sumPredicate(cond string, opts types.SumOptions) (string, func(paths []string) (string, []interface{})) {
+	if opts.ArchiveMembers {
+		return notExpandedCond + cond, f.pathsMembersWherePredicate
 	}
+	return cond, f.pathsWherePredicate
+}
 
-	rs, err := f.DB.Query(fmt.Sprintf(
-		`WITH CatSum(fcat, path, fcatcount, fcatsize) AS (%s) SELECT fcat, '' AS path, SUM(CatSum.fcatcount) AS fcatcount, SUM(CatSum.fcatsize) AS fcatsize FROM CatSum GROUP BY CatSum.fcat UNION SELECT 'total' AS fcat, '', SUM(CatSum.fcatcount), SUM(CatSum.fcatsize) FROM CatSum`,
-		strings.Join(qryParts, ` UNION ALL `)))
+// ftStatsSum is FTStatsSum from fileinfo, grouped by the expression group and with the additional condition cond (ending in AND)
+// The archive members are selected as specified by opts, and if opts.Allocated is set, the allocated bytes are returned in AllocBytes
+func (f *FileTypeStatsDB) ftStatsSum(paths []string, group, cond string, opts types.SumOptions) (types.FileTypeStats, error) {
+	ftstats := make(types.FileTypeStats)
 
-	if err != nil {
+	type catSum struct {
+		count       uint
+		size, alloc uint64
+	}
+	sums := make(map[string]*catSum)
+	cond, pred := f.sumPredicate(cond, opts)
+	err := f.pathsQuery(
+		`SELECT `+group+` AS fcat, COUNT(fileinfo.path) AS fcatcount, IFNULL(SUM(fileinfo.size), 0) AS fcatsize, IFNULL(SUM(`+allocExpr+`), 0) AS fcatalloc FROM fileinfo, cats WHERE fileinfo.catid=cats.id AND `+cond+`(%s) GROUP BY fcat`,
+		nil, nil, paths, maxWhereCond/pathArgs, pred, func(rs *sql.Rows) error {
+			var (
+				fcat string
+				cs   catSum
+			)
+			if err := rs.Scan(&fcat, &cs.count, &cs.size, &cs.alloc); err != nil {
+				return err
+			}
+			if sum, ok := sums[fcat]; ok { // a chunk sum, the paths of every chunk are counted (like with UNION ALL)
+				sum.count, sum.size, sum.alloc = sum.count+cs.count, sum.size+cs.size, sum.alloc+cs.alloc
+			} else {
+				sums[fcat] = &cs
+			}
+			return nil
+		})
+	if err != nil || len(sums) == 0 { // nothing selected, just return empty result without error
 		return ftstats, err
 	}
-	defer rs.Close()
 
+	var total catSum
+	for fcat, cs := range sums {
+		addSum(ftstats, paths, fcat, "", cs.count, cs.size)
+		total.count, total.size, total.alloc = total.count+cs.count, total.size+cs.size, total.alloc+cs.alloc
+	}
+	addSum(ftstats, paths, "total", "", total.count, total.size)
+	if opts.Allocated {
+		for fcat, cs := range sums {
+			ftstats[fcat].AllocBytes = cs.alloc
+		}
+		ftstats["total"].AllocBytes = total.alloc
+	}
+	return ftstats, nil
+}
+
+// ftStatsSumUnique is ftStatsSum, but counting every path once and with the UniqueBytes of every group,
+// the AllocBytes (if opts.Allocated is set) count every file once too. Files are identified by (dev, inode), except dirs and files without inode (NULL nlink) which are identified by their path;
+// the stored nlink of the other links may be outdated, so it is not used to decide whether a file is hardlinked
+func (f *FileTypeStatsDB) ftStatsSumUnique(paths []string, group, cond string, opts types.SumOptions) (types.FileTypeStats, error) {
+	ftstats := make(types.FileTypeStats)
+
+	type catSum struct {
+		count uint
+		size  uint64
+		files map[string]fileSize // the largest size of every file id
+	}
 	var (
-		path       string
-		fcat       string
-		fcatcount  uint
-		fcatsize   uint64
-		pathN      sql.NullString
-		fcatN      sql.NullString
-		fcatcountN sql.NullInt32
-		fcatsizeN  sql.NullInt64
+		sums  = make(map[string]*catSum)
+		total = catSum{files: make(map[string]fileSize)}
+		seen  = newSeenPaths(paths, maxWhereCond/pathArgs)
 	)
+	cond, pred := f.sumPredicate(cond, opts)
+	err := f.pathsQuery(
+		`SELECT `+group+` AS fcat, fileinfo.path, IFNULL(fileinfo.size, 0), IFNULL(`+allocExpr+`, 0),
+			CASE WHEN fileinfo.nlink IS NULL OR fileinfo.inode=0 THEN fileinfo.path ELSE fileinfo.dev || ':' || fileinfo.inode END
+			FROM fileinfo, cats WHERE fileinfo.catid=cats.id AND `+cond+`(%s)`,
+		nil, nil, paths, maxWhereCond/pathArgs, pred, func(rs *sql.Rows) error {
+			var (
+				fcat, path, fid string
+				fs              fileSize
+			)
+			if err := rs.Scan(&fcat, &path, &fs.size, &fs.alloc, &fid); err != nil {
+				return err
+			}
+			if !seen.add(path) {
+				return nil
+			}
+			cs, ok := sums[fcat]
+			if !ok {
+				cs = &catSum{files: make(map[string]fileSize)}
+				sums[fcat] = cs
+			}
+			for _, s := range []*catSum{cs, &total} {
+				s.count++
+				s.size += fs.size
+				s.files[fid] = s.files[fid].max(fs)
+			}
+			return nil
+		})
+	if err != nil || total.count == 0 {
+		return ftstats, err
+	}
 
-	for rs.Next() {
-		if err := rs.Scan(&fcatN, &pathN, &fcatcountN, &fcatsizeN); err != nil {
-			return ftstats, err
+	sums["total"] = &total
+	for fcat, cs := range sums {
+		var unique fileSize
+		for _, fs := range cs.files {
+			unique.size += fs.size
+			unique.alloc += fs.alloc
 		}
-		if !(pathN.Valid && fcatN.Valid && fcatcountN.Valid && fcatsizeN.Valid) { // we had NULL values, just return empty result without error
-			return ftstats, nil
-		}
-		path = pathN.String
-		fcat = fcatN.String
-		fcatcount = uint(fcatcountN.Int32) // crappy that we don't have sql.NullUInt => will this be a problem???
-		fcatsize = uint64(fcatsizeN.Int64)
-		if len(paths) == 1 { // the query has specified a single directory pattern, so we use it for the path
-			if fcatcount == 1 && fcat != "total" { // there's only one, so we can take the exact path, except for totals take the input path
-				ftstats[fcat] = &types.FTypeStat{Path: path, FType: fcat, FileCount: fcatcount, NumBytes: fcatsize}
-			} else { // use input pattern for path
-				ftstats[fcat] = &types.FTypeStat{Path: paths[0], FType: fcat, FileCount: fcatcount, NumBytes: fcatsize}
-			}
-		} else {
-			ftstats[fcat] = &types.FTypeStat{Path: "*", FType: fcat, FileCount: fcatcount, NumBytes: fcatsize}
+		addSum(ftstats, paths, fcat, "", cs.count, cs.size)
+		ftstats[fcat].UniqueBytes = unique.size
+		if opts.Allocated {
+			ftstats[fcat].AllocBytes = unique.alloc
 		}
 	}
 	return ftstats, nil
 }
 
+// fileSize is the apparent and the allocated size of a file
+type fileSize struct{ size, alloc uint64 }
+
+// max returns the larger apparent and the larger allocated size of fs and o
+func (fs fileSize) max(o fileSize) fileSize {
+	return fileSize{max(fs.size, o.size), max(fs.alloc, o.alloc)}
+}
+
+// addSum adds the summary of category fcat to ftstats, path is the matched path if there was only one
+func addSum(ftstats types.FileTypeStats, paths []string, fcat, path string, fcatcount uint, fcatsize uint64) {
+	if len(paths) == 1 { // the query has specified a single directory pattern, so we use it for the path
+		if fcatcount == 1 && fcat != "total" { // there's only one, so we can take the exact path, except for totals take the input path
+			ftstats[fcat] = &types.FTypeStat{Path: path, FType: fcat, FileCount: fcatcount, NumBytes: fcatsize}
+		} else { // use input pattern for path
+			ftstats[fcat] = &types.FTypeStat{Path: paths[0], FType: fcat, FileCount: fcatcount, NumBytes: fcatsize}
+		}
+	} else {
+		ftstats[fcat] = &types.FTypeStat{Path: "*", FType: fcat, FileCount: fcatcount, NumBytes: fcatsize}
+	}
+}
+
 // UpdateFileStats upserts the file in path with size
 func (f *FileTypeStatsDB) UpdateFileStats(path, filecat string, size uint64) error {
-	// upsert file type stats for dir
-	if _, err := f.DB.Exec((fmt.Sprintf(
-		`INSERT INTO fileinfo(path, size, catid, updated) VALUES('%s', %d, (SELECT id FROM cats WHERE filecat='%s'), %d)
-			ON CONFLICT(path) DO
-			UPDATE SET size=%d, catid=(SELECT id FROM cats WHERE filecat='%s'), updated=%d`,
-		strings.Replace(path, "'", "''", -1), // escape single quotes for SQL
-		size, filecat, time.Now().Unix(), size, filecat, time.Now().Unix(),
-	))); err != nil {
+	return f.UpdateFileStat(&types.FileStat{FTypeStat: types.FTypeStat{Path: path, FType: filecat, NumBytes: size}})
+}
+
+// UpdateFileStat upserts the file with all its metadata
+func (f *FileTypeStatsDB) UpdateFileStat(fst *types.FileStat) error {
+	f.dbmutex.Lock()
+	defer f.dbmutex.Unlock()
+	tx, err := f.DB.Begin()
+	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback() // no-op after commit
+	delta := make(dirStatsDelta)
+	if err := f.txUpsert(tx, delta, fst, time.Now().UnixNano()); err != nil {
+		return err
+	}
+	if err := f.applyDirStats(tx, delta); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// upsertArgs returns the args for qryUpsertFileStats
+func upsertArgs(fst *types.FileStat, updated int64) []interface{} {
+	var mtime, alloc interface{} // NULL if unknown, i.e. not from a stat
+	if !fst.ModTime.IsZero() {
+		mtime = fst.ModTime.UnixNano()
+		alloc = fst.AllocBytes
+	}
+	var ext, mime, nlink interface{} // NULL for dirs, mime and nlink also if unknown
+	if fst.FType != "dir" {
+		ext = types.FileExt(fst.Path)
+		if fst.MIME != "" {
+			mime = fst.MIME
+		}
+		if fst.Nlink != 0 {
+			nlink = int64(fst.Nlink)
+		}
+	}
+	var archive interface{} // NULL for entries on the filesystem
+	if fst.Archive != "" {
+		archive = fst.Archive
+	}
+	return []interface{}{
+		fst.Path, fst.NumBytes, fst.FType, updated,
+		mtime, int64(fst.Inode), int64(fst.Device), fst.Uid, fst.Gid, uint32(fst.Mode),
+		ext, mime, nlink, alloc, archive,
+	}
+}
+
+// scanFileStat scans a row with the columns of qrySelectFileStat into a FileStat
+func scanFileStat(row interface {
+	Scan(dest ...interface{}) error
+}) (*types.FileStat, error) {
+	var (
+		fst                               types.FileStat
+		size, mtime, inode, dev, uid, gid sql.NullInt64
+		mode, nlink, alloc                sql.NullInt64
+		ext, mime, archive                sql.NullString
+	)
+	if err := row.Scan(&fst.Path, &fst.FType, &size, &mtime, &inode, &dev, &uid, &gid, &mode, &ext, &mime, &nlink, &alloc, &archive); err != nil {
+		return nil, err
+	}
+	fst.Ext, fst.MIME, fst.Archive = ext.String, mime.String, archive.String
+	fst.NumBytes = uint64(size.Int64)
+	fst.AllocBytes = fst.NumBytes // unknown allocated size counts as apparent, like in the sums
+	if alloc.Valid {
+		fst.AllocBytes = uint64(alloc.Int64)
+	}
+	if mtime.Valid {
+		fst.ModTime = time.Unix(0, mtime.Int64)
+	}
+	fst.Inode = uint64(inode.Int64)
+	fst.Device = uint64(dev.Int64)
+	fst.Nlink = uint64(nlink.Int64)
+	fst.Uid = uint32(uid.Int64)
+	fst.Gid = uint32(gid.Int64)
+	fst.Mode = fs.FileMode(mode.Int64)
+	if fst.FType != "dir" {
+		fst.FileCount = 1
+	}
+	return &fst, nil
+}
+
+// GetFileStat returns the stored record for path, or nil (without error) if path is not in the DB
+func (f *FileTypeStatsDB) GetFileStat(path string) (*types.FileStat, error) {
+	st, err := f.stmt(qrySelectFileStat)
+	if err != nil {
+		return nil, err
+	}
+	fst, err := scanFileStat(st.QueryRow(path))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return fst, err
+}
+
+// FTDumpFileStats returns the full records of all paths selected by the paths argument (see FTDumpPaths)
+func (f *FileTypeStatsDB) FTDumpFileStats(paths []string) ([]types.FileStat, error) {
+	fsts := make([]types.FileStat, 0)
+	seen := newSeenPaths(paths, maxWhereCond/pathArgs)
+	err := f.pathsQuery(
+		`SELECT `+fileStatCols+` FROM fileinfo, cats WHERE fileinfo.catid=cats.id AND (%s)`,
+		nil, nil, paths, maxWhereCond/pathArgs, f.pathsWherePredicate, func(rs *sql.Rows) error {
+			fst, err := scanFileStat(rs)
+			if err != nil {
+				return err
+			}
+			if seen.add(fst.Path) {
+				fsts = append(fsts, *fst)
+			}
+			return nil
+		})
+	return fsts, err
 }
 
 // UpdateFilePath updates the file path(s), which needs to happen on a file move
-// if path is a dir the update is recursive
+// If from is a dir (with trailing separator) the update is recursive, to is then taken as a dir as well
+// Only the entries equal to or under from are touched, and only their leading from is replaced by to
+// Existing entries for to (with their subtree) are replaced, like the move replaced them in the filesystem
 func (f *FileTypeStatsDB) UpdateFilePath(from, to string) error {
-	from = strings.Replace(from, "'", "''", -1) // escape single quotes for SQL
-	to = strings.Replace(to, "'", "''", -1)
-	if _, err := f.DB.Exec((fmt.Sprintf(
-		`UPDATE fileinfo SET path=REPLACE(path, '%s', '%s'), updated=%d;`, from, to, time.Now().Unix()))); err != nil {
+	isDir := strings.HasSuffix(from, string(filepath.Separator))
+	if isDir {
+		to = utils.DirTrailSep(to)
+	}
+	if from == to {
+		return nil
+	}
+	f.dbmutex.Lock()
+	defer f.dbmutex.Unlock()
+	tx, err := f.DB.Begin()
+	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback() // no-op after commit
+
+	delta := make(dirStatsDelta)
+	toGlob, fromGlob := utils.GlobEscape(to)+"*", utils.GlobEscape(from)+"*"
+	if !isDir { // a file only replaces a file
+		toGlob, fromGlob = utils.GlobEscape(to), utils.GlobEscape(from)
+	}
+	if _, err = f.txTracked(tx, delta, -1, nil, qryDeleteMoveTarget, toGlob, to, fromGlob, from); err != nil {
+		return err
+	}
+
+	updated := time.Now().UnixNano()
+	qry, args := qryMoveFile, []interface{}{to, updated, from}
+	if isDir {
+		qry, args = qryMoveTree, []interface{}{to, from, updated, fromGlob, from}
+	}
+	oldPath := func(p string) string { return from + p[len(to):] }
+	if _, err = f.txTracked(tx, delta, 1, oldPath, qry, args...); err != nil {
+		return err
+	}
+	if err := f.applyDirStats(tx, delta); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // DeleteOlderThan deletes all entries older than (i.e. not updated after) t
 func (f *FileTypeStatsDB) DeleteOlderThan(t time.Time) error {
-	if _, err := f.DB.Exec((fmt.Sprintf(
-		`DELETE FROM fileinfo WHERE fileinfo.updated < %d`, t.Unix()))); err != nil {
-		return err
-	}
-	return nil
+	_, err := f.execTracked(qryDeleteOlderThan, t.UnixNano())
+	return err
 }
 
 // DeleteOlderThanWithPrefix deletes all entries older than (i.e. not updated after) t
+// prefix is taken literally, i.e. glob meta characters in it are not expanded
 func (f *FileTypeStatsDB) DeleteOlderThanWithPrefix(t time.Time, prefix string) error {
-	if _, err := f.DB.Exec((fmt.Sprintf(
-		`DELETE FROM fileinfo
-		WHERE fileinfo.updated < %d
-			AND (fileinfo.path GLOB '%s/*' OR fileinfo.path='%s')`, t.Unix(), prefix, prefix))); err != nil {
-		return err
-	}
-	return nil
+	_, err := f.execTracked(qryDeleteOlderThanWithPrefix, t.UnixNano(), utils.GlobEscape(prefix)+"/*", prefix)
+	return err
 }
 
 // DeleteFileStats deletes the file/dir in path, if it's a dir, the delete is recursive
 func (f *FileTypeStatsDB) DeleteFileStats(path string) error {
 	// if we delete "<path>/*" OR "<path>" from the DB, we catch automatically the recursive case if it was a dir and existed, otherwise we delete just the file
-	path = strings.Replace(path, "'", "''", -1) // escape single quotes for SQL
+	_, err := f.execTracked(qryDeleteFileStats, utils.GlobEscape(path)+"/*", path)
+	return err
+}
 
-	if _, err := f.DB.Exec((fmt.Sprintf(
-		`DELETE FROM fileinfo WHERE
-			fileinfo.path GLOB '%s/*' OR fileinfo.path='%s'`, path, path))); err != nil {
-		return err
+// DeleteFileStatsTree deletes path in one transaction, it reports whether path was a dir and how many entries were deleted
+// If path is a dir in the DB (i.e. "path/" exists), the whole subtree is deleted, otherwise only path itself
+// Unlike DeleteFileStats, a file never takes anything else with it, even if (inconsistently) entries under "path/" exist
+func (f *FileTypeStatsDB) DeleteFileStatsTree(path string) (isDir bool, n int64, err error) {
+	dir := utils.DirTrailSep(path)
+	f.dbmutex.Lock()
+	defer f.dbmutex.Unlock()
+	tx, err := f.DB.Begin()
+	if err != nil {
+		return false, 0, err
 	}
-	return nil
+	defer tx.Rollback() // no-op after commit
+	exists, err := f.txStmt(tx, qryPathExists)
+	if err != nil {
+		return false, 0, err
+	}
+	if err = exists.QueryRow(dir).Scan(&isDir); err != nil {
+		return false, 0, err
+	}
+	qry, args := qryDeletePath, []interface{}{utils.JustDir(path)}
+	if isDir {
+		qry, args = qryDeleteFileStats, []interface{}{utils.GlobEscape(dir) + "*", dir}
+	}
+	delta := make(dirStatsDelta)
+	if n, err = f.txTracked(tx, delta, -1, nil, qry, args...); err != nil {
+		return false, 0, err
+	}
+	if err = f.applyDirStats(tx, delta); err != nil {
+		return false, 0, err
+	}
+	return isDir, n, tx.Commit()
+}
+
+// PurgeExcluded deletes all entries under prefix (a dir, taken literally) for which excluded returns true
+// Dirs are passed to excluded with their trailing "/", and their subtree is deleted with them
+// Returns the number of deleted entries
+func (f *FileTypeStatsDB) PurgeExcluded(prefix string, excluded func(path string, isDir bool, size uint64) bool) (int64, error) {
+	prefix = utils.JustDir(prefix)
+	st, err := f.stmt(qrySelectPrefix)
+	if err != nil {
+		return 0, err
+	}
+	rs, err := st.Query(utils.GlobEscape(prefix)+"/*", prefix)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		path, filecat string
+		size          sql.NullInt64
+		purge         []string
+	)
+	for rs.Next() {
+		if err := rs.Scan(&path, &filecat, &size); err != nil {
+			rs.Close()
+			return 0, err
+		}
+		if excluded(path, filecat == "dir", uint64(size.Int64)) {
+			purge = append(purge, path)
+		}
+	}
+	rs.Close()
+	if err := rs.Err(); err != nil || len(purge) == 0 {
+		return 0, err
+	}
+
+	f.dbmutex.Lock()
+	defer f.dbmutex.Unlock()
+	tx, err := f.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // no-op after commit
+	var n int64
+	delta := make(dirStatsDelta)
+	for _, p := range purge {
+		qry, args := qryDeletePath, []interface{}{p}
+		if strings.HasSuffix(p, "/") { // dir with its subtree
+			qry, args = qryDeleteFileStats, []interface{}{utils.GlobEscape(p) + "*", p}
+		}
+		cnt, err := f.txTracked(tx, delta, -1, nil, qry, args...)
+		if err != nil {
+			return 0, err
+		}
+		n += cnt
+	}
+	if err := f.applyDirStats(tx, delta); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
 }
 
 func (f *FileTypeStatsDB) DbFileName() string {
@@ -311,42 +671,136 @@ func (f *FileTypeStatsDB) DbFileName() string {
 }
 
 // returns table.id where field==value, inserts value if not exist (id must be AUTOINCREMENT)
+// table and field are identifiers and can't be bound, so they must never come from user input
 func (f *FileTypeStatsDB) selsertIdText(table, field, value string) (int, error) {
-	value = strings.Replace(value, "'", "''", -1) // escape single quotes for SQL
 	var id int
-	rs, err := f.DB.Query(fmt.Sprintf("SELECT id FROM %s WHERE %s='%s'", table, field, value))
+	sel, err := f.stmt(fmt.Sprintf("SELECT id FROM %s WHERE %s=?", table, field))
 	if err != nil {
 		return -1, err
 	}
-	defer rs.Close() // important, otherwise later we get "locked" errors
-	if rs.Next() {
-		if err := rs.Scan(&id); err != nil {
-			return -1, err
-		}
+	err = sel.QueryRow(value).Scan(&id)
+	if err == nil {
 		return id, nil
+	} else if err != sql.ErrNoRows {
+		return -1, err
+	}
+	ins, err := f.stmt(fmt.Sprintf("INSERT INTO %s(%s) VALUES(?) RETURNING id", table, field))
+	if err != nil {
+		return -1, err
 	}
-	r := f.DB.QueryRow(fmt.Sprintf("INSERT INTO %s(%s) VALUES('%s') RETURNING id", table, field, value))
-	if err := r.Scan(&id); err != nil {
+	if err := ins.QueryRow(value).Scan(&id); err != nil {
 		return -1, err
 	}
 	return id, nil
 }
 
-// pathsWherePredicate returns the WHERE clause part selecting the paths according to input dir list
+// pathsWherePredicate returns the WHERE clause part selecting the paths according to input dir list, and the args to bind to it
 // we'll be using GLOB, translated from the path list to satisfy behaviour as described for FTStatsSum()
-func (f *FileTypeStatsDB) pathsWherePredicate(paths []string) string {
+func (f *FileTypeStatsDB) pathsWherePredicate(paths []string) (string, []interface{}) {
+	return pathsColWherePredicate("fileinfo.path", "fileinfo.archive", paths)
+}
+
+// pathsMembersWherePredicate is pathsWherePredicate, but also selecting the members of all archives in the paths
+func (f *FileTypeStatsDB) pathsMembersWherePredicate(paths []string) (string, []interface{}) {
+	return pathsColPredicate("fileinfo.path", "", paths, true)
+}
+
+// pathsColWherePredicate is pathsWherePredicate for the path column col and the archive column archiveCol of the same rows
+// (fixed identifiers, never user input)
+// Archive members are only selected by paths inside their archive, see utils.MemberMatch
+func pathsColWherePredicate(col, archiveCol string, paths []string) (string, []interface{}) {
+	return pathsColPredicate(col, archiveCol, paths, false)
+}
+
+// pathsColPredicate is pathsColWherePredicate, which selects the archive members by the paths of their archives too if members is set
+func pathsColPredicate(col, archiveCol string, paths []string, members bool) (string, []interface{}) {
 	// we can (significantly) optimise the query by removing ineffective paths (duplicates and children of recursive globs) first
 	paths = utils.OptimizePathsGlob(&paths)
 	pred := make([]string, len(paths))
+	args := make([]interface{}, 0, pathArgs*len(paths))
 	for i, d := range paths {
-		d = strings.Replace(d, "'", "''", -1)                          // escape single quotes for SQL
-		if strings.HasSuffix(d, "*/*") || strings.HasSuffix(d, "/*") { // recursive directory
-			pred[i] = fmt.Sprintf("(fileinfo.path GLOB '%s')", d)
-		} else if strings.HasSuffix(d, "/") || strings.HasSuffix(d, "*/") { // specific directory or directory pattern
-			pred[i] = fmt.Sprintf("(fileinfo.path GLOB '%s*' AND NOT fileinfo.path GLOB '%s*/*')", d, d)
-		} else { // exact file path or file pattern
-			pred[i] = fmt.Sprintf("(fileinfo.path GLOB '%s' AND NOT fileinfo.path GLOB '%s/*')", d, d)
+		p, pargs := pathColPredicate(col, d)
+		args = append(args, pargs...)
+		if !members { // a member is only selected by the paths which don't select its archive
+			ap, aargs := pathColPredicate(archiveCol, d)
+			p += fmt.Sprintf(" AND (%s IS NULL OR NOT (%s))", archiveCol, ap)
+			args = append(args, aargs...)
+		}
+		pred[i] = "(" + p + ")"
+	}
+	return strings.Join(pred, " OR "), args
+}
+
+// pathColPredicate returns the condition on the path column col selecting the path d (see FTStatsSum) and its args
+func pathColPredicate(col, d string) (string, []interface{}) {
+	if strings.HasSuffix(d, "*/*") || strings.HasSuffix(d, "/*") { // recursive directory
+		return fmt.Sprintf("%[1]s GLOB ?", col), []interface{}{d}
+	} else if strings.HasSuffix(d, "/") || strings.HasSuffix(d, "*/") { // specific directory or directory pattern
+		return fmt.Sprintf("%[1]s GLOB ? AND NOT %[1]s GLOB ?", col), []interface{}{d + "*", d + "*/*"}
+	}
+	// exact file path or file pattern
+	return fmt.Sprintf("%[1]s GLOB ? AND NOT %[1]s GLOB ?", col), []interface{}{d, d + "/*"}
+}
+
+// maxWhereCond is the maximum number of conditions we put in one WHERE clause (sqlite allows 1000)
+const maxWhereCond = 1000
+
+// pathArgs is the maximum number of args pathsWherePredicate binds per path, which limits the paths per statement to maxWhereCond/pathArgs
+const pathArgs = 4
+
+// pathsQuery runs sel (with one %s for the paths predicate) for paths in chunks of chunkSize, every chunk as a statement of its own,
+// so neither the number of WHERE conditions nor the number of bound variables of a statement grows with the number of paths
+// The args of every statement are preArgs (the args of sel before the predicate), the predicate args and postArgs.
+// scan is called for every row, merging the chunk results is up to the caller: a path matched by several chunks is returned by each of them.
+func (f *FileTypeStatsDB) pathsQuery(sel string, preArgs, postArgs []interface{}, paths []string, chunkSize int, pred func(paths []string) (string, []interface{}), scan func(rs *sql.Rows) error) error {
+	for start := 0; start < len(paths); start += chunkSize {
+		end := start + chunkSize
+		if end > len(paths) {
+			end = len(paths)
+		}
+		wp, args := pred(paths[start:end])
+		qryArgs := append(append(append(make([]interface{}, 0, len(preArgs)+len(args)+len(postArgs)), preArgs...), args...), postArgs...)
+		if err := f.queryRows(fmt.Sprintf(sel, wp), qryArgs, scan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryRows runs qry with args and calls scan for every row
+func (f *FileTypeStatsDB) queryRows(qry string, args []interface{}, scan func(rs *sql.Rows) error) error {
+	rs, err := f.DB.Query(qry, args...)
+	if err != nil {
+		return err
+	}
+	defer rs.Close()
+	for rs.Next() {
+		if err := scan(rs); err != nil {
+			return err
 		}
 	}
-	return strings.Join(pred, " OR ")
+	return rs.Err()
+}
+
+// seenPaths records the paths returned by the chunks of pathsQuery, for the queries returning every path once
+// It is nil (recording nothing) if there's only one chunk, since a single statement returns every path once anyway
+type seenPaths map[string]bool
+
+func newSeenPaths(paths []string, chunkSize int) seenPaths {
+	if len(paths) <= chunkSize {
+		return nil
+	}
+	return make(seenPaths)
+}
+
+// add records path and reports whether it's new
+func (s seenPaths) add(path string) bool {
+	if s == nil {
+		return true
+	}
+	if s[path] {
+		return false
+	}
+	s[path] = true
+	return true
 }
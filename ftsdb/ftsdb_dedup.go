@@ -0,0 +1,188 @@
+package ftsdb
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/Rainc1oud/filetypestats/types"
+)
+
+// The duplicate detection only hashes files which have the same size as another file, and stores the digests in filehash.
+// The hashing itself needs the files, so it is done by the caller (see filetypestats.Dedup), this is only the storage part.
+
+// DedupCandidates returns the files selected by paths (see FTStatsSum) which have the same (non zero) size as another selected file,
+// grouped by size, with their stored digests if they are still valid (same size and mtime)
+func (f *FileTypeStatsDB) DedupCandidates(paths []string) ([][]types.FileHash, error) {
+	var (
+		fhs  []types.FileHash
+		seen = newSeenPaths(paths, maxWhereCond/pathArgs)
+	)
+	err := f.pathsQuery(
+		`SELECT fileinfo.path, fileinfo.size, fileinfo.mtime, filehash.partial, filehash.full FROM fileinfo, cats
+			LEFT JOIN filehash ON filehash.path=fileinfo.path AND filehash.size=fileinfo.size AND filehash.mtime IS fileinfo.mtime
+			WHERE fileinfo.catid=cats.id AND cats.filecat<>'dir' AND fileinfo.size>0 AND (%s)`,
+		nil, nil, paths, maxWhereCond/pathArgs, f.pathsWherePredicate, func(rs *sql.Rows) error {
+			var (
+				fh            types.FileHash
+				mtime         sql.NullInt64
+				partial, full sql.NullString
+			)
+			if err := rs.Scan(&fh.Path, &fh.Size, &mtime, &partial, &full); err != nil {
+				return err
+			}
+			if mtime.Valid {
+				fh.ModTime = time.Unix(0, mtime.Int64)
+			}
+			fh.Partial, fh.Full = partial.String, full.String
+			if seen.add(fh.Path) {
+				fhs = append(fhs, fh)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// the size groups are merged from all chunks, so they are only formed here
+	sort.Slice(fhs, func(i, j int) bool {
+		if fhs[i].Size != fhs[j].Size {
+			return fhs[i].Size < fhs[j].Size
+		}
+		return fhs[i].Path < fhs[j].Path
+	})
+	var groups [][]types.FileHash
+	for start := 0; start < len(fhs); {
+		end := start + 1
+		for end < len(fhs) && fhs[end].Size == fhs[start].Size {
+			end++
+		}
+		if end-start > 1 {
+			groups = append(groups, fhs[start:end:end])
+		}
+		start = end
+	}
+	return groups, nil
+}
+
+// UpdateFileHashes stores the digests of hashes in one transaction
+func (f *FileTypeStatsDB) UpdateFileHashes(hashes []types.FileHash) error {
+	f.dbmutex.Lock()
+	defer f.dbmutex.Unlock()
+	tx, err := f.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op after commit
+	st, err := f.txStmt(tx, qryUpsertFileHash)
+	if err != nil {
+		return err
+	}
+	for _, fh := range hashes {
+		var mtime, partial, full interface{} // NULL if unknown
+		if !fh.ModTime.IsZero() {
+			mtime = fh.ModTime.UnixNano()
+		}
+		if fh.Partial != "" {
+			partial = fh.Partial
+		}
+		if fh.Full != "" {
+			full = fh.Full
+		}
+		if _, err := st.Exec(fh.Path, fh.Size, mtime, partial, full); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// PruneFileHashes deletes the digests of files which are not in the DB anymore, it returns the number of deleted digests
+func (f *FileTypeStatsDB) PruneFileHashes() (int64, error) {
+	st, err := f.stmt(qryPruneFileHashes)
+	if err != nil {
+		return 0, err
+	}
+	res, err := st.Exec()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Duplicates returns the groups of files selected by paths (see FTStatsSum) with identical content, largest waste first
+// Only files with a valid full digest are considered, i.e. the result is as recent as the last dedup pass
+func (f *FileTypeStatsDB) Duplicates(paths []string) (types.DupGroups, error) {
+	type inode struct{ dev, ino int64 }
+	type file struct {
+		path, fcat, hash string
+		size             uint64
+		inode            inode
+	}
+	var (
+		files []file
+		seen  = newSeenPaths(paths, maxWhereCond/pathArgs)
+	)
+	err := f.pathsQuery(
+		`SELECT fileinfo.path, cats.filecat, fileinfo.size, fileinfo.dev, fileinfo.inode, filehash.full FROM fileinfo, cats, filehash
+			WHERE fileinfo.catid=cats.id AND filehash.path=fileinfo.path AND filehash.size=fileinfo.size
+				AND filehash.mtime IS fileinfo.mtime AND filehash.full IS NOT NULL AND (%s)`,
+		nil, nil, paths, maxWhereCond/pathArgs, f.pathsWherePredicate, func(rs *sql.Rows) error {
+			var (
+				fl       file
+				dev, ino sql.NullInt64
+			)
+			if err := rs.Scan(&fl.path, &fl.fcat, &fl.size, &dev, &ino, &fl.hash); err != nil {
+				return err
+			}
+			fl.inode = inode{dev.Int64, ino.Int64}
+			if seen.add(fl.path) {
+				files = append(files, fl)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if a.size != b.size {
+			return a.size > b.size
+		}
+		if a.hash != b.hash {
+			return a.hash < b.hash
+		}
+		return a.path < b.path
+	})
+
+	var (
+		groups types.DupGroups
+		inodes map[inode]bool
+	)
+	for i, fl := range files {
+		if i == 0 || files[i-1].hash != fl.hash || files[i-1].size != fl.size {
+			if n := len(groups); n > 0 && len(groups[n-1].Paths) == 1 { // not a duplicate
+				groups = groups[:n-1]
+			}
+			groups = append(groups, types.DupGroup{Hash: fl.hash, FType: fl.fcat, Size: fl.size})
+			inodes = make(map[inode]bool)
+		}
+		g := &groups[len(groups)-1]
+		g.Paths = append(g.Paths, fl.path)
+		if fl.inode.ino == 0 { // unknown inode, count every path
+			g.Copies++
+		} else if !inodes[fl.inode] {
+			inodes[fl.inode] = true
+			g.Copies++
+		}
+	}
+	if n := len(groups); n > 0 && len(groups[n-1].Paths) == 1 {
+		groups = groups[:n-1]
+	}
+	// sort.SliceStable would do as well, but the groups are already sorted by size, so only equal sizes can be out of order
+	for i := 1; i < len(groups); i++ {
+		for j := i; j > 0 && groups[j].Wasted() > groups[j-1].Wasted(); j-- {
+			groups[j], groups[j-1] = groups[j-1], groups[j]
+		}
+	}
+	return groups, nil
+}
@@ -0,0 +1,299 @@
+package ftsdb
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/Rainc1oud/filetypestats/types"
+	"github.com/Rainc1oud/filetypestats/utils"
+)
+
+// The dirstats table holds the per category totals (count and bytes) of every directory, both direct and recursive,
+// so that directory sums don't need to scan fileinfo. It is maintained in Go from the rows each fileinfo mutation touches:
+// the mutating queries return (path, catid, size, archive) of the affected rows, which are collected in a dirStatsDelta
+// and applied to dirstats in the same transaction.
+//
+// The direct totals of a dir count the dir entry itself and the files directly in it (not its subdirs),
+// the recursive totals count all entries of the subtree. This is exactly what FTStatsSum selects for "/my/dir/" and "/my/dir/*".
+
+type tDirCat struct {
+	dir   string // with trailing separator
+	catid int64
+}
+
+type tDirStat struct {
+	dcount, dbytes int64 // direct
+	rcount, rbytes int64 // recursive
+}
+
+// dirStatsDelta accumulates the changes to dirstats of a transaction
+type dirStatsDelta map[tDirCat]*tDirStat
+
+// ownerDir returns the dir an entry is counted directly in: a dir for itself, a file for its parent dir
+func ownerDir(path string) string {
+	if strings.HasSuffix(path, "/") {
+		return path
+	}
+	return path[:strings.LastIndex(path, "/")+1]
+}
+
+// parentDir returns the parent of dir (with trailing separator), or "" for the root
+func parentDir(dir string) string {
+	dir = strings.TrimSuffix(dir, "/")
+	return dir[:strings.LastIndex(dir, "/")+1]
+}
+
+// memberRoot returns the length of the root dir ("archive!/") of the archive the entry path is a member of, 0 for an entry on the filesystem
+func memberRoot(archive sql.NullString) int {
+	if !archive.Valid {
+		return 0
+	}
+	return len(archive.String) + len(utils.MemberSep)
+}
+
+// add counts the entry path sign times (+1 for an added, -1 for a removed entry) in its owner dir and all its ancestors
+// Archive members are only counted in the dirs of their own archive, i.e. those at least as long as its root (see memberRoot),
+// since FTStatsSum doesn't select them with the dirs outside it
+func (d dirStatsDelta) add(path string, root int, catid, size, sign int64) {
+	direct := true
+	for dir := ownerDir(path); dir != "" && len(dir) >= root; dir = parentDir(dir) {
+		k := tDirCat{dir, catid}
+		ds, ok := d[k]
+		if !ok {
+			ds = &tDirStat{}
+			d[k] = ds
+		}
+		if direct {
+			ds.dcount += sign
+			ds.dbytes += sign * size
+			direct = false
+		}
+		ds.rcount += sign
+		ds.rbytes += sign * size
+	}
+}
+
+// addRows counts all rows of rs, which must have the columns (path, catid, size, archive), it returns the number of rows
+// oldPath, if not nil, returns the path a (moved) row had before, which is then uncounted
+func (d dirStatsDelta) addRows(rs *sql.Rows, sign int64, oldPath func(path string) string) (int64, error) {
+	defer rs.Close()
+	var (
+		n       int64
+		path    string
+		catid   int64
+		size    sql.NullInt64
+		archive sql.NullString
+	)
+	for rs.Next() {
+		if err := rs.Scan(&path, &catid, &size, &archive); err != nil {
+			return n, err
+		}
+		root := memberRoot(archive)
+		d.add(path, root, catid, size.Int64, sign)
+		if oldPath != nil {
+			old := oldPath(path)
+			if root > 0 { // the part of the path after the archive root is the same before the move
+				root += len(old) - len(path)
+			}
+			d.add(old, root, catid, size.Int64, -sign)
+		}
+		n++
+	}
+	return n, rs.Err()
+}
+
+// apply writes the accumulated changes with the qryUpsertDirStats and qryPruneDirStats statements
+func (d dirStatsDelta) apply(upsert, prune *sql.Stmt) error {
+	for k, ds := range d {
+		if *ds == (tDirStat{}) {
+			continue
+		}
+		if _, err := upsert.Exec(k.dir, k.catid, ds.dcount, ds.dbytes, ds.rcount, ds.rbytes); err != nil {
+			return err
+		}
+		if ds.rcount < 0 { // the dir may have no entries of this category left
+			if _, err := prune.Exec(k.dir, k.catid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyDirStats applies delta to dirstats in transaction tx
+func (f *FileTypeStatsDB) applyDirStats(tx *sql.Tx, delta dirStatsDelta) error {
+	upsert, err := f.txStmt(tx, qryUpsertDirStats)
+	if err != nil {
+		return err
+	}
+	prune, err := f.txStmt(tx, qryPruneDirStats)
+	if err != nil {
+		return err
+	}
+	return delta.apply(upsert, prune)
+}
+
+// txTracked executes the fileinfo mutation qry (returning path, catid, size, archive of the affected rows) in transaction tx
+// and counts the affected rows sign times in delta, see dirStatsDelta.addRows
+func (f *FileTypeStatsDB) txTracked(tx *sql.Tx, delta dirStatsDelta, sign int64, oldPath func(string) string, qry string, args ...interface{}) (int64, error) {
+	st, err := f.txStmt(tx, qry)
+	if err != nil {
+		return 0, err
+	}
+	rs, err := st.Query(args...)
+	if err != nil {
+		return 0, err
+	}
+	return delta.addRows(rs, sign, oldPath)
+}
+
+// execTracked executes the fileinfo mutation qry (see txTracked) in its own transaction
+// and returns the number of affected rows
+func (f *FileTypeStatsDB) execTracked(qry string, args ...interface{}) (int64, error) {
+	f.dbmutex.Lock()
+	defer f.dbmutex.Unlock()
+	tx, err := f.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // no-op after commit
+	delta := make(dirStatsDelta)
+	n, err := f.txTracked(tx, delta, -1, nil, qry, args...)
+	if err != nil {
+		return 0, err
+	}
+	if err := f.applyDirStats(tx, delta); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// txUpsert upserts fst in transaction tx and counts the change (including the replaced row, if any) in delta
+func (f *FileTypeStatsDB) txUpsert(tx *sql.Tx, delta dirStatsDelta, fst *types.FileStat, updated int64) error {
+	sel, err := f.txStmt(tx, qrySelectCatSize)
+	if err != nil {
+		return err
+	}
+	var (
+		catid   int64
+		size    sql.NullInt64
+		archive sql.NullString
+	)
+	switch err := sel.QueryRow(fst.Path).Scan(&catid, &size, &archive); err {
+	case nil:
+		delta.add(fst.Path, memberRoot(archive), catid, size.Int64, -1)
+	case sql.ErrNoRows:
+	default:
+		return err
+	}
+	_, err = f.txTracked(tx, delta, 1, nil, qryUpsertFileStats, upsertArgs(fst, updated)...)
+	return err
+}
+
+// DirStatsSum returns the summary FileTypeStats of dir from the dirstats table, in the same form as FTStatsSum
+// does for the path "dir/*" (recursive) or "dir/" (direct), dir is taken literally (the path of the sums is escaped, see utils.GlobEscape)
+func (f *FileTypeStatsDB) DirStatsSum(dir string, recursive bool) (types.FileTypeStats, error) {
+	dir = strings.TrimSuffix(dir, "/") + "/"
+	pattern := utils.GlobEscape(dir)
+	if recursive {
+		pattern += "*"
+	}
+	return f.dirStatsSum(dir, recursive, pattern)
+}
+
+// dirStatsSum is DirStatsSum with pattern as the path of the sums
+func (f *FileTypeStatsDB) dirStatsSum(dir string, recursive bool, pattern string) (types.FileTypeStats, error) {
+	qry := qrySelectDirStatsDirect
+	if recursive {
+		qry = qrySelectDirStatsRecursive
+	}
+	ftstats := make(types.FileTypeStats)
+	st, err := f.stmt(qry)
+	if err != nil {
+		return ftstats, err
+	}
+	rs, err := st.Query(dir)
+	if err != nil {
+		return ftstats, err
+	}
+	defer rs.Close()
+
+	var (
+		fcat                string
+		fcatcount, fcatsize int64
+		total               types.FTypeStat
+	)
+	for rs.Next() {
+		if err := rs.Scan(&fcat, &fcatcount, &fcatsize); err != nil {
+			return ftstats, err
+		}
+		addSum(ftstats, []string{pattern}, fcat, "", uint(fcatcount), uint64(fcatsize))
+		total.FileCount += uint(fcatcount)
+		total.NumBytes += uint64(fcatsize)
+	}
+	if err := rs.Err(); err != nil || len(ftstats) == 0 {
+		return ftstats, err
+	}
+	addSum(ftstats, []string{pattern}, "total", "", total.FileCount, total.NumBytes)
+	return ftstats, nil
+}
+
+// literalDirPattern returns the dir of a path pattern "/my/dir/*" (recursive) or "/my/dir/" (direct) without glob meta characters,
+// with the escapes of utils.GlobEscape resolved; ok is false for any other pattern
+func literalDirPattern(pattern string) (dir string, recursive, ok bool) {
+	recursive = strings.HasSuffix(pattern, "/*")
+	dir, literal := globPrefix(strings.TrimSuffix(pattern, "*"))
+	if !literal || !strings.HasSuffix(dir, "/") {
+		return "", false, false
+	}
+	return dir, recursive, true
+}
+
+// globPrefix returns the literal leading part of the GLOB pattern, with the escapes of utils.GlobEscape ("[*]", "[?]" and "[[]") resolved,
+// and whether that is the whole pattern
+func globPrefix(pattern string) (string, bool) {
+	var sb strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '[':
+			if i+2 >= len(pattern) || pattern[i+2] != ']' || strings.IndexByte("*?[", pattern[i+1]) < 0 {
+				return sb.String(), false
+			}
+			sb.WriteByte(pattern[i+1])
+			i += 2
+		case '*', '?':
+			return sb.String(), false
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String(), true
+}
+
+// dirPattern is a literal dir pattern of FTStatsSum which is answered from dirstats
+type dirPattern struct {
+	pattern, dir string
+	recursive    bool
+}
+
+// splitDirPatterns returns the literal dirs of paths (see literalDirPattern) which can be summed from dirstats, and the other paths
+// A dir is only taken from dirstats if no other path may select the same entries, i.e. if their literal prefixes (see globPrefix)
+// don't overlap, since the scan of fileinfo counts an entry selected by several paths only once
+func splitDirPatterns(paths []string) (dirs []dirPattern, rest []string) {
+	prefixes := make([]string, len(paths))
+	for i, p := range paths {
+		prefixes[i], _ = globPrefix(p)
+	}
+	for i, p := range paths {
+		dir, recursive, ok := literalDirPattern(p)
+		for j := 0; ok && j < len(paths); j++ {
+			ok = j == i || !(strings.HasPrefix(prefixes[j], dir) || strings.HasPrefix(dir, prefixes[j]))
+		}
+		if ok {
+			dirs = append(dirs, dirPattern{p, dir, recursive})
+		} else {
+			rest = append(rest, p)
+		}
+	}
+	return dirs, rest
+}
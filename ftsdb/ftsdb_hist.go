@@ -0,0 +1,79 @@
+package ftsdb
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/Rainc1oud/filetypestats/types"
+)
+
+// Log2SizeBounds are the default bucket bounds of SizeHistogram: a bucket for empty files, then one per power of 2
+func Log2SizeBounds() []uint64 {
+	bounds := make([]uint64, 63)
+	for i := range bounds {
+		bounds[i] = 1 << i
+	}
+	return bounds
+}
+
+// SizeHistogram returns the histogram of the file sizes per type for the given paths (see FTStatsSum), dirs are not counted
+// bounds are the ascending bucket bounds: bucket 0 counts the sizes < bounds[0], bucket i the sizes in [bounds[i-1], bounds[i]),
+// and the last bucket the sizes >= bounds[len(bounds)-1]; nil bounds are Log2SizeBounds()
+// The buckets of each type are returned up to the largest non-empty one
+func (f *FileTypeStatsDB) SizeHistogram(paths []string, bounds []uint64) (types.SizeHistogram, error) {
+	if bounds == nil {
+		bounds = Log2SizeBounds()
+	}
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] <= bounds[i-1] {
+			return nil, fmt.Errorf("size histogram bounds must be ascending: %v", bounds)
+		}
+	}
+
+	// the bucket index is selected with a CASE over the bounds, which are bound for every chunk
+	cases := make([]string, len(bounds))
+	boundArgs := make([]interface{}, len(bounds))
+	for i, b := range bounds {
+		cases[i] = fmt.Sprintf("WHEN IFNULL(fileinfo.size, 0) < ? THEN %d", i)
+		boundArgs[i] = b
+	}
+	hist := make(types.SizeHistogram)
+	// the chunk counts are added up, like the sums of FTStatsSum
+	err := f.pathsQuery(
+		`SELECT cats.filecat AS fcat, CASE `+strings.Join(cases, " ")+fmt.Sprintf(` ELSE %d END AS bucket,`, len(bounds))+`
+			COUNT(fileinfo.path) AS fcatcount, IFNULL(SUM(fileinfo.size), 0) AS fcatsize FROM fileinfo, cats
+			WHERE fileinfo.catid=cats.id AND cats.filecat<>'dir' AND (%s) GROUP BY fcat, bucket`,
+		boundArgs, nil, paths, (maxWhereCond-len(bounds))/pathArgs, f.pathsWherePredicate, func(rs *sql.Rows) error {
+			var (
+				fcat      string
+				bucket    int
+				fcatcount uint
+				fcatsize  uint64
+			)
+			if err := rs.Scan(&fcat, &bucket, &fcatcount, &fcatsize); err != nil {
+				return err
+			}
+			for _, t := range []string{fcat, "total"} {
+				for len(hist[t]) <= bucket {
+					hist[t] = append(hist[t], sizeBucket(bounds, len(hist[t])))
+				}
+				hist[t][bucket].FileCount += fcatcount
+				hist[t][bucket].NumBytes += fcatsize
+			}
+			return nil
+		})
+	return hist, err
+}
+
+// sizeBucket returns the empty bucket i for bounds
+func sizeBucket(bounds []uint64, i int) types.SizeBucket {
+	var b types.SizeBucket
+	if i > 0 {
+		b.Lower = bounds[i-1]
+	}
+	if i < len(bounds) {
+		b.Upper = bounds[i]
+	}
+	return b
+}
@@ -0,0 +1,315 @@
+package ftsdb
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/Rainc1oud/filetypestats/types"
+	"github.com/Rainc1oud/filetypestats/utils"
+)
+
+// The schema version is kept in PRAGMA user_version, which is 0 for databases created before versioning existed.
+// Every schema change is appended as a migration to the registry below and never modified afterwards,
+// so that databases of any older version can be upgraded in place by running the missing migrations in order.
+
+type migration struct {
+	version int
+	descr   string
+	up      func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "create fileinfo and cats tables", migrateCreateTables},
+	{2, "add file metadata columns to fileinfo", migrateFileMetadata},
+	{3, "create dirstats table", migrateDirStats},
+	{4, "add file extension and MIME type columns to fileinfo", migrateExtMIME},
+	{5, "create snapshots tables", migrateSnapshots},
+	{6, "create filehash table", migrateFileHash},
+	{7, "add nlink column to fileinfo", migrateNlink},
+	{8, "add alloc column to fileinfo", migrateAlloc},
+	{9, "store fileinfo.updated in nanoseconds", migrateUpdatedNanos},
+	{10, "add archive column to fileinfo", migrateArchive},
+}
+
+// SchemaVersion is the database schema version created and understood by this library
+var SchemaVersion = migrations[len(migrations)-1].version
+
+// SchemaVersionError is returned when a database has a schema version this library doesn't understand
+type SchemaVersionError struct {
+	File      string
+	Version   int // schema version of the database
+	Supported int // latest schema version supported by the library
+}
+
+func (e *SchemaVersionError) Error() string {
+	return fmt.Sprintf("database %s has schema version %d, but this library only supports up to version %d", e.File, e.Version, e.Supported)
+}
+
+func schemaVersion(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}) (int, error) {
+	var v int
+	err := q.QueryRow(`PRAGMA user_version`).Scan(&v)
+	return v, err
+}
+
+// SchemaVersion returns the schema version of the opened database
+func (f *FileTypeStatsDB) SchemaVersion() (int, error) {
+	return schemaVersion(f.DB)
+}
+
+// migrate upgrades the database schema to SchemaVersion, each migration is executed in its own transaction
+func (f *FileTypeStatsDB) migrate() error {
+	v, err := f.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if v > SchemaVersion {
+		return &SchemaVersionError{File: f.fileName, Version: v, Supported: SchemaVersion}
+	}
+	for _, m := range migrations {
+		if m.version <= v {
+			continue
+		}
+		if err := f.runMigration(m); err != nil {
+			return fmt.Errorf("migrating %s to schema version %d (%s): %w", f.fileName, m.version, m.descr, err)
+		}
+	}
+	return nil
+}
+
+func (f *FileTypeStatsDB) runMigration(m migration) error {
+	f.dbmutex.Lock()
+	defer f.dbmutex.Unlock()
+
+	tx, err := f.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op after commit
+
+	// another connection may have migrated in the meantime
+	if v, err := schemaVersion(tx); err != nil || v >= m.version {
+		return err
+	}
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	// PRAGMA doesn't support bound parameters, version is an int from the registry
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, m.version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*** migrations ***/
+
+func migrateCreateTables(tx *sql.Tx) error {
+	// the updated field is INTEGER as unix time (sec, ns since version 9), for efficientcy (https://stackoverflow.com/q/31667495/12771809)
+	if _, err := tx.Exec(
+		`CREATE TABLE IF NOT EXISTS fileinfo (
+			path TEXT NOT NULL,
+			size BIGINT,
+			catid INTEGER NOT NULL,
+			updated INTEGER,
+			PRIMARY KEY (path)
+		);`); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(
+		`CREATE TABLE IF NOT EXISTS cats (
+			id INTEGER PRIMARY KEY,
+			filecat TEXT UNIQUE
+		);`); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func migrateFileMetadata(tx *sql.Tx) error {
+	// mtime is unix time in ns (the precision matters for change detection), inode and dev are stored as the bit-identical int64
+	for _, col := range []string{"mtime INTEGER", "inode INTEGER", "dev INTEGER", "uid INTEGER", "gid INTEGER", "mode INTEGER"} {
+		if _, err := tx.Exec(`ALTER TABLE fileinfo ADD COLUMN ` + col); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateDirStats(tx *sql.Tx) error {
+	// the per dir totals, see dirStatsDelta; dir is stored with trailing separator like the dirs in fileinfo
+	if _, err := tx.Exec(
+		`CREATE TABLE IF NOT EXISTS dirstats (
+			dir TEXT NOT NULL,
+			catid INTEGER NOT NULL,
+			dcount INTEGER NOT NULL DEFAULT 0,
+			dbytes INTEGER NOT NULL DEFAULT 0,
+			rcount INTEGER NOT NULL DEFAULT 0,
+			rbytes INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (dir, catid)
+		);`); err != nil {
+		return err
+	}
+
+	// aggregate the existing entries, none of them is an archive member yet
+	return aggregateDirStats(tx, `SELECT path, catid, size, NULL FROM fileinfo`)
+}
+
+// aggregateDirStats adds the rows (path, catid, size, archive) selected by qry to dirstats
+func aggregateDirStats(tx *sql.Tx, qry string) error {
+	rs, err := tx.Query(qry)
+	if err != nil {
+		return err
+	}
+	delta := make(dirStatsDelta)
+	if _, err := delta.addRows(rs, 1, nil); err != nil {
+		return err
+	}
+	upsert, err := tx.Prepare(qryUpsertDirStats)
+	if err != nil {
+		return err
+	}
+	defer upsert.Close()
+	prune, err := tx.Prepare(qryPruneDirStats)
+	if err != nil {
+		return err
+	}
+	defer prune.Close()
+	return delta.apply(upsert, prune)
+}
+
+func migrateExtMIME(tx *sql.Tx) error {
+	// both are NULL for dirs; the extension is taken from the path, the MIME type is only known after the next (re)scan
+	for _, col := range []string{"ext TEXT", "mime TEXT"} {
+		if _, err := tx.Exec(`ALTER TABLE fileinfo ADD COLUMN ` + col); err != nil {
+			return err
+		}
+	}
+	rs, err := tx.Query(`SELECT fileinfo.path FROM fileinfo, cats WHERE fileinfo.catid=cats.id AND cats.filecat<>'dir'`)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for rs.Next() {
+		var path string
+		if err := rs.Scan(&path); err != nil {
+			rs.Close()
+			return err
+		}
+		paths = append(paths, path)
+	}
+	rs.Close()
+	if err := rs.Err(); err != nil {
+		return err
+	}
+	upd, err := tx.Prepare(`UPDATE fileinfo SET ext=? WHERE path=?`)
+	if err != nil {
+		return err
+	}
+	defer upd.Close()
+	for _, path := range paths {
+		if _, err := upd.Exec(types.FileExt(path), path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateSnapshots(tx *sql.Tx) error {
+	// taken is unix time (sec), root is stored with trailing separator like the dirs in fileinfo
+	for _, qry := range []string{
+		`CREATE TABLE IF NOT EXISTS snapshots (
+			id INTEGER PRIMARY KEY,
+			root TEXT NOT NULL,
+			taken INTEGER NOT NULL
+		);`,
+		`CREATE INDEX IF NOT EXISTS snapshots_root_taken ON snapshots(root, taken);`,
+		`CREATE TABLE IF NOT EXISTS snapshotstats (
+			snapid INTEGER NOT NULL,
+			catid INTEGER NOT NULL,
+			count INTEGER NOT NULL,
+			bytes INTEGER NOT NULL,
+			PRIMARY KEY (snapid, catid)
+		);`,
+	} {
+		if _, err := tx.Exec(qry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateFileHash(tx *sql.Tx) error {
+	// the content digests are only valid for the size and mtime (ns, like fileinfo.mtime) they were computed for
+	_, err := tx.Exec(
+		`CREATE TABLE IF NOT EXISTS filehash (
+			path TEXT NOT NULL,
+			size BIGINT,
+			mtime INTEGER,
+			partial TEXT,
+			full TEXT,
+			PRIMARY KEY (path)
+		);`)
+	return err
+}
+
+func migrateNlink(tx *sql.Tx) error {
+	// NULL for dirs and until the next (re)scan
+	_, err := tx.Exec(`ALTER TABLE fileinfo ADD COLUMN nlink INTEGER`)
+	return err
+}
+
+func migrateAlloc(tx *sql.Tx) error {
+	// the allocated bytes (st_blocks*512), NULL if unknown until the next (re)scan
+	_, err := tx.Exec(`ALTER TABLE fileinfo ADD COLUMN alloc BIGINT`)
+	return err
+}
+
+func migrateUpdatedNanos(tx *sql.Tx) error {
+	// with a resolution of 1s, a scan couldn't tell the entries it refreshed from the stale ones written in the second it started
+	_, err := tx.Exec(`UPDATE fileinfo SET updated = updated * 1000000000`)
+	return err
+}
+
+func migrateArchive(tx *sql.Tx) error {
+	// the path of the archive (or fs.FS prefix) an entry is a member of, NULL for entries on the filesystem
+	if _, err := tx.Exec(`ALTER TABLE fileinfo ADD COLUMN archive TEXT`); err != nil {
+		return err
+	}
+	// the members were told apart by the separator in their path before, which has to do until the next (re)scan
+	rs, err := tx.Query(`SELECT path FROM fileinfo WHERE path GLOB '*` + utils.MemberSep + `*'`)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for rs.Next() {
+		var path string
+		if err := rs.Scan(&path); err != nil {
+			rs.Close()
+			return err
+		}
+		paths = append(paths, path)
+	}
+	rs.Close()
+	if err := rs.Err(); err != nil {
+		return err
+	}
+	upd, err := tx.Prepare(`UPDATE fileinfo SET archive=? WHERE path=?`)
+	if err != nil {
+		return err
+	}
+	defer upd.Close()
+	for _, path := range paths {
+		if _, err := upd.Exec(path[:strings.LastIndex(path, utils.MemberSep)], path); err != nil {
+			return err
+		}
+	}
+	// older versions counted all entries in all their ancestors, recount them with the members in their archives only
+	if _, err := tx.Exec(`DELETE FROM dirstats`); err != nil {
+		return err
+	}
+	return aggregateDirStats(tx, `SELECT path, catid, size, archive FROM fileinfo`)
+}
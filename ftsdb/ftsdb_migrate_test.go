@@ -0,0 +1,129 @@
+//go:build cgo
+
+package ftsdb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Rainc1oud/filetypestats/types"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestFileTypeStatsDB_SchemaVersion(t *testing.T) {
+
+	fdb := tmpDB(t)
+	defer os.RemoveAll(path.Dir(fdb.DbFileName()))
+
+	v, err := fdb.SchemaVersion()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if v != SchemaVersion {
+		t.Errorf("new DB has schema version %d, want %d", v, SchemaVersion)
+	}
+
+	// re-opening an up to date DB is a no-op
+	fdb.Close()
+	if fdb, err = New(fdb.DbFileName(), false); err != nil {
+		t.Fatal(err.Error())
+	}
+	fdb.Close()
+}
+
+func TestFileTypeStatsDB_MigrateUnversioned(t *testing.T) {
+	dtmp := t.TempDir()
+	dbfile := filepath.Join(dtmp, "legacy.sqlite")
+
+	// a DB as created by versions before schema versioning
+	db, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, q := range []string{
+		`CREATE TABLE fileinfo (path TEXT NOT NULL, size BIGINT, catid INTEGER NOT NULL, updated INTEGER, PRIMARY KEY (path))`,
+		`CREATE TABLE cats (id INTEGER PRIMARY KEY, filecat TEXT UNIQUE)`,
+		`INSERT INTO cats(filecat) VALUES('video')`,
+		`INSERT INTO fileinfo(path, size, catid, updated) VALUES('/legacy/file.mkv', 42, 1, 1600000000)`,
+		// an archive member as stored before it was tagged
+		`INSERT INTO fileinfo(path, size, catid, updated) VALUES('/legacy/a.zip!/m.mkv', 8, 1, 1600000000)`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	db.Close()
+
+	fdb, err := New(dbfile, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fdb.Close()
+
+	if v, err := fdb.SchemaVersion(); err != nil || v != SchemaVersion {
+		t.Errorf("migrated DB has schema version %d (err: %v), want %d", v, err, SchemaVersion)
+	}
+	got, err := fdb.FTStatsSum([]string{"/legacy/*"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if vs, ok := got["video"]; !ok || vs.NumBytes != 42 || vs.FileCount != 1 {
+		t.Errorf("legacy data not preserved after migration: \n%s", got.ToString())
+	}
+	// the extension is derived from the path, the MIME type is unknown until the next scan
+	fst, err := fdb.GetFileStat("/legacy/file.mkv")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fst == nil || fst.Ext != "mkv" || fst.MIME != "" {
+		t.Errorf("migrated entry = %+v, want Ext mkv and no MIME", fst)
+	}
+	// the members are tagged with their archive, and only counted inside it
+	if fst, err := fdb.GetFileStat("/legacy/a.zip!/m.mkv"); err != nil || fst == nil || fst.Archive != "/legacy/a.zip" {
+		t.Errorf("migrated member = %+v, %v; want archive /legacy/a.zip", fst, err)
+	}
+	if got, err := fdb.FTStatsSumWith([]string{"/legacy/*"}, types.SumOptions{Unique: true}); err != nil || got["video"].FileCount != 1 {
+		t.Errorf("legacy member counted outside its archive: %v\n%s", err, got.ToString())
+	}
+	// the update time (sec) is converted to ns
+	for _, ts := range []int64{1600000000, 1600000001} {
+		if err := fdb.DeleteOlderThan(time.Unix(ts, 0)); err != nil {
+			t.Fatal(err.Error())
+		}
+		if fst, _ := fdb.GetFileStat("/legacy/file.mkv"); (fst != nil) != (ts == 1600000000) {
+			t.Errorf("DeleteOlderThan(%d) kept the entry: %v", ts, fst != nil)
+		}
+	}
+}
+
+func TestFileTypeStatsDB_RefuseNewerSchema(t *testing.T) {
+	dtmp := t.TempDir()
+	dbfile := filepath.Join(dtmp, "future.sqlite")
+
+	db, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, SchemaVersion+1)); err != nil {
+		t.Fatal(err.Error())
+	}
+	db.Close()
+
+	fdb, err := New(dbfile, false)
+	var sverr *SchemaVersionError
+	if !errors.As(err, &sverr) {
+		t.Fatalf("New() error = %v, want *SchemaVersionError", err)
+	}
+	if fdb != nil {
+		t.Errorf("New() returned a DB instance for a newer schema")
+	}
+	if sverr.Version != SchemaVersion+1 || sverr.Supported != SchemaVersion {
+		t.Errorf("unexpected error content: %s", sverr.Error())
+	}
+}
@@ -9,7 +9,7 @@ import (
 
 // FTStatsSum returns the summary FileTypeStats for the given paths as a map of FTypeStat per File Type
 func (f *FileTypeStatsDB) FTStatsSum_(paths []string) (types.FileTypeStats, error) {
-	wp := f.pathsWherePredicate(paths)
+	wp, args := f.pathsWherePredicate(paths)
 	ftstats := make(types.FileTypeStats)
 	rs, err := f.DB.Query(fmt.Sprintf(
 		`SELECT cats.filecat AS fcat, fileinfo.path, COUNT(fileinfo.path) AS fcatcount, SUM(fileinfo.size) AS fcatsize FROM fileinfo, cats
@@ -19,7 +19,7 @@ func (f *FileTypeStatsDB) FTStatsSum_(paths []string) (types.FileTypeStats, erro
 		 SELECT 'total', '', COUNT(fileinfo.path), SUM(fileinfo.size) FROM cats, fileinfo
 		 	WHERE fileinfo.catid=cats.id AND (cats.filecat IS NOT 'dir') AND (%s)
 		 ORDER BY fileinfo.path
-			`, wp, wp))
+			`, wp, wp), append(args, args...)...)
 	if err != nil {
 		return ftstats, err
 	}
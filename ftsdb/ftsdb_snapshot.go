@@ -0,0 +1,215 @@
+package ftsdb
+
+import (
+	"database/sql"
+	"math"
+	"time"
+
+	"github.com/Rainc1oud/filetypestats/types"
+	"github.com/Rainc1oud/filetypestats/utils"
+)
+
+// Snapshots record the totals per category of a root dir at a point in time, so the growth of a tree can be queried later.
+// They are taken from dirstats, so taking one costs the same for any tree size.
+
+// SnapshotRetention limits the snapshots kept per root, it is applied whenever a snapshot is taken
+// The zero value keeps all snapshots
+type SnapshotRetention struct {
+	MaxAge   time.Duration // delete snapshots older than MaxAge, keep all if 0
+	MaxCount int           // keep only the MaxCount latest snapshots, keep all if 0
+}
+
+// SetSnapshotRetention sets the retention policy for all following snapshots
+func (f *FileTypeStatsDB) SetSnapshotRetention(r SnapshotRetention) {
+	f.dbmutex.Lock()
+	defer f.dbmutex.Unlock()
+	f.snapRetention = r
+}
+
+// TakeSnapshot records the current totals of the dir root (taken literally) and applies the retention policy to its snapshots
+func (f *FileTypeStatsDB) TakeSnapshot(root string) (*types.Snapshot, error) {
+	root = utils.DirTrailSep(root)
+	f.dbmutex.Lock()
+	defer f.dbmutex.Unlock()
+	tx, err := f.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op after commit
+
+	ins, err := f.txStmt(tx, qryInsertSnapshot)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var id int64
+	if err := ins.QueryRow(root, now.Unix()).Scan(&id); err != nil {
+		return nil, err
+	}
+	insStats, err := f.txStmt(tx, qryInsertSnapshotStats)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := insStats.Exec(id, root); err != nil {
+		return nil, err
+	}
+	if err := f.txPruneSnapshots(tx, root, now); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return f.Snapshot(id)
+}
+
+// txPruneSnapshots deletes the snapshots of root exceeding the retention policy, the caller must hold dbmutex
+func (f *FileTypeStatsDB) txPruneSnapshots(tx *sql.Tx, root string, now time.Time) error {
+	r := f.snapRetention
+	if r.MaxAge <= 0 && r.MaxCount <= 0 {
+		return nil
+	}
+	oldest, keep := int64(math.MinInt64), -1 // sqlite takes a negative LIMIT as no limit
+	if r.MaxAge > 0 {
+		oldest = now.Add(-r.MaxAge).Unix()
+	}
+	if r.MaxCount > 0 {
+		keep = r.MaxCount
+	}
+	sel, err := f.txStmt(tx, qrySelectExpiredSnapshots)
+	if err != nil {
+		return err
+	}
+	rs, err := sel.Query(root, oldest, root, keep)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rs.Next() {
+		var id int64
+		if err := rs.Scan(&id); err != nil {
+			rs.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rs.Close()
+	if err := rs.Err(); err != nil {
+		return err
+	}
+	for _, qry := range []string{qryDeleteSnapshotStats, qryDeleteSnapshot} {
+		del, err := f.txStmt(tx, qry)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if _, err := del.Exec(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Snapshot returns the snapshot with id, or nil (without error) if it doesn't exist
+func (f *FileTypeStatsDB) Snapshot(id int64) (*types.Snapshot, error) {
+	snaps, err := f.querySnapshots(qrySelectSnapshot, id)
+	if err != nil || len(snaps) == 0 {
+		return nil, err
+	}
+	return &snaps[0], nil
+}
+
+// Snapshots returns the time series of the snapshots of the dir root taken between since and until (inclusive, zero: unbounded), oldest first
+func (f *FileTypeStatsDB) Snapshots(root string, since, until time.Time) ([]types.Snapshot, error) {
+	from, to := int64(math.MinInt64), int64(math.MaxInt64)
+	if !since.IsZero() {
+		from = since.Unix()
+	}
+	if !until.IsZero() {
+		to = until.Unix()
+	}
+	return f.querySnapshots(qrySelectSnapshots, utils.DirTrailSep(root), from, to)
+}
+
+// SnapshotAt returns the latest snapshot of the dir root taken at or before t, or nil (without error) if there is none
+func (f *FileTypeStatsDB) SnapshotAt(root string, t time.Time) (*types.Snapshot, error) {
+	return f.snapshotBy(qrySelectSnapshotAt, utils.DirTrailSep(root), t.Unix())
+}
+
+// SnapshotDelta returns the change of the totals of the dir root from t1 to t2, between the snapshots SnapshotAt(t1) and SnapshotAt(t2)
+// If there is no snapshot at or before t1, the first one after t1 is used, so the delta covers the whole history until t2
+func (f *FileTypeStatsDB) SnapshotDelta(root string, t1, t2 time.Time) (types.FileTypeStatsDelta, error) {
+	from, err := f.SnapshotAt(root, t1)
+	if err != nil {
+		return nil, err
+	}
+	if from == nil {
+		if from, err = f.snapshotBy(qrySelectSnapshotAfter, utils.DirTrailSep(root), t1.Unix()); err != nil {
+			return nil, err
+		}
+	}
+	to, err := f.SnapshotAt(root, t2)
+	if err != nil {
+		return nil, err
+	}
+	if from == nil || to == nil || from.Taken.After(to.Taken) {
+		return make(types.FileTypeStatsDelta), nil // no snapshots in the range
+	}
+	return from.Delta(to), nil
+}
+
+// snapshotBy returns the snapshot with the id selected by qry, or nil if qry returns no row
+func (f *FileTypeStatsDB) snapshotBy(qry string, args ...interface{}) (*types.Snapshot, error) {
+	st, err := f.stmt(qry)
+	if err != nil {
+		return nil, err
+	}
+	var id int64
+	if err := st.QueryRow(args...).Scan(&id); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return f.Snapshot(id)
+}
+
+// querySnapshots returns the snapshots selected by qry (a selectSnapshots query)
+func (f *FileTypeStatsDB) querySnapshots(qry string, args ...interface{}) ([]types.Snapshot, error) {
+	st, err := f.stmt(qry)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := st.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	snaps := make([]types.Snapshot, 0)
+	var (
+		id, taken    int64
+		root         string
+		fcat         sql.NullString
+		count, bytes sql.NullInt64
+	)
+	for rs.Next() {
+		if err := rs.Scan(&id, &root, &taken, &fcat, &count, &bytes); err != nil {
+			return snaps, err
+		}
+		if len(snaps) == 0 || snaps[len(snaps)-1].ID != id {
+			snaps = append(snaps, types.Snapshot{ID: id, Root: root, Taken: time.Unix(taken, 0), Stats: make(types.FileTypeStats)})
+		}
+		if !fcat.Valid { // a snapshot of an empty tree
+			continue
+		}
+		s := &snaps[len(snaps)-1]
+		paths := []string{root + "*"}
+		addSum(s.Stats, paths, fcat.String, "", uint(count.Int64), uint64(bytes.Int64))
+		total := types.FTypeStat{}
+		if t, ok := s.Stats["total"]; ok {
+			total = *t
+		}
+		addSum(s.Stats, paths, "total", "", total.FileCount+uint(count.Int64), total.NumBytes+uint64(bytes.Int64))
+	}
+	return snaps, rs.Err()
+}
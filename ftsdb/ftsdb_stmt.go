@@ -0,0 +1,130 @@
+package ftsdb
+
+import (
+	"database/sql"
+)
+
+// the columns scanned by scanFileStat
+const fileStatCols = `fileinfo.path, cats.filecat, fileinfo.size, fileinfo.mtime, fileinfo.inode, fileinfo.dev, fileinfo.uid, fileinfo.gid, fileinfo.mode,
+	fileinfo.ext, fileinfo.mime, fileinfo.nlink, fileinfo.alloc, fileinfo.archive`
+
+// the snapshots with their stats, scanned by scanSnapshots
+const selectSnapshots = `SELECT snapshots.id, snapshots.root, snapshots.taken, cats.filecat, snapshotstats.count, snapshotstats.bytes
+	FROM snapshots LEFT JOIN snapshotstats ON snapshotstats.snapid=snapshots.id LEFT JOIN cats ON snapshotstats.catid=cats.id
+	`
+
+// all queries with a fixed shape are kept here and executed as prepared statements with bound parameters,
+// so we never have to escape values and sqlite doesn't need to re-parse them for every call
+const (
+	qryInsertCat = `INSERT INTO cats(filecat) VALUES(?)
+		ON CONFLICT(filecat) DO NOTHING`
+	// the fileinfo mutations return (path, catid, size, archive) of the affected rows to maintain dirstats, see dirStatsDelta
+	// args as returned by upsertArgs()
+	qryUpsertFileStats = `INSERT INTO fileinfo(path, size, catid, updated, mtime, inode, dev, uid, gid, mode, ext, mime, nlink, alloc, archive)
+		VALUES(?, ?, (SELECT id FROM cats WHERE filecat=?), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(path) DO
+		UPDATE SET size=excluded.size, catid=excluded.catid, updated=excluded.updated,
+			mtime=excluded.mtime, inode=excluded.inode, dev=excluded.dev, uid=excluded.uid, gid=excluded.gid, mode=excluded.mode,
+			ext=excluded.ext, mime=excluded.mime, nlink=excluded.nlink, alloc=excluded.alloc, archive=excluded.archive
+		RETURNING path, catid, size, archive`
+	qrySelectFileStat = `SELECT ` + fileStatCols + `
+		FROM fileinfo, cats WHERE fileinfo.catid=cats.id AND fileinfo.path=?`
+	// the archive of a member is a prefix of its path followed by the rest "!/member", which a move doesn't change,
+	// so the new archive is the new path without that rest (NULL stays NULL)
+	// args: (to, updated, from)
+	qryMoveFile = `UPDATE fileinfo SET path=?1, archive=substr(?1, 1, length(?1)-length(path)+length(archive)), updated=?2
+		WHERE fileinfo.path=?3
+		RETURNING path, catid, size, archive`
+	// args: (to, from, updated, GlobEscape(from)+"*", from), from and to with trailing separator; only the leading from is replaced
+	qryMoveTree = `UPDATE fileinfo SET path=?1 || substr(path, length(?2)+1),
+			archive=substr(?1 || substr(path, length(?2)+1), 1, length(?1)-length(?2)+length(archive)), updated=?3
+		WHERE fileinfo.path GLOB ?4 OR fileinfo.path=?5
+		RETURNING path, catid, size, archive`
+	// deletes the move target, except what is under the move source; args: (GlobEscape(to)+"*", to, GlobEscape(from)+"*", from)
+	qryDeleteMoveTarget = `DELETE FROM fileinfo WHERE (fileinfo.path GLOB ? OR fileinfo.path=?)
+		AND NOT (fileinfo.path GLOB ? OR fileinfo.path=?)
+		RETURNING path, catid, size, archive`
+	qryDeleteOlderThan = `DELETE FROM fileinfo WHERE fileinfo.updated < ?
+		RETURNING path, catid, size, archive`
+	// the prefix/path args are bound as (GlobEscape(p)+"/*", p)
+	qryDeleteOlderThanWithPrefix = `DELETE FROM fileinfo
+		WHERE fileinfo.updated < ?
+			AND (fileinfo.path GLOB ? OR fileinfo.path=?)
+		RETURNING path, catid, size, archive`
+	qryDeleteFileStats = `DELETE FROM fileinfo WHERE
+		fileinfo.path GLOB ? OR fileinfo.path=?
+		RETURNING path, catid, size, archive`
+	qrySelectPrefix = `SELECT fileinfo.path, cats.filecat, fileinfo.size FROM fileinfo, cats
+		WHERE fileinfo.catid=cats.id AND (fileinfo.path GLOB ? OR fileinfo.path=?)`
+	qryDeletePath = `DELETE FROM fileinfo WHERE fileinfo.path=?
+		RETURNING path, catid, size, archive`
+	qryPathExists    = `SELECT EXISTS(SELECT 1 FROM fileinfo WHERE fileinfo.path=?)`
+	qrySelectCatSize = `SELECT catid, size, archive FROM fileinfo WHERE fileinfo.path=?`
+
+	// args: (dir, catid, dcount, dbytes, rcount, rbytes) as deltas
+	qryUpsertDirStats = `INSERT INTO dirstats(dir, catid, dcount, dbytes, rcount, rbytes) VALUES(?, ?, ?, ?, ?, ?)
+		ON CONFLICT(dir, catid) DO
+		UPDATE SET dcount=dcount+excluded.dcount, dbytes=dbytes+excluded.dbytes,
+			rcount=rcount+excluded.rcount, rbytes=rbytes+excluded.rbytes`
+	qryInsertSnapshot      = `INSERT INTO snapshots(root, taken) VALUES(?, ?) RETURNING id`
+	qryInsertSnapshotStats = `INSERT INTO snapshotstats(snapid, catid, count, bytes)
+		SELECT ?, dirstats.catid, dirstats.rcount, dirstats.rbytes FROM dirstats WHERE dirstats.dir=? AND dirstats.rcount>0`
+	// args: (root, since, until), with the stats of each snapshot in consecutive rows
+	qrySelectSnapshots = selectSnapshots + `WHERE snapshots.root=? AND snapshots.taken>=? AND snapshots.taken<=? ORDER BY snapshots.taken, snapshots.id`
+	qrySelectSnapshot  = selectSnapshots + `WHERE snapshots.id=?`
+	// args: (root, taken) for the latest snapshot at or before taken
+	qrySelectSnapshotAt = `SELECT id FROM snapshots WHERE root=? AND taken<=? ORDER BY taken DESC, id DESC LIMIT 1`
+	// args: (root, taken) for the first snapshot after taken
+	qrySelectSnapshotAfter = `SELECT id FROM snapshots WHERE root=? AND taken>? ORDER BY taken, id LIMIT 1`
+	// args: (root, oldest taken to keep, root, number to keep)
+	qrySelectExpiredSnapshots = `SELECT id FROM snapshots WHERE root=? AND
+		(taken<? OR id NOT IN (SELECT id FROM snapshots WHERE root=? ORDER BY taken DESC, id DESC LIMIT ?))`
+	qryDeleteSnapshot      = `DELETE FROM snapshots WHERE id=?`
+	qryDeleteSnapshotStats = `DELETE FROM snapshotstats WHERE snapid=?`
+	qryUpsertFileHash      = `INSERT INTO filehash(path, size, mtime, partial, full) VALUES(?, ?, ?, ?, ?)
+		ON CONFLICT(path) DO
+		UPDATE SET size=excluded.size, mtime=excluded.mtime, partial=excluded.partial, full=excluded.full`
+	qryPruneFileHashes      = `DELETE FROM filehash WHERE NOT EXISTS (SELECT 1 FROM fileinfo WHERE fileinfo.path=filehash.path)`
+	qryPruneDirStats        = `DELETE FROM dirstats WHERE dir=? AND catid=? AND rcount<=0`
+	qrySelectDirStatsDirect = `SELECT cats.filecat, dirstats.dcount, dirstats.dbytes FROM dirstats, cats
+		WHERE dirstats.catid=cats.id AND dirstats.dir=? AND dirstats.dcount>0`
+	qrySelectDirStatsRecursive = `SELECT cats.filecat, dirstats.rcount, dirstats.rbytes FROM dirstats, cats
+		WHERE dirstats.catid=cats.id AND dirstats.dir=? AND dirstats.rcount>0`
+)
+
+// stmt returns the cached prepared statement for qry, preparing it on first use
+func (f *FileTypeStatsDB) stmt(qry string) (*sql.Stmt, error) {
+	f.stmtmutex.Lock()
+	defer f.stmtmutex.Unlock()
+	if st, ok := f.stmts[qry]; ok {
+		return st, nil
+	}
+	st, err := f.DB.Prepare(qry)
+	if err != nil {
+		return nil, err
+	}
+	if f.stmts == nil {
+		f.stmts = make(map[string]*sql.Stmt)
+	}
+	f.stmts[qry] = st
+	return st, nil
+}
+
+// txStmt returns the cached prepared statement for qry bound to transaction tx
+func (f *FileTypeStatsDB) txStmt(tx *sql.Tx, qry string) (*sql.Stmt, error) {
+	st, err := f.stmt(qry)
+	if err != nil {
+		return nil, err
+	}
+	return tx.Stmt(st), nil
+}
+
+// closeStmts closes and forgets all cached statements (they are bound to the DB handle)
+func (f *FileTypeStatsDB) closeStmts() {
+	f.stmtmutex.Lock()
+	defer f.stmtmutex.Unlock()
+	for _, st := range f.stmts {
+		st.Close()
+	}
+	f.stmts = nil
+}
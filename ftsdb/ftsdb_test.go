@@ -1,3 +1,5 @@
+//go:build cgo
+
 package ftsdb
 
 import (
@@ -7,9 +9,14 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/Rainc1oud/filetypestats/store"
 	"github.com/Rainc1oud/filetypestats/types"
+	"github.com/Rainc1oud/filetypestats/utils"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -133,3 +140,1212 @@ func TestFileTypeStatsDB_FTStatsSum(t *testing.T) {
 		})
 	}
 }
+
+func TestFileTypeStatsDB_ManyPaths(t *testing.T) {
+	fdb := tmpDB(t)
+	defer os.RemoveAll(path.Dir(fdb.DbFileName()))
+
+	// more paths than fit in the bound variables of one statement, every size twice and every dir with 40 files
+	const nfiles, ndirs = 12000, 300
+	var (
+		paths, dirs []string
+		hashes      []types.FileHash
+		total       uint64
+		dirBytes    = make(map[string]uint64)
+	)
+	batch := types.NewFTypeStatsBatch(1000)
+	for i := 0; i < nfiles; i++ {
+		dir := fmt.Sprintf("/many/d%03d/", i%ndirs)
+		fpath, size := fmt.Sprintf("%sf%05d", dir, i), uint64(i%(nfiles/2)+1)
+		if err := fdb.UpdateFileStatsMulti(fpath, []string{"image", "video"}[i%2], size, batch); err != nil {
+			t.Fatal(err.Error())
+		}
+		paths = append(paths, fpath)
+		hashes = append(hashes, types.FileHash{Path: fpath, Size: size, Full: fmt.Sprint(size)})
+		total += size
+		dirBytes[dir] += size
+	}
+	if err := fdb.CommitBatch(batch); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := fdb.UpdateFileHashes(hashes); err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < ndirs; i++ {
+		dirs = append(dirs, fmt.Sprintf("/many/d%03d/", i))
+	}
+
+	sum, err := fdb.FTStatsSum(paths)
+	if err != nil || sum["total"].FileCount != nfiles || sum["total"].NumBytes != total {
+		t.Fatalf("FTStatsSum() = %v, %v, want %d files with %d bytes", sum["total"], err, nfiles, total)
+	}
+	// a path matched in several chunks is counted once where every path is returned once
+	overlapping := append([]string{"/many/*"}, paths...)
+	sum, err = fdb.FTStatsSumWith(overlapping, types.SumOptions{Unique: true})
+	if err != nil || sum["total"].FileCount != nfiles || sum["total"].UniqueBytes != total {
+		t.Errorf("FTStatsSumWith(Unique) = %v, %v, want %d files with %d bytes", sum["total"], err, nfiles, total)
+	}
+	if fts, err := fdb.FTDumpPaths(overlapping); err != nil || len(*fts) != nfiles {
+		t.Errorf("FTDumpPaths() returned %d paths, %v, want %d", len(*fts), err, nfiles)
+	}
+	if fsts, err := fdb.FTDumpFileStats(overlapping); err != nil || len(fsts) != nfiles {
+		t.Errorf("FTDumpFileStats() returned %d paths, %v, want %d", len(fsts), err, nfiles)
+	}
+	top, err := fdb.TopFiles(overlapping, 3, types.FileFilter{})
+	var topPaths []string
+	for _, ft := range top {
+		topPaths = append(topPaths, ft.Path)
+	}
+	if want := []string{"/many/d299/f05999", "/many/d299/f11999", "/many/d298/f05998"}; err != nil || !cmp.Equal(topPaths, want) {
+		t.Errorf("TopFiles() = %v, %v, want %v", topPaths, err, want)
+	}
+	topDirs, err := fdb.TopDirs(dirs, 1, "", 0)
+	if err != nil || len(topDirs) != 1 || topDirs[0].Path != "/many/d299/" || topDirs[0].NumBytes != dirBytes["/many/d299/"] {
+		t.Errorf("TopDirs() = %v, %v, want /many/d299/ with %d bytes", topDirs, err, dirBytes["/many/d299/"])
+	}
+	hist, err := fdb.SizeHistogram(paths, []uint64{nfiles / 4})
+	if err != nil || hist["total"][0].FileCount+hist["total"][1].FileCount != nfiles || hist["total"][0].FileCount != 2*(nfiles/4-1) {
+		t.Errorf("SizeHistogram() = %v, %v", hist["total"], err)
+	}
+	if groups, err := fdb.DedupCandidates(overlapping); err != nil || len(groups) != nfiles/2 || len(groups[0]) != 2 || groups[0][0].Size != 1 {
+		t.Errorf("DedupCandidates() returned %d groups, %v, want %d pairs", len(groups), err, nfiles/2)
+	}
+	if dups, err := fdb.Duplicates(overlapping); err != nil || len(dups) != nfiles/2 || len(dups[0].Paths) != 2 || dups[0].Size != nfiles/2 {
+		t.Errorf("Duplicates() returned %d groups, %v, want %d pairs", len(dups), err, nfiles/2)
+	}
+}
+
+// dumpPaths returns the set of all paths in the DB matching paths
+func dumpPaths(t *testing.T, fdb *FileTypeStatsDB, paths ...string) map[string]bool {
+	fts, err := fdb.FTDumpPaths(paths)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	m := make(map[string]bool)
+	for _, ft := range *fts {
+		m[ft.Path] = true
+	}
+	return m
+}
+
+func TestFileTypeStatsDB_SpecialChars(t *testing.T) {
+
+	fdb := tmpDB(t)
+	defer os.RemoveAll(path.Dir(fdb.DbFileName()))
+
+	files := []string{
+		"/d/it's.txt",
+		"/d/quote\"d.txt",
+		"/d/a*",
+		"/d/ab",
+		"/d/a?c",
+		"/d/abc",
+		"/d/[x]/f1",
+		"/d/x/f2",
+		"/d/bin\xff\xfe.dat",
+		"/d/sub'dir/",
+		"/d/sub'dir/f3",
+	}
+	batch := types.NewFTypeStatsBatch(4)
+	for i, f := range files {
+		if i%2 == 0 {
+			if err := fdb.UpdateFileStats(f, "other", uint64(i)); err != nil {
+				t.Fatalf("UpdateFileStats(%q): %s", f, err.Error())
+			}
+		} else if err := fdb.UpdateFileStatsMulti(f, "other", uint64(i), batch); err != nil {
+			t.Fatalf("UpdateFileStatsMulti(%q): %s", f, err.Error())
+		}
+	}
+	if err := fdb.CommitBatch(batch); err != nil {
+		t.Fatal(err.Error())
+	}
+	got := dumpPaths(t, fdb, "/d/*")
+	for _, f := range files {
+		if !got[f] {
+			t.Errorf("%q not stored", f)
+		}
+	}
+
+	// glob characters in a path to delete must be literal
+	for _, del := range []string{"/d/a*", "/d/a?c", "/d/[x]", "/d/sub'dir"} {
+		if err := fdb.DeleteFileStats(del); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	got = dumpPaths(t, fdb, "/d/*")
+	for _, f := range []string{"/d/ab", "/d/abc", "/d/x/f2", "/d/it's.txt", "/d/bin\xff\xfe.dat"} {
+		if !got[f] {
+			t.Errorf("%q was deleted, but shouldn't have been", f)
+		}
+	}
+	for _, f := range []string{"/d/a*", "/d/a?c", "/d/[x]/f1", "/d/sub'dir/", "/d/sub'dir/f3"} {
+		if got[f] {
+			t.Errorf("%q wasn't deleted", f)
+		}
+	}
+
+	// same for the prefix of DeleteOlderThanWithPrefix
+	if err := fdb.UpdateFileStats("/e/[x]/f1", "other", 1); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := fdb.UpdateFileStats("/e/x/f2", "other", 1); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := fdb.DeleteOlderThanWithPrefix(time.Now().Add(time.Hour), "/e/[x]"); err != nil {
+		t.Fatal(err.Error())
+	}
+	got = dumpPaths(t, fdb, "/e/*")
+	if got["/e/[x]/f1"] || !got["/e/x/f2"] {
+		t.Errorf("DeleteOlderThanWithPrefix() didn't treat the prefix literally: %v", got)
+	}
+}
+
+func TestFileTypeStatsDB_FileStat(t *testing.T) {
+
+	fdb := tmpDB(t)
+	defer os.RemoveAll(path.Dir(fdb.DbFileName()))
+
+	mtime := time.Date(2022, 4, 30, 9, 15, 18, 123456789, time.UTC)
+	want := types.FileStat{
+		FTypeStat: types.FTypeStat{Path: "/nas/video/movie.mkv", FType: "video", NumBytes: 4 << 30, FileCount: 1, AllocBytes: 4<<30 + 4096},
+		Ext:       "mkv",
+		MIME:      "video/x-matroska",
+		ModTime:   mtime,
+		Inode:     1<<63 + 12345, // must survive the round trip through a signed sqlite INTEGER
+		Device:    2049,
+		Nlink:     2,
+		Uid:       1026,
+		Gid:       100,
+		Mode:      0640,
+	}
+	if err := fdb.UpdateFileStat(&want); err != nil {
+		t.Fatal(err.Error())
+	}
+	batch := types.NewFTypeStatsBatch(10)
+	want2 := want
+	want2.Path = "/nas/video/movie2.mkv"
+	want2.Inode = 7
+	if err := fdb.UpdateFileStatMulti(&want2, batch); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := fdb.CommitBatch(batch); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, w := range []types.FileStat{want, want2} {
+		got, err := fdb.GetFileStat(w.Path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if got == nil || !got.ModTime.Equal(w.ModTime) {
+			t.Fatalf("GetFileStat(%s) = %v, want %v", w.Path, got, w)
+		}
+		got.ModTime = w.ModTime // compare without location
+		if !cmp.Equal(*got, w) {
+			t.Errorf("GetFileStat(%s) = %+v, want %+v", w.Path, *got, w)
+		}
+	}
+
+	if got, err := fdb.GetFileStat("/not/there"); got != nil || err != nil {
+		t.Errorf("GetFileStat() for non-existing path = %v, %v; want nil, nil", got, err)
+	}
+
+	all, err := fdb.FTDumpFileStats([]string{"/nas/*"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(all) != 2 {
+		t.Errorf("FTDumpFileStats() returned %d records, want 2", len(all))
+	}
+}
+
+func TestFileTypeStatsDB_PurgeExcluded(t *testing.T) {
+
+	fdb := tmpDB(t)
+	defer os.RemoveAll(path.Dir(fdb.DbFileName()))
+
+	for _, p := range []struct {
+		path, cat string
+		size      uint64
+	}{
+		{"/r/", "dir", 0},
+		{"/r/keep", "other", 10},
+		{"/r/big", "video", 1000},
+		{"/r/tmp/", "dir", 0},
+		{"/r/tmp/a", "other", 1},
+		{"/r/tmp/sub/", "dir", 0},
+		{"/r/tmp/sub/b", "other", 1},
+		{"/r/tmpfile", "other", 1}, // the subtree delete must not hit its "sibling"
+		{"/other/big", "video", 1000},
+	} {
+		if err := fdb.UpdateFileStats(p.path, p.cat, p.size); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	n, err := fdb.PurgeExcluded("/r", func(path string, isDir bool, size uint64) bool {
+		return (isDir && path == "/r/tmp/") || (!isDir && size > 100)
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n != 5 {
+		t.Errorf("PurgeExcluded() deleted %d entries, want 5", n)
+	}
+	want := map[string]bool{"/r/": true, "/r/keep": true, "/r/tmpfile": true, "/other/big": true}
+	if got := dumpPaths(t, fdb, "/r/*", "/other/*"); !cmp.Equal(got, want) {
+		t.Errorf("PurgeExcluded() left %v, want %v", got, want)
+	}
+}
+
+func TestFileTypeStatsDB_DeleteFileStatsTree(t *testing.T) {
+
+	fdb := tmpDB(t)
+	defer os.RemoveAll(path.Dir(fdb.DbFileName()))
+
+	for _, p := range []struct{ path, cat string }{
+		{"/a/", "dir"},
+		{"/a/x", "other"},
+		{"/a/sub/", "dir"},
+		{"/a/sub/y", "other"},
+		{"/ab", "other"},
+		{"/a.txt", "other"},
+		{"/f", "other"},
+		{"/f/inconsistent", "other"},
+	} {
+		if err := fdb.UpdateFileStats(p.path, p.cat, 1); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	tests := []struct {
+		path   string
+		isDir  bool
+		n      int64
+		remain map[string]bool
+	}{
+		{"/a", true, 4, map[string]bool{"/ab": true, "/a.txt": true, "/f": true, "/f/inconsistent": true}},
+		{"/f", false, 1, map[string]bool{"/ab": true, "/a.txt": true, "/f/inconsistent": true}},
+		{"/a", false, 0, map[string]bool{"/ab": true, "/a.txt": true, "/f/inconsistent": true}},
+	}
+	for _, tt := range tests {
+		isDir, n, err := fdb.DeleteFileStatsTree(tt.path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if isDir != tt.isDir || n != tt.n {
+			t.Errorf("DeleteFileStatsTree(%s) = %t, %d; want %t, %d", tt.path, isDir, n, tt.isDir, tt.n)
+		}
+		if got := dumpPaths(t, fdb, "/*"); !cmp.Equal(got, tt.remain) {
+			t.Errorf("DeleteFileStatsTree(%s) left %v, want %v", tt.path, got, tt.remain)
+		}
+	}
+}
+
+func TestFileTypeStatsDB_UpdateFilePath(t *testing.T) {
+
+	fdb := tmpDB(t)
+	defer os.RemoveAll(path.Dir(fdb.DbFileName()))
+
+	sizes := func() map[string]uint64 {
+		fts, err := fdb.FTDumpPaths([]string{"/*"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		m := make(map[string]uint64)
+		for _, ft := range *fts {
+			m[ft.Path] = ft.NumBytes
+		}
+		return m
+	}
+	for p, size := range map[string]uint64{
+		"/a/b/":       0,
+		"/a/b/f":      1,
+		"/a/b/sub/":   0,
+		"/a/b/sub/g":  2,
+		"/a/bc":       3, // prefix of the name, but not under the moved dir
+		"/x/a/b/":     0, // contains the moved path, but not as prefix
+		"/x/a/b/f":    4,
+		"/y/a/b/f":    5,
+		"/g[1]/":      0,
+		"/g[1]/*?":    6,
+		"/g1/":        0, // matches the glob "/g[1]/"
+		"/g1/h":       7,
+		"/t/":         0, // the target of a dir move, with stale entries
+		"/t/stale":    8,
+		"/t/sub/":     0,
+		"/t/sub/old":  9,
+		"/tx":         10,
+		"/ü/":         0, // multi byte chars must not shift the replaced prefix
+		"/ü/ä":        11,
+		"/file1":      12,
+		"/file1/junk": 13, // inconsistent, but a file move must not touch it
+	} {
+		cat := "other"
+		if strings.HasSuffix(p, "/") {
+			cat = "dir"
+		}
+		if err := fdb.UpdateFileStats(p, cat, size); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	tests := []struct {
+		from, to string
+		moved    map[string]uint64 // expected entries after the move which differ from before
+		gone     []string
+	}{
+		{"/a/b/", "/c/b/",
+			map[string]uint64{"/c/b/": 0, "/c/b/f": 1, "/c/b/sub/": 0, "/c/b/sub/g": 2},
+			[]string{"/a/b/", "/a/b/f", "/a/b/sub/", "/a/b/sub/g"}},
+		{"/y/a/b/f", "/x/a/b/f", // replaces an existing file
+			map[string]uint64{"/x/a/b/f": 5},
+			[]string{"/y/a/b/f"}},
+		{"/g[1]/", "/h*/",
+			map[string]uint64{"/h*/": 0, "/h*/*?": 6},
+			[]string{"/g[1]/", "/g[1]/*?"}},
+		{"/c/b/", "/t", // replaces an existing dir, to without trailing separator
+			map[string]uint64{"/t/": 0, "/t/f": 1, "/t/sub/": 0, "/t/sub/g": 2},
+			[]string{"/c/b/", "/c/b/f", "/c/b/sub/", "/c/b/sub/g", "/t/stale", "/t/sub/old"}},
+		{"/ü/", "/ö/",
+			map[string]uint64{"/ö/": 0, "/ö/ä": 11},
+			[]string{"/ü/", "/ü/ä"}},
+		{"/file1", "/file2",
+			map[string]uint64{"/file2": 12},
+			[]string{"/file1"}},
+	}
+	for _, tt := range tests {
+		want := sizes()
+		for _, p := range tt.gone {
+			delete(want, p)
+		}
+		for p, size := range tt.moved {
+			want[p] = size
+		}
+		if err := fdb.UpdateFilePath(tt.from, tt.to); err != nil {
+			t.Fatal(err.Error())
+		}
+		if got := sizes(); !cmp.Equal(got, want) {
+			t.Errorf("UpdateFilePath(%s, %s): %s", tt.from, tt.to, cmp.Diff(want, got))
+		}
+	}
+}
+
+// checkDirStats compares the dirstats table with the totals recomputed from all entries
+func checkDirStats(t *testing.T, fdb *FileTypeStatsDB, step string) {
+	t.Helper()
+	type stat struct{ DCount, DBytes, RCount, RBytes int64 }
+	fts, err := fdb.FTDumpPaths([]string{"/*"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := make(map[string]stat)
+	for _, ft := range *fts {
+		for i := range ft.Path {
+			if ft.Path[i] != '/' {
+				continue
+			}
+			dir := ft.Path[:i+1]
+			k := dir + " " + ft.FType
+			s := want[k]
+			s.RCount++
+			s.RBytes += int64(ft.NumBytes)
+			if !strings.Contains(ft.Path[len(dir):], "/") {
+				s.DCount++
+				s.DBytes += int64(ft.NumBytes)
+			}
+			want[k] = s
+		}
+	}
+
+	rs, err := fdb.DB.Query(`SELECT dirstats.dir, cats.filecat, dcount, dbytes, rcount, rbytes FROM dirstats, cats WHERE dirstats.catid=cats.id`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer rs.Close()
+	got := make(map[string]stat)
+	for rs.Next() {
+		var (
+			dir, cat string
+			s        stat
+		)
+		if err := rs.Scan(&dir, &cat, &s.DCount, &s.DBytes, &s.RCount, &s.RBytes); err != nil {
+			t.Fatal(err.Error())
+		}
+		got[dir+" "+cat] = s
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%s: dirstats differ from fileinfo: %s", step, cmp.Diff(want, got))
+	}
+}
+
+func TestFileTypeStatsDB_DirStats(t *testing.T) {
+
+	fdb := tmpDB(t)
+	defer os.RemoveAll(path.Dir(fdb.DbFileName()))
+
+	batch := types.NewFTypeStatsBatch(50)
+	cats := []string{"video", "image", "other"}
+	for i := 0; i < 200; i++ {
+		p := fmt.Sprintf("/m/d%d/s%d/f%d", i%3, i%5, i)
+		if err := fdb.UpdateFileStatsMulti(p, cats[i%len(cats)], uint64(i), batch); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	for _, d := range []string{"/m/", "/m/d0/", "/m/d1/", "/m/d2/", "/m/d0/s0/", "/m/d1/s1/", "/[x]/"} {
+		if err := fdb.UpdateFileStatsMulti(d, "dir", 0, batch); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := fdb.CommitBatch(batch); err != nil {
+		t.Fatal(err.Error())
+	}
+	checkDirStats(t, fdb, "batch insert")
+
+	steps := []struct {
+		name string
+		fun  func() error
+	}{
+		{"update", func() error { return fdb.UpdateFileStats("/m/d0/s0/f0", "image", 1000) }},
+		{"insert", func() error { return fdb.UpdateFileStats("/[x]/f", "video", 7) }},
+		{"move dir", func() error { return fdb.UpdateFilePath("/m/d1/", "/n/d1") }},
+		{"move dir over dir", func() error { return fdb.UpdateFilePath("/m/d2/", "/n/d1/") }},
+		{"move file", func() error { return fdb.UpdateFilePath("/m/d0/s0/f0", "/[x]/f") }},
+		{"delete tree", func() error { _, _, err := fdb.DeleteFileStatsTree("/m/d0/s1"); return err }},
+		{"delete file", func() error { return fdb.DeleteFileStats("/m/d0/s2/f2") }},
+		{"purge", func() error {
+			_, err := fdb.PurgeExcluded("/", func(path string, isDir bool, size uint64) bool { return size%7 == 0 })
+			return err
+		}},
+		{"delete older", func() error { return fdb.DeleteOlderThanWithPrefix(time.Now().Add(time.Hour), "/n") }},
+	}
+	for _, s := range steps {
+		if err := s.fun(); err != nil {
+			t.Fatalf("%s: %s", s.name, err.Error())
+		}
+		checkDirStats(t, fdb, s.name)
+	}
+
+	// a literal dir is answered from dirstats, the result must not differ from the scan of fileinfo
+	for _, p := range []string{"/*", "/m/*", "/m/d0/*", "/m/d0/", "/n/d1/", "/none/*"} {
+		got, err := fdb.FTStatsSum([]string{p})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		want, err := fdb.FTStatsSum([]string{p, p}) // not a single path, so it takes the scan
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, s := range want {
+			s.Path = "*"
+		}
+		for _, s := range got {
+			s.Path = "*"
+		}
+		if !cmp.Equal(got, want) {
+			t.Errorf("FTStatsSum(%s): %s", p, cmp.Diff(want, got))
+		}
+	}
+
+	// escaped dirs and the literal dirs of several paths are answered from dirstats as well, the globs from fileinfo:
+	// a row inserted behind the back of dirstats is only counted by the scan
+	for i, p := range []string{"/[x]/a", "/m/d0/a", "/m/d1/a", "/n/d1/a"} {
+		if err := fdb.UpdateFileStats(p, "video", uint64(10*(i+1))); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	for _, p := range []string{"/[x]/ghost", "/n/d1/ghost"} {
+		if _, err := fdb.DB.Exec(`INSERT INTO fileinfo(path, size, catid, updated) VALUES(?, 1000000, 1, 0)`, p); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	total := func(paths ...string) uint64 {
+		t.Helper()
+		got, err := fdb.FTStatsSum(paths)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if got["total"] == nil {
+			return 0
+		}
+		return got["total"].NumBytes
+	}
+	x, m, n := total(utils.GlobEscape("/[x]/")+"*"), total("/m/d0/*"), total("/n/*[1]/")
+	if x >= 1000000 || m >= 1000000 || x == 0 || m == 0 {
+		t.Errorf("escaped or plain dir not summed from dirstats: %d, %d bytes", x, m)
+	}
+	if n < 1000000 {
+		t.Errorf("glob not summed from fileinfo: %d bytes", n)
+	}
+	if got := total(utils.GlobEscape("/[x]/")+"*", "/m/d0/*", "/n/*[1]/"); got != x+m+n {
+		t.Errorf("FTStatsSum of several paths = %d bytes, want %d", got, x+m+n)
+	}
+	if got := total("/m/*", "/m/d0/*"); got != total("/m/*") {
+		t.Errorf("FTStatsSum of overlapping dirs = %d bytes, counted twice", got)
+	}
+}
+
+func TestFileTypeStatsDB_Top(t *testing.T) {
+
+	fdb := tmpDB(t)
+	defer os.RemoveAll(path.Dir(fdb.DbFileName()))
+
+	for _, p := range []struct {
+		path, cat string
+		size      uint64
+	}{
+		{"/s/", "dir", 0},
+		{"/s/a/", "dir", 0},
+		{"/s/a/v1", "video", 100},
+		{"/s/a/i1", "image", 10},
+		{"/s/a/deep/", "dir", 0},
+		{"/s/a/deep/v2", "video", 300},
+		{"/s/b/", "dir", 0},
+		{"/s/b/i2", "image", 50},
+		{"/s/b/i3", "image", 40},
+		{"/s/v3", "video", 200},
+		{"/t/", "dir", 0},
+		{"/t/v4", "video", 1000},
+	} {
+		if err := fdb.UpdateFileStats(p.path, p.cat, p.size); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	names := func(fts []types.FTypeStat, err error) []string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		s := make([]string, len(fts))
+		for i, ft := range fts {
+			s[i] = fmt.Sprintf("%s:%d", ft.Path, ft.NumBytes)
+		}
+		return s
+	}
+
+	files := []struct {
+		paths  []string
+		n      int
+		filter types.FileFilter
+		want   []string
+	}{
+		{[]string{"/s/*"}, 3, types.FileFilter{}, []string{"/s/a/deep/v2:300", "/s/v3:200", "/s/a/v1:100"}},
+		{[]string{"/s/*"}, 0, types.FileFilter{Categories: []string{"image"}}, []string{"/s/b/i2:50", "/s/b/i3:40", "/s/a/i1:10"}},
+		{[]string{"/s/a/"}, 0, types.FileFilter{}, []string{"/s/a/v1:100", "/s/a/i1:10"}},
+		{[]string{"/s/*", "/t/*", "/s/b/*"}, 2, types.FileFilter{MaxSize: 300}, []string{"/s/a/deep/v2:300", "/s/v3:200"}},
+		{[]string{"/*"}, 0, types.FileFilter{Categories: []string{"video", "image"}, MinSize: 50, MaxSize: 200}, []string{"/s/v3:200", "/s/a/v1:100", "/s/b/i2:50"}},
+	}
+	for _, tt := range files {
+		if got := names(fdb.TopFiles(tt.paths, tt.n, tt.filter)); !cmp.Equal(got, tt.want) {
+			t.Errorf("TopFiles(%v, %d, %+v) = %v, want %v", tt.paths, tt.n, tt.filter, got, tt.want)
+		}
+	}
+
+	dirs := []struct {
+		paths    []string
+		n        int
+		category string
+		depth    int
+		want     []string
+	}{
+		{[]string{"/s/*"}, 0, "video", 0, []string{"/s/:600", "/s/a/:400", "/s/a/deep/:300"}},
+		{[]string{"/s/*"}, 0, "video", 1, []string{"/s/:600", "/s/a/:400"}},
+		{[]string{"/s/*"}, 2, "image", 0, []string{"/s/:100", "/s/b/:90"}},
+		{[]string{"/s/*/"}, 0, "", 0, []string{"/s/a/:410", "/s/b/:90"}},
+		{[]string{"/*"}, 3, "total", 1, []string{"/:1700", "/t/:1000", "/s/:700"}},
+	}
+	for _, tt := range dirs {
+		if got := names(fdb.TopDirs(tt.paths, tt.n, tt.category, tt.depth)); !cmp.Equal(got, tt.want) {
+			t.Errorf("TopDirs(%v, %d, %s, %d) = %v, want %v", tt.paths, tt.n, tt.category, tt.depth, got, tt.want)
+		}
+	}
+}
+
+func TestFileTypeStatsDB_SizeHistogram(t *testing.T) {
+
+	fdb := tmpDB(t)
+	defer os.RemoveAll(path.Dir(fdb.DbFileName()))
+
+	for _, p := range []struct {
+		path, cat string
+		size      uint64
+	}{
+		{"/h/", "dir", 4096},
+		{"/h/empty", "other", 0},
+		{"/h/one", "other", 1},
+		{"/h/i1", "image", 3},
+		{"/h/i2", "image", 2},
+		{"/h/v", "video", 1000},
+		{"/x/v", "video", 5},
+	} {
+		if err := fdb.UpdateFileStats(p.path, p.cat, p.size); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	b := func(lower, upper uint64, count uint, size uint64) types.SizeBucket {
+		return types.SizeBucket{Lower: lower, Upper: upper, FileCount: count, NumBytes: size}
+	}
+	tests := []struct {
+		name   string
+		paths  []string
+		bounds []uint64
+		want   types.SizeHistogram
+	}{
+		{"log2", []string{"/h/*"}, nil, types.SizeHistogram{
+			"other": {b(0, 1, 1, 0), b(1, 2, 1, 1)},
+			"image": {b(0, 1, 0, 0), b(1, 2, 0, 0), b(2, 4, 2, 5)},
+			"video": {b(0, 1, 0, 0), b(1, 2, 0, 0), b(2, 4, 0, 0), b(4, 8, 0, 0), b(8, 16, 0, 0), b(16, 32, 0, 0),
+				b(32, 64, 0, 0), b(64, 128, 0, 0), b(128, 256, 0, 0), b(256, 512, 0, 0), b(512, 1024, 1, 1000)},
+			"total": {b(0, 1, 1, 0), b(1, 2, 1, 1), b(2, 4, 2, 5), b(4, 8, 0, 0), b(8, 16, 0, 0), b(16, 32, 0, 0),
+				b(32, 64, 0, 0), b(64, 128, 0, 0), b(128, 256, 0, 0), b(256, 512, 0, 0), b(512, 1024, 1, 1000)},
+		}},
+		{"custom bounds", []string{"/h/*", "/x/*"}, []uint64{3, 100}, types.SizeHistogram{
+			"other": {b(0, 3, 2, 1)},
+			"image": {b(0, 3, 1, 2), b(3, 100, 1, 3)},
+			"video": {b(0, 3, 0, 0), b(3, 100, 1, 5), b(100, 0, 1, 1000)},
+			"total": {b(0, 3, 3, 3), b(3, 100, 2, 8), b(100, 0, 1, 1000)},
+		}},
+		{"nothing selected", []string{"/none/*"}, nil, types.SizeHistogram{}},
+	}
+	for _, tt := range tests {
+		got, err := fdb.SizeHistogram(tt.paths, tt.bounds)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !cmp.Equal(got, tt.want) {
+			t.Errorf("%s: %s", tt.name, cmp.Diff(tt.want, got))
+		}
+	}
+
+	if _, err := fdb.SizeHistogram([]string{"/*"}, []uint64{10, 10}); err == nil {
+		t.Errorf("SizeHistogram() with bounds not ascending didn't fail")
+	}
+}
+
+func TestFileTypeStatsDB_Snapshots(t *testing.T) {
+
+	fdb := tmpDB(t)
+	defer os.RemoveAll(path.Dir(fdb.DbFileName()))
+
+	counts := func(fts types.FileTypeStats) map[string][2]uint64 {
+		m := make(map[string][2]uint64)
+		for k, s := range fts {
+			m[k] = [2]uint64{uint64(s.FileCount), s.NumBytes}
+		}
+		return m
+	}
+
+	empty, err := fdb.TakeSnapshot("/p")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if empty.Root != "/p/" || len(empty.Stats) != 0 {
+		t.Errorf("snapshot of an empty tree = %+v", empty)
+	}
+
+	for _, p := range []struct {
+		path, cat string
+		size      uint64
+	}{
+		{"/p/", "dir", 0},
+		{"/p/a.jpg", "image", 100},
+		{"/p/b.jpg", "image", 50},
+		{"/q/c.jpg", "image", 1000},
+	} {
+		if err := fdb.UpdateFileStats(p.path, p.cat, p.size); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	first, err := fdb.TakeSnapshot("/p/")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := map[string][2]uint64{"dir": {1, 0}, "image": {2, 150}, "total": {3, 150}}
+	if got := counts(first.Stats); !cmp.Equal(got, want) {
+		t.Errorf("TakeSnapshot(): %s", cmp.Diff(want, got))
+	}
+
+	if err := fdb.UpdateFileStats("/p/c.mkv", "video", 1000); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := fdb.DeleteFileStats("/p/b.jpg"); err != nil {
+		t.Fatal(err.Error())
+	}
+	second, err := fdb.TakeSnapshot("/p")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	series, err := fdb.Snapshots("/p", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(series) != 3 || series[0].ID != empty.ID || series[1].ID != first.ID || series[2].ID != second.ID {
+		t.Fatalf("Snapshots() = %+v, want the 3 snapshots in order", series)
+	}
+	if got := counts(series[1].Stats); !cmp.Equal(got, want) {
+		t.Errorf("Snapshots()[1]: %s", cmp.Diff(want, got))
+	}
+	if series, err := fdb.Snapshots("/p", time.Now().Add(time.Hour), time.Time{}); err != nil || len(series) != 0 {
+		t.Errorf("Snapshots() in the future = %v, %v; want none", series, err)
+	}
+
+	delta := first.Delta(second)
+	wantDelta := types.FileTypeStatsDelta{
+		"dir":   {FType: "dir"},
+		"image": {FType: "image", NumBytes: -50, FileCount: -1},
+		"video": {FType: "video", NumBytes: 1000, FileCount: 1},
+		"total": {FType: "total", NumBytes: 950, FileCount: 0},
+	}
+	if !cmp.Equal(delta, wantDelta) {
+		t.Errorf("Delta(): %s", cmp.Diff(wantDelta, delta))
+	}
+	// without a snapshot before t1 the delta starts from the first one, which is empty here
+	got, err := fdb.SnapshotDelta("/p", time.Now().Add(-time.Hour), time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if wantAll := (*types.Snapshot)(nil).Delta(second); !cmp.Equal(got, wantAll) {
+		t.Errorf("SnapshotDelta(): %s", cmp.Diff(wantAll, got))
+	}
+
+	fdb.SetSnapshotRetention(SnapshotRetention{MaxCount: 2})
+	if _, err := fdb.TakeSnapshot("/q"); err != nil {
+		t.Fatal(err.Error())
+	}
+	last, err := fdb.TakeSnapshot("/p")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if series, err := fdb.Snapshots("/p", time.Time{}, time.Time{}); err != nil || len(series) != 2 || series[0].ID != second.ID || series[1].ID != last.ID {
+		t.Errorf("Snapshots() after retention = %+v, %v; want the last 2", series, err)
+	}
+	if series, err := fdb.Snapshots("/q", time.Time{}, time.Time{}); err != nil || len(series) != 1 {
+		t.Errorf("retention of /p touched /q: %+v, %v", series, err)
+	}
+	if snap, err := fdb.Snapshot(first.ID); snap != nil || err != nil {
+		t.Errorf("Snapshot() of a pruned snapshot = %v, %v; want nil, nil", snap, err)
+	}
+}
+
+func TestFileTypeStatsDB_Unique(t *testing.T) {
+
+	fdb := tmpDB(t)
+	defer os.RemoveAll(path.Dir(fdb.DbFileName()))
+
+	for _, fst := range []types.FileStat{
+		{FTypeStat: types.FTypeStat{Path: "/b/", FType: "dir"}, Device: 1, Inode: 1},
+		{FTypeStat: types.FTypeStat{Path: "/b/1/", FType: "dir"}, Device: 1, Inode: 2},
+		{FTypeStat: types.FTypeStat{Path: "/b/1/v.mkv", FType: "video", NumBytes: 1000}, Device: 1, Inode: 10, Nlink: 3},
+		{FTypeStat: types.FTypeStat{Path: "/b/1/i.jpg", FType: "image", NumBytes: 50}, Device: 1, Inode: 11, Nlink: 1},
+		{FTypeStat: types.FTypeStat{Path: "/b/2/", FType: "dir"}, Device: 1, Inode: 3},
+		{FTypeStat: types.FTypeStat{Path: "/b/2/v.mkv", FType: "video", NumBytes: 1000}, Device: 1, Inode: 10, Nlink: 3},
+		{FTypeStat: types.FTypeStat{Path: "/b/2/i.jpg", FType: "image", NumBytes: 50}, Device: 1, Inode: 12, Nlink: 1},
+		{FTypeStat: types.FTypeStat{Path: "/b/2/other.mkv", FType: "video", NumBytes: 1000}, Device: 2, Inode: 10, Nlink: 1}, // other device
+		{FTypeStat: types.FTypeStat{Path: "/b/3/", FType: "dir"}, Device: 1, Inode: 4},
+		{FTypeStat: types.FTypeStat{Path: "/b/3/v.mkv", FType: "video", NumBytes: 1000}, Device: 1, Inode: 10, Nlink: 3},
+		{FTypeStat: types.FTypeStat{Path: "/b/3/noinode", FType: "other", NumBytes: 7}},
+	} {
+		fst := fst
+		if fst.FType != "dir" {
+			fst.FileCount = 1
+		}
+		if err := fdb.UpdateFileStat(&fst); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	type sums map[string][3]uint64 // count, apparent, unique bytes
+	get := func(paths []string, opts types.SumOptions) sums {
+		t.Helper()
+		fts, err := fdb.FTStatsSumWith(paths, opts)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		s := make(sums)
+		for k, ft := range fts {
+			s[k] = [3]uint64{uint64(ft.FileCount), ft.NumBytes, ft.UniqueBytes}
+		}
+		return s
+	}
+
+	tests := []struct {
+		paths []string
+		opts  types.SumOptions
+		want  sums
+	}{
+		{[]string{"/b/*"}, types.SumOptions{Unique: true}, sums{
+			"dir":   {4, 0, 0},
+			"video": {4, 4000, 2000},
+			"image": {2, 100, 100},
+			"other": {1, 7, 7},
+			"total": {11, 4107, 2107},
+		}},
+		// every path is counted once, even if matched by overlapping paths
+		{[]string{"/b/1/*", "/b/2/*", "/b/*/v.mkv"}, types.SumOptions{Unique: true}, sums{
+			"dir":   {2, 0, 0},
+			"video": {4, 4000, 2000},
+			"image": {2, 100, 100},
+			"total": {8, 4100, 2100},
+		}},
+		{[]string{"/b/*"}, types.SumOptions{Unique: true, GroupBy: types.GroupByExt}, sums{
+			"mkv":   {4, 4000, 2000},
+			"jpg":   {2, 100, 100},
+			"":      {1, 7, 7},
+			"total": {7, 4107, 2107},
+		}},
+		// without Unique there are no unique bytes
+		{[]string{"/b/*"}, types.SumOptions{}, sums{
+			"dir":   {4, 0, 0},
+			"video": {4, 4000, 0},
+			"image": {2, 100, 0},
+			"other": {1, 7, 0},
+			"total": {11, 4107, 0},
+		}},
+		{[]string{"/nothing/*"}, types.SumOptions{Unique: true}, sums{}},
+	}
+	for _, tt := range tests {
+		if got := get(tt.paths, tt.opts); !cmp.Equal(got, tt.want) {
+			t.Errorf("FTStatsSumWith(%v, %+v): %s", tt.paths, tt.opts, cmp.Diff(tt.want, got))
+		}
+	}
+
+	for _, paths := range [][]string{{"/b/1/*"}, {"/b/1/*", "/b/2/"}} {
+		fts, err := fdb.FTStatsSumWith(paths, types.SumOptions{Unique: true})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		want, err := fdb.FTStatsSum(paths)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for k, ft := range fts {
+			if w, ok := want[k]; !ok || ft.Path != w.Path {
+				t.Errorf("FTStatsSumWith(%v)[%s].Path = %q, want that of FTStatsSum %+v", paths, k, ft.Path, w)
+			}
+		}
+	}
+}
+
+func TestFileTypeStatsDB_Allocated(t *testing.T) {
+
+	fdb := tmpDB(t)
+	defer os.RemoveAll(path.Dir(fdb.DbFileName()))
+
+	mtime := time.Now()
+	for _, fst := range []types.FileStat{
+		{FTypeStat: types.FTypeStat{Path: "/vm/", FType: "dir"}, ModTime: mtime},
+		{FTypeStat: types.FTypeStat{Path: "/vm/disk.img", FType: "other", NumBytes: 100 << 30, AllocBytes: 3 << 30}, ModTime: mtime, Device: 1, Inode: 10, Nlink: 2},
+		{FTypeStat: types.FTypeStat{Path: "/vm/disk.link", FType: "other", NumBytes: 100 << 30, AllocBytes: 3 << 30}, ModTime: mtime, Device: 1, Inode: 10, Nlink: 2},
+		{FTypeStat: types.FTypeStat{Path: "/vm/small.jpg", FType: "image", NumBytes: 100, AllocBytes: 4096}, ModTime: mtime, Device: 1, Inode: 11, Nlink: 1},
+		{FTypeStat: types.FTypeStat{Path: "/vm/unknown.jpg", FType: "image", NumBytes: 1000}}, // no metadata: counts as apparent
+	} {
+		fst := fst
+		if fst.FType != "dir" {
+			fst.FileCount = 1
+		}
+		if err := fdb.UpdateFileStat(&fst); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	type sums map[string][2]uint64 // apparent, allocated bytes
+	get := func(paths []string, opts types.SumOptions) sums {
+		t.Helper()
+		fts, err := fdb.FTStatsSumWith(paths, opts)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		s := make(sums)
+		for k, ft := range fts {
+			s[k] = [2]uint64{ft.NumBytes, ft.AllocBytes}
+		}
+		return s
+	}
+
+	tests := []struct {
+		paths []string
+		opts  types.SumOptions
+		want  sums
+	}{
+		{[]string{"/vm/*"}, types.SumOptions{Allocated: true}, sums{
+			"dir":   {0, 0},
+			"other": {200 << 30, 6 << 30},
+			"image": {1100, 5096},
+			"total": {200<<30 + 1100, 6<<30 + 5096},
+		}},
+		{[]string{"/vm/*"}, types.SumOptions{Allocated: true, Unique: true}, sums{
+			"dir":   {0, 0},
+			"other": {200 << 30, 3 << 30},
+			"image": {1100, 5096},
+			"total": {200<<30 + 1100, 3<<30 + 5096},
+		}},
+		{[]string{"/vm/*"}, types.SumOptions{Allocated: true, GroupBy: types.GroupByExt}, sums{
+			"img":   {100 << 30, 3 << 30},
+			"link":  {100 << 30, 3 << 30},
+			"jpg":   {1100, 5096},
+			"total": {200<<30 + 1100, 6<<30 + 5096},
+		}},
+		// the apparent size is the default
+		{[]string{"/vm/*"}, types.SumOptions{}, sums{
+			"dir":   {0, 0},
+			"other": {200 << 30, 0},
+			"image": {1100, 0},
+			"total": {200<<30 + 1100, 0},
+		}},
+	}
+	for _, tt := range tests {
+		if got := get(tt.paths, tt.opts); !cmp.Equal(got, tt.want) {
+			t.Errorf("FTStatsSumWith(%v, %+v): %s", tt.paths, tt.opts, cmp.Diff(tt.want, got))
+		}
+	}
+
+	if fst, err := fdb.GetFileStat("/vm/unknown.jpg"); err != nil || fst == nil || fst.AllocBytes != 1000 {
+		t.Errorf("GetFileStat() of a file without allocated size = %+v, %v; want AllocBytes 1000", fst, err)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+
+	fdb := tmpDB(t)
+	defer os.RemoveAll(path.Dir(fdb.DbFileName()))
+
+	strs := []string{"", "/", "a", "/a/b", "/a/b/", "/a/bc", "/a/[b]", "/a/*", "/a/?", "/ä/ö", "x-y", "]", "^", "-"}
+	patterns := []string{"", "*", "**", "?", "/a/*", "/a/?", "/a/??", "/?/?", "/a/[b]", "/a/[[]b]", "/a/[*]", "/a/[?]",
+		"/a/[a-c]*", "/a/[^b]*", "/a/[^]", "[]]", "[^]]", "[-]", "[x-]", "x[-]y", "/a/[", "/ä/*", "/[ä]/?", "*/", "*b*", "/a/b/*"}
+	for _, p := range patterns {
+		for _, s := range strs {
+			var want bool
+			if err := fdb.DB.QueryRow(`SELECT ? GLOB ?`, s, p).Scan(&want); err != nil {
+				t.Fatal(err.Error())
+			}
+			if got := utils.GlobMatch(p, s); got != want {
+				t.Errorf("GlobMatch(%q, %q) = %v, sqlite GLOB = %v", p, s, got, want)
+			}
+		}
+	}
+}
+
+// TestFileTypeStatsDB_ArchiveMembers checks that the archive members are only counted by the paths inside their archive
+func TestFileTypeStatsDB_ArchiveMembers(t *testing.T) {
+
+	fdb := tmpDB(t)
+	defer os.RemoveAll(path.Dir(fdb.DbFileName()))
+
+	for _, fst := range []types.FileStat{
+		{FTypeStat: types.FTypeStat{Path: "/a/", FType: "dir"}},
+		{FTypeStat: types.FTypeStat{Path: "/a/t.txt", FType: "other", NumBytes: 5}},
+		{FTypeStat: types.FTypeStat{Path: "/a/wow!/", FType: "dir"}}, // not an archive, just a name ending in the separator
+		{FTypeStat: types.FTypeStat{Path: "/a/wow!/v.mp4", FType: "video", NumBytes: 7}},
+		{FTypeStat: types.FTypeStat{Path: "/a/y.zip", FType: "archive", NumBytes: 10}}, // not expanded
+		{FTypeStat: types.FTypeStat{Path: "/a/x.zip", FType: "archive", NumBytes: 100}},
+		{FTypeStat: types.FTypeStat{Path: "/a/x.zip!/", FType: "dir"}, Archive: "/a/x.zip"},
+		{FTypeStat: types.FTypeStat{Path: "/a/x.zip!/d/", FType: "dir"}, Archive: "/a/x.zip"},
+		{FTypeStat: types.FTypeStat{Path: "/a/x.zip!/d/p.jpg", FType: "image", NumBytes: 40}, Archive: "/a/x.zip"},
+		{FTypeStat: types.FTypeStat{Path: "/a/x.zip!/in.tar", FType: "archive", NumBytes: 60}, Archive: "/a/x.zip"},
+		{FTypeStat: types.FTypeStat{Path: "/a/x.zip!/in.tar!/", FType: "dir"}, Archive: "/a/x.zip!/in.tar"},
+		{FTypeStat: types.FTypeStat{Path: "/a/x.zip!/in.tar!/s.mp3", FType: "audio", NumBytes: 30}, Archive: "/a/x.zip!/in.tar"},
+	} {
+		fst := fst
+		if fst.FType != "dir" {
+			fst.FileCount = 1
+		}
+		if err := fdb.UpdateFileStat(&fst); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	type sums map[string][2]uint64 // count, bytes
+	get := func(paths []string, opts types.SumOptions) sums {
+		t.Helper()
+		fts, err := fdb.FTStatsSumWith(paths, opts)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		s := make(sums)
+		for k, ft := range fts {
+			s[k] = [2]uint64{uint64(ft.FileCount), ft.NumBytes}
+		}
+		return s
+	}
+
+	onDisk := sums{"dir": {2, 0}, "archive": {2, 110}, "other": {1, 5}, "video": {1, 7}, "total": {6, 122}}
+	inZip := sums{"dir": {2, 0}, "image": {1, 40}, "archive": {1, 60}, "total": {4, 100}}
+	inWow := sums{"dir": {1, 0}, "video": {1, 7}, "total": {2, 7}}
+	check := func(dir string) {
+		t.Helper()
+		tests := []struct {
+			paths []string
+			opts  types.SumOptions
+			want  sums
+		}{
+			{[]string{dir + "*"}, types.SumOptions{}, onDisk}, // from dirstats
+			{[]string{dir + "*", dir + "t.txt"}, types.SumOptions{}, onDisk},
+			{[]string{dir + "*"}, types.SumOptions{Unique: true}, onDisk},
+			{[]string{dir + "*.zip*"}, types.SumOptions{}, sums{"archive": {2, 110}, "total": {2, 110}}},
+			{[]string{dir + "x.zip!/*"}, types.SumOptions{}, inZip},
+			{[]string{dir + "x.zip!/*"}, types.SumOptions{Unique: true}, inZip},
+			{[]string{dir + "x.zip!/"}, types.SumOptions{}, sums{"dir": {1, 0}, "archive": {1, 60}, "total": {2, 60}}},
+			{[]string{dir + "wow!/*"}, types.SumOptions{}, inWow},
+			{[]string{dir + "wow!/"}, types.SumOptions{Unique: true}, inWow},
+			// the expanded archives are replaced by their members
+			{[]string{dir + "*"}, types.SumOptions{ArchiveMembers: true}, sums{
+				"dir": {5, 0}, "image": {1, 40}, "audio": {1, 30}, "archive": {1, 10}, "other": {1, 5}, "video": {1, 7}, "total": {10, 92}}},
+			{[]string{dir + "x.zip!/*"}, types.SumOptions{ArchiveMembers: true, Unique: true}, sums{
+				"dir": {3, 0}, "image": {1, 40}, "audio": {1, 30}, "total": {5, 70}}},
+		}
+		for _, tt := range tests {
+			if got := get(tt.paths, tt.opts); !cmp.Equal(got, tt.want) {
+				t.Errorf("FTStatsSumWith(%v, %+v): %s", tt.paths, tt.opts, cmp.Diff(tt.want, got))
+			}
+		}
+		top, err := fdb.TopDirs([]string{dir + "*"}, 0, "", 0)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		var topDirs []string
+		for _, ft := range top {
+			topDirs = append(topDirs, ft.Path)
+		}
+		if want := []string{dir, dir + "wow!/"}; !cmp.Equal(topDirs, want) {
+			t.Errorf("TopDirs(%s*) = %v, want %v", dir, topDirs, want)
+		}
+	}
+	check("/a/")
+
+	// the members move with the tree they are in
+	if err := fdb.UpdateFilePath("/a/", "/b/"); err != nil {
+		t.Fatal(err.Error())
+	}
+	check("/b/")
+	if fst, err := fdb.GetFileStat("/b/x.zip!/in.tar!/s.mp3"); err != nil || fst == nil || fst.Archive != "/b/x.zip!/in.tar" {
+		t.Errorf("GetFileStat() of a moved member = %+v, %v; want archive /b/x.zip!/in.tar", fst, err)
+	}
+
+	// deleting the members, like the watcher does for a changed archive, makes the archive count again
+	if _, n, err := fdb.DeleteFileStatsTree("/b/x.zip!"); err != nil || n != 6 {
+		t.Fatalf("DeleteFileStatsTree(/b/x.zip!) = %d, %v", n, err)
+	}
+	if got := get([]string{"/b/*"}, types.SumOptions{ArchiveMembers: true}); !cmp.Equal(got, onDisk) {
+		t.Errorf("after deleting the members: %s", cmp.Diff(onDisk, got))
+	}
+}
+
+func TestFileTypeStatsDB_MemStore(t *testing.T) {
+
+	fdb := tmpDB(t)
+	defer os.RemoveAll(path.Dir(fdb.DbFileName()))
+	mem := store.NewMemStore()
+	stores := []store.Store{fdb, mem}
+
+	mtime := time.Date(2023, 1, 2, 3, 4, 5, 6, time.UTC)
+	batch := func(s store.Store, fsts ...types.FileStat) error {
+		b := types.NewFTypeStatsBatch(3) // commits in between
+		for i := range fsts {
+			if err := s.UpdateFileStatMulti(&fsts[i], b); err != nil {
+				return err
+			}
+		}
+		return s.CommitBatch(b)
+	}
+	file := func(p, cat string, size uint64, ino uint64) types.FileStat {
+		return types.FileStat{FTypeStat: types.FTypeStat{Path: p, FType: cat, NumBytes: size, FileCount: 1, AllocBytes: size / 2},
+			ModTime: mtime, Device: 1, Inode: ino, Nlink: 1, MIME: "mime/" + cat}
+	}
+	dir := func(p string) types.FileStat {
+		return types.FileStat{FTypeStat: types.FTypeStat{Path: p, FType: "dir"}, ModTime: mtime, Inode: 1000 + uint64(len(p))}
+	}
+	member := func(fst types.FileStat, archive string) types.FileStat {
+		fst.Archive = archive
+		return fst
+	}
+	linked := file("/r/b/link.mkv", "video", 5000, 42)
+	linked.Nlink = 2
+	linked2 := linked
+	linked2.Path = "/r/a/link.mkv"
+
+	ops := []struct {
+		name string
+		op   func(s store.Store) error
+	}{
+		{"batch", func(s store.Store) error {
+			return batch(s, dir("/r/"), dir("/r/a/"), dir("/r/b/"), dir("/r/a/c/"), dir("/r/x[1]/"),
+				file("/r/a/1.jpg", "image", 10, 1), file("/r/a/2.JPG", "image", 20, 2), file("/r/a/c/3.mkv", "video", 300, 3),
+				file("/r/b/4.pdf", "document", 40, 4), file("/r/b/5", "other", 5, 5), file("/r/x[1]/6.mp3", "audio", 60, 6),
+				file("/r/7.zip", "archive", 70, 7), file("/ra/8.jpg", "image", 80, 8), linked, linked2,
+				dir("/r/wow!/"), file("/r/wow!/w.jpg", "image", 12, 12)) // not an archive
+		}},
+		{"members", func(s store.Store) error { // of the expanded /r/7.zip, with a nested archive, and of /r/a/c/9.zip
+			return batch(s, member(dir("/r/7.zip!/"), "/r/7.zip"), member(dir("/r/7.zip!/d/"), "/r/7.zip"),
+				member(file("/r/7.zip!/m.jpg", "image", 11, 0), "/r/7.zip"), member(file("/r/7.zip!/d/in.tar", "archive", 50, 0), "/r/7.zip"),
+				member(dir("/r/7.zip!/d/in.tar!/"), "/r/7.zip!/d/in.tar"), member(file("/r/7.zip!/d/in.tar!/x.mp3", "audio", 33, 0), "/r/7.zip!/d/in.tar"),
+				file("/r/a/c/9.zip", "archive", 90, 9), member(dir("/r/a/c/9.zip!/"), "/r/a/c/9.zip"),
+				member(file("/r/a/c/9.zip!/n.mkv", "video", 13, 0), "/r/a/c/9.zip"))
+		}},
+		{"update", func(s store.Store) error { fst := file("/r/b/4.pdf", "document", 44, 4); return s.UpdateFileStat(&fst) }},
+		{"legacy", func(s store.Store) error {
+			return s.UpdateFileStat(&types.FileStat{FTypeStat: types.FTypeStat{Path: "/r/b/9", FType: "other", NumBytes: 9}})
+		}},
+		{"move file", func(s store.Store) error { return s.UpdateFilePath("/r/a/2.JPG", "/r/b/2.jpg") }},
+		{"move dir", func(s store.Store) error { return s.UpdateFilePath("/r/a/c/", "/r/b/c") }},
+		{"move dir over dir", func(s store.Store) error {
+			if err := batch(s, dir("/r/t/"), file("/r/t/old.jpg", "image", 1, 99)); err != nil {
+				return err
+			}
+			return s.UpdateFilePath("/r/b/c/", "/r/t")
+		}},
+		{"move members", func(s store.Store) error { return s.UpdateFilePath("/r/7.zip!/", "/r/z.zip!/") }},
+		{"delete file", func(s store.Store) error { _, _, err := s.DeleteFileStatsTree("/r/b/5"); return err }},
+		{"delete dir", func(s store.Store) error { _, _, err := s.DeleteFileStatsTree("/r/x[1]"); return err }},
+		{"purge", func(s store.Store) error {
+			_, err := s.PurgeExcluded("/r", func(p string, isDir bool, size uint64) bool { return strings.HasSuffix(p, ".zip") })
+			return err
+		}},
+		{"delete older", func(s store.Store) error { return s.DeleteOlderThanWithPrefix(time.Now().Add(time.Hour), "/ra") }},
+	}
+	patterns := [][]string{{"/r/*"}, {"/r/"}, {"/r/a/"}, {"/r/b/*"}, {"/r/*/"}, {"/r/?/*"}, {"/r/a/1.jpg"}, {"/r/b/*.jpg"}, {"/r*"},
+		{"/r/a/*", "/r/b/"}, {"/r/*", "/r/a/*"}, {"/nothing/*"}, {"/r/x[[]1]/*"}, {"/*"},
+		{"/r/7.zip!/*"}, {"/r/7.zip!/"}, {"/r/7.zip!/d/in.tar!/*"}, {"/r/7.zip*"}, {"/r/*", "/r/7.zip!/d/*"},
+		{"/r/wow!/*"}, {"/r/*.zip!/*"}, {"/r/z.zip!/*"}, {"/r/t/*"}, {"/r/t/9.zip!/"}}
+	options := []types.SumOptions{{}, {GroupBy: types.GroupByExt}, {GroupBy: types.GroupByMIME}, {Unique: true}, {Allocated: true},
+		{Unique: true, Allocated: true, GroupBy: types.GroupByExt}, {ArchiveMembers: true}, {ArchiveMembers: true, Unique: true, Allocated: true}}
+
+	for _, o := range ops {
+		for _, s := range stores {
+			if err := o.op(s); err != nil {
+				t.Fatalf("%s on %T: %s", o.name, s, err.Error())
+			}
+		}
+		for _, paths := range patterns {
+			want, err := fdb.FTStatsSum(paths)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if got, err := mem.FTStatsSum(paths); err != nil || !cmp.Equal(got, want) {
+				t.Errorf("after %s: MemStore.FTStatsSum(%v) = %v: %s", o.name, paths, err, cmp.Diff(want, got))
+			}
+			for _, opts := range options {
+				want, err := fdb.FTStatsSumWith(paths, opts)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if got, err := mem.FTStatsSumWith(paths, opts); err != nil || !cmp.Equal(got, want) {
+					t.Errorf("after %s: MemStore.FTStatsSumWith(%v, %+v) = %v: %s", o.name, paths, opts, err, cmp.Diff(want, got))
+				}
+			}
+			wantDump, err := fdb.FTDumpFileStats(paths)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			sort.Slice(wantDump, func(i, j int) bool { return wantDump[i].Path < wantDump[j].Path })
+			if got, err := mem.FTDumpFileStats(paths); err != nil || !cmp.Equal(got, wantDump) {
+				t.Errorf("after %s: MemStore.FTDumpFileStats(%v) = %v: %s", o.name, paths, err, cmp.Diff(wantDump, got))
+			}
+		}
+	}
+	if err := mem.UpdateFileStat(&types.FileStat{FTypeStat: types.FTypeStat{Path: "/r/bad", FType: "nocategory"}}); err == nil {
+		t.Errorf("MemStore.UpdateFileStat() with an unknown category succeeded")
+	}
+}
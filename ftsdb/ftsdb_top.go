@@ -0,0 +1,125 @@
+package ftsdb
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Rainc1oud/filetypestats/types"
+	"github.com/Rainc1oud/filetypestats/utils"
+)
+
+// TopFiles returns the n largest files (largest first) selected by paths (see FTStatsSum) and filter, n <= 0 returns all
+// Dirs are never returned, every FTypeStat has FileCount 1
+func (f *FileTypeStatsDB) TopFiles(paths []string, n int, filter types.FileFilter) ([]types.FTypeStat, error) {
+	cond := []string{"fileinfo.catid=cats.id", "cats.filecat<>'dir'"}
+	var filterArgs []interface{}
+	if len(filter.Categories) > 0 {
+		cond = append(cond, "cats.filecat IN (?"+strings.Repeat(", ?", len(filter.Categories)-1)+")")
+		for _, c := range filter.Categories {
+			filterArgs = append(filterArgs, c)
+		}
+	}
+	if filter.MinSize > 0 {
+		cond = append(cond, "fileinfo.size>=?")
+		filterArgs = append(filterArgs, filter.MinSize)
+	}
+	if filter.MaxSize > 0 {
+		cond = append(cond, "fileinfo.size<=?")
+		filterArgs = append(filterArgs, filter.MaxSize)
+	}
+	chunkSize := (maxWhereCond - len(filterArgs)) / pathArgs
+	fts := make([]types.FTypeStat, 0)
+	seen := newSeenPaths(paths, chunkSize)
+	err := f.pathsQuery(
+		`SELECT fileinfo.path, cats.filecat, fileinfo.size FROM fileinfo, cats WHERE `+strings.Join(cond, " AND ")+` AND (%s) ORDER BY 3 DESC, 1 LIMIT ?`,
+		filterArgs, []interface{}{limit(n)}, paths, chunkSize, f.pathsWherePredicate, func(rs *sql.Rows) error {
+			ft := types.FTypeStat{FileCount: 1}
+			if err := rs.Scan(&ft.Path, &ft.FType, &ft.NumBytes); err != nil {
+				return err
+			}
+			if seen.add(ft.Path) {
+				fts = append(fts, ft)
+			}
+			return nil
+		})
+	return topN(fts, n), err
+}
+
+// TopDirs returns the n dirs (largest first) selected by paths (see FTStatsSum) with the most bytes of category in their subtree,
+// category "" or "total" ranks by the bytes of all categories, n <= 0 returns all
+// depth > 0 limits the dirs to at most depth levels below the dir part of each path, e.g. for "/share/*" depth 1 returns /share/ and its direct subdirs
+// The totals are taken from dirstats, so the dirs above the scanned trees are included when paths selects them,
+// the dirs in archives only with paths inside their archive, like the members in FTStatsSum (see types.FileStat.Archive)
+func (f *FileTypeStatsDB) TopDirs(paths []string, n int, category string, depth int) ([]types.FTypeStat, error) {
+	catCond, catArgs := "", []interface{}(nil)
+	if category == "" {
+		category = "total"
+	}
+	if category != "total" {
+		catCond, catArgs = "cats.filecat=? AND ", []interface{}{category}
+	}
+	pred := func(paths []string) (string, []interface{}) {
+		if depth <= 0 {
+			return pathsColWherePredicate("dirstats.dir", "fileinfo.archive", paths)
+		}
+		var (
+			preds []string
+			args  []interface{}
+		)
+		for _, p := range utils.OptimizePathsGlob(&paths) {
+			wp, pargs := pathsColWherePredicate("dirstats.dir", "fileinfo.archive", []string{p})
+			base := p[:strings.LastIndex(p, "/")+1]
+			preds = append(preds, fmt.Sprintf("(%s AND %s<=?)", wp, qrySlashes("dirstats.dir")))
+			args = append(append(args, pargs...), strings.Count(base, "/")+depth)
+		}
+		return strings.Join(preds, " OR "), args
+	}
+	// each path has one more arg with the depth limit
+	chunkSize := (maxWhereCond - 1) / (pathArgs + 1)
+	fts := make([]types.FTypeStat, 0)
+	seen := newSeenPaths(paths, chunkSize)
+	err := f.pathsQuery(
+		`SELECT dirstats.dir, SUM(dirstats.rcount), SUM(dirstats.rbytes)
+			FROM dirstats JOIN cats ON dirstats.catid=cats.id LEFT JOIN fileinfo ON fileinfo.path=dirstats.dir
+			WHERE `+catCond+`(%s) GROUP BY dirstats.dir ORDER BY 3 DESC, 1 LIMIT ?`,
+		catArgs, []interface{}{limit(n)}, paths, chunkSize, pred, func(rs *sql.Rows) error {
+			ft := types.FTypeStat{FType: category}
+			if err := rs.Scan(&ft.Path, &ft.FileCount, &ft.NumBytes); err != nil {
+				return err
+			}
+			if seen.add(ft.Path) {
+				fts = append(fts, ft)
+			}
+			return nil
+		})
+	return topN(fts, n), err
+}
+
+// topN returns the n largest of fts (largest first, then by path) merged from the top n of every chunk, n <= 0 returns all
+func topN(fts []types.FTypeStat, n int) []types.FTypeStat {
+	sort.SliceStable(fts, func(i, j int) bool {
+		if fts[i].NumBytes != fts[j].NumBytes {
+			return fts[i].NumBytes > fts[j].NumBytes
+		}
+		return fts[i].Path < fts[j].Path
+	})
+	if n > 0 && len(fts) > n {
+		fts = fts[:n]
+	}
+	return fts
+}
+
+// qrySlashes returns the SQL expression for the number of separators in the path column col
+func qrySlashes(col string) string {
+	return fmt.Sprintf("(length(%[1]s)-length(replace(%[1]s, '/', '')))", col)
+}
+
+// limit returns the LIMIT arg for n results, sqlite takes a negative LIMIT as no limit
+func limit(n int) int {
+	if n <= 0 {
+		return -1
+	}
+	return n
+}
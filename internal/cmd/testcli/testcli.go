@@ -1,10 +1,15 @@
 package main
 
 import (
+	"archive/zip"
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"time"
 
@@ -12,6 +17,7 @@ import (
 	"github.com/Rainc1oud/filetypestats/ftsdb"
 	"github.com/Rainc1oud/filetypestats/treestatsquery"
 	"github.com/Rainc1oud/filetypestats/types"
+	ftsutils "github.com/Rainc1oud/filetypestats/utils"
 	utils "github.com/Rainc1oud/gogenutils"
 )
 
@@ -24,6 +30,14 @@ func main() {
 	dbfile := flag.String("db", "scandb.sqlite", "database in which the scan result is stored")
 
 	rm := flag.Bool("rm", false, "remove database if exists")
+	n := flag.Int("n", 20, "number of results for top and topdirs")
+	cat := flag.String("cat", "", "only files of these categories for top (comma-separated), rank dirs by this category for topdirs")
+	minsize := flag.Uint64("minsize", 0, "only files of at least minsize bytes for top")
+	groupby := flag.String("groupby", "class", "group the summary by class, ext or mime")
+	unique := flag.Bool("unique", false, "also show the bytes counting hardlinked files once for summary")
+	alloc := flag.Bool("alloc", false, "also show the allocated (on-disk) bytes for summary")
+	members := flag.Bool("members", false, "count the members of expanded archives instead of the archives for summary")
+	depth := flag.Int("depth", 0, "only dirs at most depth levels below the given dirs for topdirs (0: no limit), and for walk (0: none)")
 	flag.Parse()
 
 	if len(flag.Args()) == 0 {
@@ -41,9 +55,29 @@ func main() {
 	case "show":
 		show(scandirs, *dbfile)
 	case "summary":
-		summary(scandirs, *dbfile)
+		summary(scandirs, *dbfile, *groupby, *unique, *alloc, *members)
 	case "dump":
 		dump(scandirs, *dbfile)
+	case "top":
+		var cats []string
+		if *cat != "" {
+			cats = strings.Split(*cat, ",")
+		}
+		top(scandirs, *dbfile, *n, types.FileFilter{Categories: cats, MinSize: *minsize})
+	case "topdirs":
+		topdirs(scandirs, *dbfile, *n, *cat, *depth)
+	case "hist":
+		hist(scandirs, *dbfile)
+	case "snapshot":
+		snapshot(scandirs, *dbfile)
+	case "history":
+		history(scandirs, *dbfile)
+	case "walk":
+		walk(scandirs, *depth)
+	case "scanzip":
+		scanzip(scandirs, *dbfile)
+	case "dups":
+		dups(scandirs, *dbfile, *n)
 	case "watch":
 		watch(scandirs, *dbfile)
 	default:
@@ -53,12 +87,20 @@ func main() {
 
 func usage() {
 	fmt.Printf(
-		"Usage: %s [ --dirs=dir1,dir2 ] [ --db=scandb.sqlite ] [ scan | show | summary | dump ]\n"+
+		"Usage: %s [ --dirs=dir1,dir2 ] [ --db=scandb.sqlite ] [ scan | show | summary | dump | top | topdirs | hist | snapshot | history | dups | walk | scanzip ]\n"+
 			"\tscan: scans all dirs given recursively and stores statistics per dir in scandb\n"+
 			"\tshow: gets the totals from scandb for the given dirs.\n"+
 			"\t\tTo show totals under a dir, use the special form --dir='/dir/to/*' (remember quoting if necessary)\n"+
-			"\tsummary: show sum totals for all selected dirs\n"+
+			"\tsummary: show sum totals for all selected dirs (by --groupby)\n"+
 			"\tdump: dump the paths and info for the selected dirs\n"+
+			"\ttop: show the largest files in the selected dirs\n"+
+			"\ttopdirs: show the dirs with the most bytes (of --cat) in the selected dirs\n"+
+			"\thist: show the size histogram per type for the selected dirs\n"+
+			"\tsnapshot: record a snapshot of the totals of the selected dirs\n"+
+			"\thistory: show the snapshots of the selected dirs and the growth since the first one\n"+
+			"\twalk: scans all dirs given without database and shows the totals, and those of the dirs down to --depth\n"+
+			"\tscanzip: scans the zip files given as dirs into scandb as \"file.zip!/inner/path\" and shows their totals\n"+
+			"\tdups: hash the duplicate candidates in the selected dirs and show the --n largest duplicate groups\n"+
 			"\twatch: watch selected dirs for modification (blocking)\n\nFlags:\n", os.Args[0])
 	flag.PrintDefaults()
 	os.Exit(0)
@@ -72,12 +114,60 @@ func exiterr(err error) {
 func scan(dirs []string, file string) {
 	fmt.Printf("Scanning %v to database %s...\n", dirs, file)
 	ts := time.Now()
-	if _, err := filetypestats.WalkFileTypeStatsDB(dirs, file); err != nil {
+	if fstats, err := filetypestats.WalkFileTypeStatsDB(dirs, file); err != nil {
 		exiterr(err)
 	} else {
 		fmt.Printf("Scanning took %s\n\n", time.Since(ts))
 		fmt.Println("Scan totals:")
-		// printstats(fstats)
+		printstats(fstats)
+	}
+}
+
+func walk(dirs []string, depth int) {
+	fmt.Printf("Scanning %v without database...\n", dirs)
+	ts := time.Now()
+	stats, err := filetypestats.WalkStats(context.Background(), dirs, filetypestats.WalkOptions{
+		ScanOptions: filetypestats.ScanOptions{Workers: runtime.NumCPU()},
+		PerDir:      depth > 0,
+		DirDepth:    depth,
+	})
+	if err != nil {
+		exiterr(err)
+	}
+	fmt.Printf("Scanning took %s\n\n", time.Since(ts))
+	dirnames := make([]string, 0, len(stats.Dirs))
+	for d := range stats.Dirs {
+		dirnames = append(dirnames, d)
+	}
+	sort.Strings(dirnames)
+	for _, d := range dirnames {
+		fmt.Printf("%s:\n", d)
+		printstats(stats.Dirs[d])
+		fmt.Println()
+	}
+	fmt.Println("Scan totals:")
+	printstats(stats.Total)
+}
+
+func scanzip(zips []string, file string) {
+	fdb := getDB(file)
+	for _, z := range zips {
+		zr, err := zip.OpenReader(z)
+		if err != nil {
+			exiterr(err)
+		}
+		err = filetypestats.ScanFS(context.Background(), fdb, zr, z, filetypestats.ScanOptions{Workers: runtime.NumCPU()})
+		zr.Close()
+		if err != nil {
+			exiterr(err)
+		}
+		fstats, err := fdb.FTStatsSum([]string{ftsutils.GlobEscape(filepath.Clean(z)) + filetypestats.FSPathSep + "/*"})
+		if err != nil {
+			exiterr(err)
+		}
+		fmt.Printf("%s:\n", z)
+		printstats(fstats)
+		fmt.Println()
 	}
 }
 
@@ -103,15 +193,31 @@ func show(dirs []string, file string) {
 	}
 }
 
-func summary(dirs []string, file string) {
+func summary(dirs []string, file string, groupby string, unique, alloc, members bool) {
+	groupBy, ok := map[string]types.GroupBy{"class": types.GroupByClass, "ext": types.GroupByExt, "mime": types.GroupByMIME}[groupby]
+	if !ok {
+		usage()
+	}
 	ts := time.Now()
-	fstats, err := treestatsquery.FTStatsSum(file, dirs)
+	fstats, err := treestatsquery.FTStatsSumWith(file, dirs, types.SumOptions{GroupBy: groupBy, Unique: unique, Allocated: alloc, ArchiveMembers: members})
 	if err != nil {
 		exiterr(err)
 	}
 	fmt.Printf("Query took %s\n\n", time.Since(ts))
 	fmt.Println("Query totals:")
 	printstats(fstats)
+	if unique {
+		fmt.Println("\nUnique bytes (hardlinks counted once):")
+		for _, catstat := range fstats {
+			fmt.Printf("%10s: \t%8s\n", catstat.FType, utils.ByteCountSI(catstat.UniqueBytes))
+		}
+	}
+	if alloc {
+		fmt.Println("\nAllocated bytes:")
+		for _, catstat := range fstats {
+			fmt.Printf("%10s: \t%8s\n", catstat.FType, utils.ByteCountSI(catstat.AllocBytes))
+		}
+	}
 }
 
 func dump(dirs []string, file string) {
@@ -133,6 +239,127 @@ func dump(dirs []string, file string) {
 	fmt.Printf("\n\nQuery took %s\n", te)
 }
 
+func top(dirs []string, file string, n int, filter types.FileFilter) {
+	ts := time.Now()
+	flist, err := treestatsquery.TopFiles(file, dirs, n, filter)
+	if err != nil {
+		exiterr(err)
+	}
+	te := time.Since(ts)
+	printflist(&flist)
+	fmt.Printf("\n\nQuery took %s\n", te)
+}
+
+func topdirs(dirs []string, file string, n int, category string, depth int) {
+	ts := time.Now()
+	dlist, err := treestatsquery.TopDirs(file, dirs, n, category, depth)
+	if err != nil {
+		exiterr(err)
+	}
+	te := time.Since(ts)
+	fmt.Printf("%60s\t%10s\t%10s\t%8s\n%80s\n", "Path", "Type", "Size", "Count", strings.Repeat("-", 75))
+	for _, d := range dlist {
+		fmt.Printf("%60s\t%10s\t%10s\t%8d\n", d.Path, d.FType, utils.ByteCountSI(d.NumBytes), d.FileCount)
+	}
+	fmt.Printf("\n\nQuery took %s\n", te)
+}
+
+func hist(dirs []string, file string) {
+	ts := time.Now()
+	h, err := treestatsquery.SizeHistogram(file, dirs, nil)
+	if err != nil {
+		exiterr(err)
+	}
+	te := time.Since(ts)
+	for _, t := range append(types.FClassNames(), "total") {
+		buckets, ok := h[t]
+		if !ok {
+			continue
+		}
+		fmt.Printf("%s:\n", t)
+		for _, b := range buckets {
+			if b.FileCount > 0 {
+				fmt.Printf("%10s - %-10s\t%8d files\t%10s\n", utils.ByteCountSI(b.Lower), utils.ByteCountSI(b.Upper), b.FileCount, utils.ByteCountSI(b.NumBytes))
+			}
+		}
+	}
+	fmt.Printf("\n\nQuery took %s\n", te)
+}
+
+func snapshot(dirs []string, file string) {
+	fdb, err := ftsdb.New(file, false)
+	if err != nil {
+		exiterr(err)
+	}
+	defer fdb.Close()
+	for _, d := range dirs {
+		snap, err := fdb.TakeSnapshot(d)
+		if err != nil {
+			exiterr(err)
+		}
+		fmt.Printf("%s: snapshot %d taken at %s\n\n", snap.Root, snap.ID, snap.Taken.Format(time.RFC3339))
+		printstats(snap.Stats)
+	}
+}
+
+func history(dirs []string, file string) {
+	for _, d := range dirs {
+		snaps, err := treestatsquery.Snapshots(file, d, time.Time{}, time.Time{})
+		if err != nil {
+			exiterr(err)
+		}
+		fmt.Printf("%s:\n", d)
+		for _, snap := range snaps {
+			var total types.FTypeStat
+			if t, ok := snap.Stats["total"]; ok {
+				total = *t
+			}
+			fmt.Printf("%25s\t%10s\t%8d files\n", snap.Taken.Format(time.RFC3339), utils.ByteCountSI(total.NumBytes), total.FileCount)
+		}
+		if len(snaps) > 1 {
+			delta, err := treestatsquery.SnapshotDelta(file, d, snaps[0].Taken, time.Now())
+			if err != nil {
+				exiterr(err)
+			}
+			fmt.Println("growth:")
+			for _, t := range append(types.FClassNames(), "total") {
+				if dt, ok := delta[t]; ok {
+					fmt.Printf("%10s: %+14d bytes\t%+8d files\n", t, dt.NumBytes, dt.FileCount)
+				}
+			}
+		}
+		fmt.Println()
+	}
+}
+
+func dups(dirs []string, file string, n int) {
+	fdb, err := ftsdb.New(file, false)
+	if err != nil {
+		exiterr(err)
+	}
+	defer fdb.Close()
+	ts := time.Now()
+	if err := filetypestats.Dedup(context.Background(), fdb, dirs); err != nil {
+		exiterr(err)
+	}
+	fmt.Printf("Hashing took %s\n\n", time.Since(ts))
+	groups, err := treestatsquery.DuplicatesDB(fdb, dirs)
+	if err != nil {
+		exiterr(err)
+	}
+	for i, g := range groups {
+		if i == n {
+			break
+		}
+		fmt.Printf("%s %s, %d copies of %s, wasted %s:\n", g.Hash[:12], g.FType, g.Copies, utils.ByteCountSI(g.Size), utils.ByteCountSI(g.Wasted()))
+		for _, p := range g.Paths {
+			fmt.Printf("\t%s\n", p)
+		}
+	}
+	fmt.Println("\nWasted:")
+	printstats(groups.WastedByType())
+}
+
 func watch(dirs []string, file string) {
 	var fts *filetypestats.TreeStatsWatcher
 	var err error
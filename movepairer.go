@@ -0,0 +1,106 @@
+package filetypestats
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultMoveTimeout is how long the first half of a move waits for its second half
+// inotify delivers both halves of a move within the watched tree back to back, so this only delays moves in and out of it
+const DefaultMoveTimeout = time.Second
+
+type tMoveInfo struct {
+	From string
+	To   string
+}
+
+type tPendingMove struct {
+	tMoveInfo
+	timer *time.Timer
+}
+
+// movePairer pairs the MovedFrom and MovedTo events of a move by their cookie
+// A half which isn't paired within the timeout is passed to onExpired: a lone From was moved out of the watched tree
+// (or to an unwatched place in it), a lone To was moved in from outside
+// onExpired is called from a timer goroutine
+type movePairer struct {
+	mu        sync.Mutex
+	timeout   time.Duration
+	pending   map[uint32]*tPendingMove
+	onExpired func(tMoveInfo)
+}
+
+func newMovePairer(timeout time.Duration, onExpired func(tMoveInfo)) *movePairer {
+	return &movePairer{
+		timeout:   timeout,
+		pending:   make(map[uint32]*tPendingMove),
+		onExpired: onExpired,
+	}
+}
+
+func (mp *movePairer) setTimeout(timeout time.Duration) {
+	mp.mu.Lock()
+	mp.timeout = timeout
+	mp.mu.Unlock()
+}
+
+// from adds the MovedFrom half, it returns the complete move and true if the To half was already there
+func (mp *movePairer) from(cookie uint32, path string) (tMoveInfo, bool) {
+	return mp.add(cookie, tMoveInfo{From: path})
+}
+
+// to adds the MovedTo half, it returns the complete move and true if the From half was already there
+func (mp *movePairer) to(cookie uint32, path string) (tMoveInfo, bool) {
+	return mp.add(cookie, tMoveInfo{To: path})
+}
+
+func (mp *movePairer) add(cookie uint32, half tMoveInfo) (tMoveInfo, bool) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if pm, ok := mp.pending[cookie]; ok {
+		if (half.From != "" && pm.From == "") || (half.To != "" && pm.To == "") {
+			pm.timer.Stop()
+			delete(mp.pending, cookie)
+			if half.From != "" {
+				return tMoveInfo{From: half.From, To: pm.To}, true
+			}
+			return tMoveInfo{From: pm.From, To: half.To}, true
+		}
+		// the same half twice means the cookie was reused, the old half won't be paired anymore
+		pm.timer.Stop()
+		delete(mp.pending, cookie)
+		go mp.onExpired(pm.tMoveInfo)
+	}
+	pm := &tPendingMove{tMoveInfo: half}
+	pm.timer = time.AfterFunc(mp.timeout, func() { mp.expire(cookie, pm) })
+	mp.pending[cookie] = pm
+	return tMoveInfo{}, false
+}
+
+func (mp *movePairer) expire(cookie uint32, pm *tPendingMove) {
+	mp.mu.Lock()
+	if mp.pending[cookie] != pm { // paired (or replaced) while the timer fired
+		mp.mu.Unlock()
+		return
+	}
+	delete(mp.pending, cookie)
+	mp.mu.Unlock()
+	mp.onExpired(pm.tMoveInfo)
+}
+
+// len returns the number of unpaired halves
+func (mp *movePairer) len() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return len(mp.pending)
+}
+
+// reset drops all unpaired halves without handling them
+func (mp *movePairer) reset() {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	for cookie, pm := range mp.pending {
+		pm.timer.Stop()
+		delete(mp.pending, cookie)
+	}
+}
@@ -0,0 +1,49 @@
+package filetypestats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMovePairer(t *testing.T) {
+	expired := make(chan tMoveInfo, 10)
+	mp := newMovePairer(50*time.Millisecond, func(mi tMoveInfo) { expired <- mi })
+
+	// both halves within the timeout
+	_, paired := mp.from(1, "/w/a")
+	assert.False(t, paired)
+	mi, paired := mp.to(1, "/w/b")
+	assert.True(t, paired)
+	assert.Equal(t, tMoveInfo{From: "/w/a", To: "/w/b"}, mi)
+
+	// halves with different cookies don't pair, and expire separately
+	_, paired = mp.from(2, "/w/out")
+	assert.False(t, paired)
+	_, paired = mp.to(3, "/w/in")
+	assert.False(t, paired)
+	assert.Equal(t, 2, mp.len())
+	got := map[tMoveInfo]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case mi := <-expired:
+			got[mi] = true
+		case <-time.After(time.Second):
+			t.Fatal("unpaired move didn't expire")
+		}
+	}
+	assert.Equal(t, map[tMoveInfo]bool{{From: "/w/out"}: true, {To: "/w/in"}: true}, got)
+	assert.Zero(t, mp.len())
+
+	// a late second half doesn't pair with an expired one
+	_, paired = mp.to(2, "/w/late")
+	assert.False(t, paired)
+	mp.reset()
+	assert.Zero(t, mp.len())
+	select {
+	case mi := <-expired:
+		t.Errorf("reset move expired: %v", mi)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
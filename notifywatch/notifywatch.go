@@ -2,6 +2,9 @@ package notifywatch
 
 import (
 	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
 
 	"github.com/Rainc1oud/filetypestats/utils"
 	"github.com/rjeczalik/notify"
@@ -9,32 +12,105 @@ import (
 
 type NotifyHandlerFun func(*notify.EventInfo) error
 
+// NotifyErrorFun receives the errors returned by the NotifyHandlerFun, together with the event that caused it
+type NotifyErrorFun func(notify.EventInfo, error)
+
+// StderrErrorHandler is the default NotifyErrorFun, it prints the errors to stderr like the scanner does
+// The event may be nil for errors which aren't caused by a single event.
+func StderrErrorHandler(ei notify.EventInfo, err error) {
+	if ei == nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	fmt.Fprintf(os.Stderr, "handling %s on %s: %s\n", ei.Event(), ei.Path(), err.Error())
+}
+
+// NotifyOverflowFun is called when events were (or are likely to have been) lost
+type NotifyOverflowFun func()
+
+// DefaultEventBufferSize is the capacity of the event queue between notify and the handler worker
+// notify drops events if the receiving channel is full, so this should be generous
+const DefaultEventBufferSize = 4096
+
+// DefaultOverflowBacklog is the number of queued events from which on the handler is considered overflowed
+// notify filters IN_Q_OVERFLOW from the kernel and silently drops events when the queue is full,
+// so a queue which is (almost) full is the only reliable sign that events got lost
+const DefaultOverflowBacklog = DefaultEventBufferSize * 3 / 4
+
 /*** inotify watcher with handler for one (recursive) file tree ***/
 
 type NotifyWatcher struct {
 	watchdir  string
 	recursive bool
-	watching  bool
+	watching  atomic.Bool
 	eventInfo chan notify.EventInfo
+	done      chan struct{}
 	events    []notify.Event
-	handler   NotifyHandlerFun
+	mu        sync.Mutex // guards handlers and the closing of done, the handlers are read for every event
+	handlers  notifyHandlers
+}
+
+// notifyHandlers are the callbacks of a watcher
+type notifyHandlers struct {
+	handler         NotifyHandlerFun
+	errorHandler    NotifyErrorFun
+	overflowHandler NotifyOverflowFun
+	overflowBacklog int
 }
 
 // NewNotifyWatcher watches the given dir and calls handler on inotify events
 // a dir ending in "/*" will result in a recursive watch
 func NewNotifyWatcher(dir string, recursive bool, handler NotifyHandlerFun, events ...notify.Event) *NotifyWatcher {
 	nw := &NotifyWatcher{
-		eventInfo: make(chan notify.EventInfo, 1), // buffered to ensure no events are dropped
+		eventInfo: make(chan notify.EventInfo, DefaultEventBufferSize), // buffered to ensure no events are dropped while the handler is busy
+		done:      make(chan struct{}),
 		events:    events,
 		watchdir:  dir,
 		recursive: recursive,
-		watching:  false,
-		handler:   handler,
+		handlers: notifyHandlers{
+			handler:         handler,
+			errorHandler:    StderrErrorHandler,
+			overflowBacklog: DefaultOverflowBacklog,
+		},
 	}
 	return nw
 }
 
-// Watch starts an initialised notify watcher (blockings)
+// SetErrorHandler sets the sink for errors returned by the event handler (nil: StderrErrorHandler)
+// It can be changed while watching, it then applies from the next event on
+func (nw *NotifyWatcher) SetErrorHandler(errorHandler NotifyErrorFun) {
+	if errorHandler == nil {
+		errorHandler = StderrErrorHandler
+	}
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.handlers.errorHandler = errorHandler
+}
+
+// SetOverflowHandler sets the function called when the event queue overflows (nil disables overflow detection)
+// The queue is considered overflowed when it holds backlog or more events (backlog <= 0 uses DefaultOverflowBacklog),
+// this backlog is the only detection: the kernel's IN_Q_OVERFLOW never reaches the queue (see DefaultOverflowBacklog).
+// overflowHandler is called once per overflow, i.e. again only after the queue has been emptied in between.
+// It is called from the handler worker, so it must not block.
+// It can be changed while watching, it then applies from the next event on
+func (nw *NotifyWatcher) SetOverflowHandler(overflowHandler NotifyOverflowFun, backlog int) {
+	if backlog <= 0 || backlog > cap(nw.eventInfo) {
+		backlog = DefaultOverflowBacklog
+	}
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.handlers.overflowHandler = overflowHandler
+	nw.handlers.overflowBacklog = backlog
+}
+
+func (nw *NotifyWatcher) currentHandlers() notifyHandlers {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	return nw.handlers
+}
+
+// Watch starts an initialised notify watcher (blocking)
+// Events are dispatched to the handler by a single worker goroutine, in the order they arrived
 func (nw *NotifyWatcher) Watch() error {
 	if nw.watchdir == "" {
 		return fmt.Errorf("ERROR: refusing to start empty watcher")
@@ -46,46 +122,72 @@ func (nw *NotifyWatcher) Watch() error {
 	} else {
 		dir = nw.watchdir
 	}
-	nw.watching = true
-	if err = notify.Watch(dir, nw.eventInfo, nw.events...); err != nil { // blocking function
-		// log.Printf("error: %s", err.Error())
-		nw.watching = false
+	if err = notify.Watch(dir, nw.eventInfo, nw.events...); err != nil {
 		return err
 	}
 	defer notify.Stop(nw.eventInfo)
+	nw.watching.Store(true)
+
+	workerDone := make(chan struct{})
+	go func() {
+		nw.dispatch()
+		close(workerDone)
+	}()
 
+	<-nw.done    // this exits when we close the channel by executing nw.Stop()
+	<-workerDone // make sure no handler is running anymore when we return
+	nw.watching.Store(false)
+	return fmt.Errorf("watcher for %s terminated", nw.watchdir)
+}
+
+// dispatch is the worker loop which calls the handler for every received event until the watcher is stopped
+// The handlers are read for every event, so they can be changed while watching
+func (nw *NotifyWatcher) dispatch() {
+	overflowed := false // the overflow handler was called and the backlog wasn't cleared since
 	for {
-		_, ok := <-nw.eventInfo // this should exit the loop when we close the channel by executing nw.Stop()
-		// if ok {
-		// log.Printf("got event: %v; executing handler...", ei) // FIXME: uncontrolled logging
-		// if err = nw.handler(&ei); err != nil {
-		// log.Printf("failed executing handler for event: %v; %s", ei, err.Error()) // FIXME: uncontrolled logging
-		// TODO: consider how to handle this error
-		// }
-		if !ok {
-			err = fmt.Errorf("watcher for %s terminated", nw.watchdir)
-			break
+		select {
+		case <-nw.done:
+			return
+		case ei := <-nw.eventInfo:
+			h := nw.currentHandlers()
+			if h.overflowHandler != nil {
+				nw.checkOverflow(h, &overflowed)
+			}
+			if h.handler == nil {
+				continue
+			}
+			if err := h.handler(&ei); err != nil {
+				h.errorHandler(ei, err)
+			}
 		}
 	}
-	nw.watching = false
-	return err
 }
 
+// checkOverflow calls the overflow handler if the queue holds the overflow backlog (and it wasn't called for this backlog yet)
+func (nw *NotifyWatcher) checkOverflow(h notifyHandlers, overflowed *bool) {
+	backlog := len(nw.eventInfo)
+	if backlog >= h.overflowBacklog && !*overflowed {
+		*overflowed = true
+		h.overflowHandler()
+	} else if backlog == 0 {
+		*overflowed = false
+	}
+}
+
+// Stop stops the watcher; a stopped watcher can't be restarted
 func (nw *NotifyWatcher) Stop() error {
-	nw.watching = false
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.watching.Store(false)
 	select {
-	case _, ok := <-nw.eventInfo:
-		if !ok {
-			return fmt.Errorf("channel nw.EventInfo already closed")
-		} else {
-			close(nw.eventInfo) // can we do this? we probably need to be careful in the watch loop?
-			return nil
-		}
+	case <-nw.done:
+		return fmt.Errorf("watcher for %s already stopped", nw.watchdir)
 	default:
+		close(nw.done)
 		return nil
 	}
 }
 
 func (nw *NotifyWatcher) IsWatching() bool {
-	return nw.watching
+	return nw.watching.Load()
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -47,3 +48,92 @@ func TestNotifyWatcher_Watch(t *testing.T) {
 	assert.Nil(t, os.WriteFile(filepath.Join(tdir, "tmpdir", "tmpfile11.txt"), []byte("Hahaha, this is the content of tmpfile11"), 0644))
 	time.Sleep(2 * time.Second)
 }
+
+func TestNotifyWatcher_Overflow(t *testing.T) {
+	wd, err := os.Getwd()
+	assert.Nil(t, err)
+	tdir := mktemp(wd)
+	defer os.RemoveAll(tdir)
+
+	// the handler blocks while a round of events piles up, like a slow handler during a bulk copy
+	var (
+		handled   atomic.Int32
+		overflows atomic.Int32
+		blocked   = make(chan chan struct{}, 1)
+	)
+	h := func(ei *notify.EventInfo) error {
+		select {
+		case release := <-blocked:
+			<-release
+		default:
+		}
+		handled.Add(1)
+		return nil
+	}
+	nw := NewNotifyWatcher(tdir, true, h, notify.InCreate)
+	nw.SetOverflowHandler(func() { overflows.Add(1) }, 10)
+	watchDone := make(chan struct{})
+	go func() {
+		nw.Watch()
+		close(watchDone)
+	}()
+	defer func() {
+		nw.Stop()
+		<-watchDone
+	}()
+	assert.Eventually(t, nw.IsWatching, time.Second, time.Millisecond)
+
+	create := 0
+	round := func() {
+		t.Helper()
+		release := make(chan struct{})
+		blocked <- release
+		for i := 0; i < 15; i++ {
+			create++
+			assert.Nil(t, os.WriteFile(filepath.Join(tdir, fmt.Sprintf("f%d", create)), nil, 0644))
+		}
+		// the first event blocks the handler, the other 14 are queued beyond the backlog threshold
+		assert.Eventually(t, func() bool { return len(nw.eventInfo) == 14 }, 5*time.Second, time.Millisecond)
+		close(release)
+		assert.Eventually(t, func() bool { return int(handled.Load()) == create }, 5*time.Second, time.Millisecond)
+	}
+	round()
+	assert.Equal(t, int32(1), overflows.Load(), "overflow must be reported once per backlog")
+
+	// after the queue was emptied, the next backlog is reported again
+	round()
+	assert.Equal(t, int32(2), overflows.Load())
+}
+
+func TestNotifyWatcher_ErrorHandler(t *testing.T) {
+	tdir := t.TempDir()
+	h := func(ei *notify.EventInfo) error {
+		return fmt.Errorf("can't handle %s", (*ei).Path())
+	}
+	nw := NewNotifyWatcher(tdir, true, h, notify.InCreate)
+	assert.NotNil(t, nw.currentHandlers().errorHandler, "errors must be reported by default")
+	watchDone := make(chan struct{})
+	go func() {
+		nw.Watch()
+		close(watchDone)
+	}()
+	defer func() {
+		nw.Stop()
+		<-watchDone
+	}()
+	assert.Eventually(t, nw.IsWatching, time.Second, time.Millisecond)
+
+	// the handler can be replaced while watching
+	errs := make(chan error, 10)
+	nw.SetErrorHandler(func(ei notify.EventInfo, err error) { errs <- err })
+	assert.Nil(t, os.WriteFile(filepath.Join(tdir, "f"), nil, 0644))
+	select {
+	case err := <-errs:
+		assert.ErrorContains(t, err, "can't handle")
+	case <-time.After(5 * time.Second):
+		t.Fatal("error not reported")
+	}
+
+	nw.SetErrorHandler(nil)
+	assert.NotNil(t, nw.currentHandlers().errorHandler)
+}
@@ -0,0 +1,422 @@
+package filetypestats
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Rainc1oud/filetypestats/exclude"
+	"github.com/Rainc1oud/filetypestats/store"
+	"github.com/Rainc1oud/filetypestats/types"
+	"github.com/karrick/godirwalk"
+)
+
+// ScanOptions control how ScanDir() scans a tree
+type ScanOptions struct {
+	// Incremental skips content sniffing for files whose size, mtime and inode are unchanged since the last scan,
+	// their stored file type is reused and only their updated time is refreshed.
+	// The members of unchanged archives are likewise taken from the DB instead of expanding them again (see ArchiveOptions).
+	Incremental bool
+	// Workers is the number of concurrent classification workers (and directory readers)
+	// With Workers <= 1 the tree is scanned serially in a single godirwalk.Walk
+	Workers int
+	// Progress is called every ProgressInterval (default 1s) during the scan and once when it ends
+	// It is called from a separate goroutine, but never concurrently
+	Progress         func(ScanProgress)
+	ProgressInterval time.Duration
+	// Exclude are the rules for paths to skip, excluded dirs are not descended into
+	Exclude *exclude.Rules
+	// Dedup runs a duplicate detection pass (see Dedup) over the tree after a complete scan
+	Dedup bool
+	// Archives controls the expansion of the archives in the tree, by default they are only counted as files
+	Archives ArchiveOptions
+}
+
+const defaultProgressInterval = time.Second
+
+// ScanProgress is a snapshot of the counters of a running scan
+type ScanProgress struct {
+	Root   string
+	Dirs   uint64 // directories visited
+	Files  uint64 // regular files classified
+	Bytes  uint64 // total size of the classified files
+	Errors uint64 // paths that couldn't be read
+	Path   string // the path that was classified last
+}
+
+// scanSink is what a treeScanner writes to, normally a store.Store
+type scanSink interface {
+	GetFileStat(path string) (*types.FileStat, error)
+	FTDumpFileStats(paths []string) ([]types.FileStat, error)
+	UpdateFileStatMulti(fst *types.FileStat, batch *types.FTypeStatsBatch) error
+	CommitBatch(batch *types.FTypeStatsBatch) error
+}
+
+var _ scanSink = store.Store(nil)
+
+// treeScanner scans one tree into the DB, it holds the state of one scan and is not reusable
+type treeScanner struct {
+	root  string
+	fsys  fs.FS // if set, the tree is read from fsys and stored under root (see newFSScanner), otherwise root is read from the OS
+	opts  ScanOptions
+	db    scanSink
+	batch *types.FTypeStatsBatch
+	// the prefix of fsys, all its entries are stored as members of it (see types.FileStat.Archive)
+	archive string
+	// the first failed write, the scan is then incomplete (store is never called concurrently)
+	writeErr error
+	// progress counters
+	dirs, files, bytes, errors atomic.Uint64
+	curPath                    atomic.Value
+}
+
+func newTreeScanner(db scanSink, root string, opts ScanOptions) *treeScanner {
+	return &treeScanner{
+		root:  filepath.Clean(root), // like godirwalk.Walk, so all paths are clean
+		opts:  opts,
+		db:    db,
+		batch: types.NewFTypeStatsBatch(pathInfoBatchSize),
+	}
+}
+
+// scan walks the tree and upserts all dirs and regular files, it doesn't delete anything
+// If ctx is cancelled, the scan stops as soon as possible and returns ctx.Err(), the results obtained so far are still stored.
+// It also returns an error if a batch couldn't be written, the scan is then incomplete as well.
+func (s *treeScanner) scan(ctx context.Context) error {
+	stopProgress := s.reportProgress()
+	var err error
+	switch {
+	case s.fsys != nil:
+		err = s.walkFS(ctx)
+	case s.opts.Workers > 1:
+		err = s.walkParallel(ctx)
+	default:
+		err = s.walkSerial(ctx)
+	}
+	if cerr := s.db.CommitBatch(s.batch); cerr != nil && s.writeErr == nil { // commit any "in-flight" batch
+		s.writeErr = cerr
+	}
+	if err == nil {
+		err = s.writeErr
+	}
+	stopProgress()
+	if ctx.Err() != nil { // the walk may have ended normally while ctx was cancelled, but we can't know if it was complete
+		return ctx.Err()
+	}
+	return err
+}
+
+// progress returns a snapshot of the counters
+func (s *treeScanner) progress() ScanProgress {
+	p := ScanProgress{
+		Root:   s.root,
+		Dirs:   s.dirs.Load(),
+		Files:  s.files.Load(),
+		Bytes:  s.bytes.Load(),
+		Errors: s.errors.Load(),
+	}
+	if path, ok := s.curPath.Load().(string); ok {
+		p.Path = path
+	}
+	return p
+}
+
+// reportProgress calls opts.Progress periodically until the returned function is called, which does a last report
+func (s *treeScanner) reportProgress() (stop func()) {
+	if s.opts.Progress == nil {
+		return func() {}
+	}
+	interval := s.opts.ProgressInterval
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				s.opts.Progress(s.progress())
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+		s.opts.Progress(s.progress())
+	}
+}
+
+// store adds fst to the current batch, a failed write is reported and remembered in s.writeErr
+func (s *treeScanner) store(fst *types.FileStat) {
+	if err := s.db.UpdateFileStatMulti(fst, s.batch); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		if s.writeErr == nil {
+			s.writeErr = err
+		}
+	}
+}
+
+// classify returns the FileStat for path, or nil if path is excluded or can't be read
+func (s *treeScanner) classify(path string) *types.FileStat {
+	fst, err := s.fileStat(path)
+	if err != nil {
+		s.errors.Add(1)
+		fmt.Fprintln(os.Stderr, err.Error())
+		return nil
+	} else if fst == nil {
+		return nil
+	}
+	if fst.FType == "dir" {
+		s.dirs.Add(1)
+	} else {
+		s.files.Add(1)
+		s.bytes.Add(fst.NumBytes)
+	}
+	s.curPath.Store(path)
+	return fst
+}
+
+// classifyAll returns the FileStat of path followed by those of its members if it's an archive to expand (see ArchiveOptions),
+// or nil if path is excluded or can't be read
+func (s *treeScanner) classifyAll(path string) []*types.FileStat {
+	fst := s.classify(path)
+	if fst == nil {
+		return nil
+	}
+	return append([]*types.FileStat{fst}, s.expandArchive(fst)...)
+}
+
+// fileStat returns the FileStat for path, or nil without error if path is excluded
+// In incremental mode the stored file type is reused if the file is unchanged, which saves opening and sniffing it
+func (s *treeScanner) fileStat(path string) (*types.FileStat, error) {
+	fi, err := s.lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if s.opts.Exclude.ExcludedEntry(path, fi.IsDir(), uint64(fi.Size())) {
+		return nil, nil
+	}
+	if s.opts.Incremental && fi.Mode().IsRegular() {
+		// entries stored before MIME types were detected are sniffed again
+		if stored, err := s.db.GetFileStat(path); err == nil && stored != nil && stored.MIME != "" {
+			if fst := types.NewFileStat(path, stored.FType, fi); fst.Unchanged(stored) {
+				fst.MIME, fst.Archive = stored.MIME, s.archive
+				return fst, nil
+			}
+		}
+	}
+	if s.fsys != nil {
+		fst, err := fsFileInfoFTStat(s.fsys, s.fsName(path), path, fi)
+		if err == nil {
+			fst.Archive = s.archive
+		}
+		return fst, err
+	}
+	return fileInfoFTStat(path, fi)
+}
+
+// lstat returns the FileInfo of path (without following symlinks), from s.fsys if set
+func (s *treeScanner) lstat(path string) (fs.FileInfo, error) {
+	if s.fsys != nil {
+		return fs.Lstat(s.fsys, s.fsName(path))
+	}
+	return os.Lstat(path)
+}
+
+// open opens path for reading, from s.fsys if set
+func (s *treeScanner) open(path string) (fs.File, error) {
+	if s.fsys != nil {
+		return s.fsys.Open(s.fsName(path))
+	}
+	return os.Open(path)
+}
+
+func (s *treeScanner) walkSerial(ctx context.Context) error {
+	return godirwalk.Walk(s.root, &godirwalk.Options{
+		AllowNonDirectory: true,
+		Callback: func(osPathname string, de *godirwalk.Dirent) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !(de.IsDir() || de.IsRegular()) {
+				return nil
+			}
+			if de.IsDir() && osPathname != s.root && s.opts.Exclude.ExcludedDir(osPathname) {
+				return godirwalk.SkipThis
+			}
+			for _, fst := range s.classifyAll(osPathname) {
+				s.store(fst)
+			}
+			return nil
+		},
+		Unsorted: true, // (optional) set true for faster yet non-deterministic enumeration (see godoc)
+		ErrorCallback: func(path string, e error) godirwalk.ErrorAction {
+			if ctx.Err() != nil {
+				return godirwalk.Halt
+			}
+			// fmt.Fprintf(os.Stderr, "warning: %s reading %s\n", e.Error(), path)
+			s.errors.Add(1)
+			return godirwalk.SkipNode
+		},
+	})
+}
+
+// walkParallel reads directories with s.opts.Workers goroutines and feeds all entries to as many classification workers
+func (s *treeScanner) walkParallel(ctx context.Context) error {
+	fi, err := os.Lstat(s.root)
+	if err != nil {
+		return err
+	}
+	return s.classifyParallel(ctx, func(jobs chan<- string) error {
+		jobs <- s.root
+		if !fi.IsDir() {
+			return nil
+		}
+		dq := newDirQueue(s.root)
+		defer context.AfterFunc(ctx, dq.cancel)()
+		var walkers sync.WaitGroup
+		for i := 0; i < s.opts.Workers; i++ {
+			walkers.Add(1)
+			go func() {
+				defer walkers.Done()
+				scratch := make([]byte, godirwalk.MinimumScratchBufferSize)
+				for dir, ok := dq.pop(); ok; dir, ok = dq.pop() {
+					s.readDir(ctx, dir, scratch, dq, jobs)
+					dq.done()
+				}
+			}()
+		}
+		walkers.Wait()
+		return nil
+	})
+}
+
+// classifyParallel classifies the paths that feed sends to jobs with s.opts.Workers goroutines, it returns the error of feed
+// The results are written by a single goroutine, so the DB sees the same (serialised) batches as with walkSerial()
+func (s *treeScanner) classifyParallel(ctx context.Context, feed func(jobs chan<- string) error) error {
+	jobs := make(chan string, 4*s.opts.Workers)
+	results := make(chan *types.FileStat, 4*s.opts.Workers)
+
+	var workers sync.WaitGroup
+	for i := 0; i < s.opts.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for path := range jobs {
+				if ctx.Err() != nil {
+					continue // drain
+				}
+				for _, fst := range s.classifyAll(path) {
+					results <- fst
+				}
+			}
+		}()
+	}
+
+	writerDone := make(chan struct{})
+	go func() {
+		for fst := range results {
+			s.store(fst)
+		}
+		close(writerDone)
+	}()
+
+	err := feed(jobs)
+	close(jobs)
+	workers.Wait()
+	close(results)
+	<-writerDone
+	return err
+}
+
+// readDir sends all dirs and regular files in dir to jobs, and queues the subdirs for reading
+func (s *treeScanner) readDir(ctx context.Context, dir string, scratch []byte, dq *dirQueue, jobs chan<- string) {
+	des, err := godirwalk.ReadDirents(dir, scratch)
+	if err != nil {
+		s.errors.Add(1)
+		return // skip unreadable dirs, like walkSerial()
+	}
+	for _, de := range des {
+		if ctx.Err() != nil {
+			return
+		}
+		path := filepath.Join(dir, de.Name())
+		if de.IsDir() {
+			if s.opts.Exclude.ExcludedDir(path) {
+				continue
+			}
+			dq.push(path)
+		} else if !de.IsRegular() {
+			continue
+		}
+		jobs <- path
+	}
+}
+
+// dirQueue is an unbounded work queue of directories which is finished when all pushed dirs are done
+type dirQueue struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	dirs      []string
+	pending   int // queued + in progress
+	cancelled bool
+}
+
+func newDirQueue(root string) *dirQueue {
+	dq := &dirQueue{dirs: []string{root}, pending: 1}
+	dq.cond = sync.NewCond(&dq.mu)
+	return dq
+}
+
+func (dq *dirQueue) push(dir string) {
+	dq.mu.Lock()
+	dq.dirs = append(dq.dirs, dir)
+	dq.pending++
+	dq.mu.Unlock()
+	dq.cond.Signal()
+}
+
+// pop blocks until a dir is available, it returns false when all work is done
+func (dq *dirQueue) pop() (string, bool) {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	for len(dq.dirs) == 0 && dq.pending > 0 && !dq.cancelled {
+		dq.cond.Wait()
+	}
+	if len(dq.dirs) == 0 || dq.cancelled {
+		return "", false
+	}
+	dir := dq.dirs[len(dq.dirs)-1] // depth first keeps the queue short
+	dq.dirs = dq.dirs[:len(dq.dirs)-1]
+	return dir, true
+}
+
+// done marks a popped dir as finished
+func (dq *dirQueue) done() {
+	dq.mu.Lock()
+	dq.pending--
+	finished := dq.pending == 0
+	dq.mu.Unlock()
+	if finished {
+		dq.cond.Broadcast()
+	}
+}
+
+// cancel makes all current and future pop() calls return false
+func (dq *dirQueue) cancel() {
+	dq.mu.Lock()
+	dq.cancelled = true
+	dq.mu.Unlock()
+	dq.cond.Broadcast()
+}
@@ -0,0 +1,249 @@
+package filetypestats
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Rainc1oud/filetypestats/store"
+	"github.com/Rainc1oud/filetypestats/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// file headers recognised by filetype, so the generated tree has a mix of classes
+var testFileHeaders = [][]byte{
+	[]byte("\x89PNG\r\n\x1a\n"),      // image
+	[]byte("PK\x03\x04"),             // archive
+	[]byte("ID3"),                    // audio
+	[]byte("%PDF-1.4"),               // application
+	[]byte("just some text content"), // other
+}
+
+// genTree creates a tree of depth levels with fanout subdirs and nfiles files per dir under root
+func genTree(t testing.TB, root string, depth, fanout, nfiles int) (ndirs, nfilesTotal int) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < nfiles; i++ {
+		content := append(append([]byte{}, testFileHeaders[i%len(testFileHeaders)]...), make([]byte, i*17)...)
+		if err := os.WriteFile(filepath.Join(root, fmt.Sprintf("file%03d", i)), content, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	ndirs, nfilesTotal = 1, nfiles
+	if depth > 0 {
+		for d := 0; d < fanout; d++ {
+			nd, nf := genTree(t, filepath.Join(root, fmt.Sprintf("dir%02d", d)), depth-1, fanout, nfiles)
+			ndirs += nd
+			nfilesTotal += nf
+		}
+	}
+	return ndirs, nfilesTotal
+}
+
+// dbFileStats returns all records under dir sorted by path
+func dbFileStats(t testing.TB, fdb store.Store, dir string) []types.FileStat {
+	fsts, err := fdb.FTDumpFileStats([]string{dir + "/*"})
+	require.NoError(t, err)
+	sort.Slice(fsts, func(i, j int) bool { return fsts[i].Path < fsts[j].Path })
+	return fsts
+}
+
+func TestTreeScanner_ParallelEqualsSerial(t *testing.T) {
+	dir := t.TempDir()
+	ndirs, nfiles := genTree(t, dir, 3, 4, 10)
+
+	serialDB := tmpStore(t)
+	require.NoError(t, newTreeScanner(serialDB, dir, ScanOptions{}).scan(context.Background()))
+	serial := dbFileStats(t, serialDB, dir)
+	assert.Len(t, serial, ndirs+nfiles)
+
+	for _, workers := range []int{2, 8} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			parallelDB := tmpStore(t)
+			require.NoError(t, newTreeScanner(parallelDB, dir, ScanOptions{Workers: workers}).scan(context.Background()))
+			assert.Equal(t, serial, dbFileStats(t, parallelDB, dir))
+
+			want, err := serialDB.FTStatsSum([]string{dir + "/*"})
+			require.NoError(t, err)
+			got, err := parallelDB.FTStatsSum([]string{dir + "/*"})
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func TestTreeStatsWatcher_ScanDirContextProgress(t *testing.T) {
+	dir := t.TempDir()
+	ndirs, nfiles := genTree(t, dir, 2, 3, 7)
+	fdb := tmpStore(t)
+	tsw, err := NewTreeStatsWatcher(nil, fdb)
+	require.NoError(t, err)
+
+	for _, workers := range []int{0, 4} {
+		var reports []ScanProgress
+		opts := ScanOptions{
+			Workers:          workers,
+			Progress:         func(p ScanProgress) { reports = append(reports, p) },
+			ProgressInterval: time.Millisecond,
+		}
+		require.NoError(t, tsw.ScanDirContext(context.Background(), dir, opts))
+		require.NotEmpty(t, reports)
+		last := reports[len(reports)-1]
+		assert.Equal(t, uint64(ndirs), last.Dirs)
+		assert.Equal(t, uint64(nfiles), last.Files)
+		assert.Zero(t, last.Errors)
+		assert.NotEmpty(t, last.Path)
+
+		sum, err := fdb.FTStatsSum([]string{dir + "/*"})
+		require.NoError(t, err)
+		assert.Equal(t, sum["total"].NumBytes, last.Bytes)
+	}
+}
+
+func TestTreeStatsWatcher_ScanDirContextCancel(t *testing.T) {
+	dir := t.TempDir()
+	genTree(t, dir, 2, 3, 7)
+	fdb := tmpStore(t)
+	tsw, err := NewTreeStatsWatcher(nil, fdb)
+	require.NoError(t, err)
+
+	// a stale entry, which a complete scan would delete
+	stale := filepath.Join(dir, "deleted-file")
+	require.NoError(t, fdb.UpdateFileStat(&types.FileStat{FTypeStat: types.FTypeStat{Path: stale, FType: "other", NumBytes: 1}}))
+
+	for _, workers := range []int{0, 4} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := tsw.ScanDirContext(ctx, dir, ScanOptions{Workers: workers})
+		assert.ErrorIs(t, err, context.Canceled)
+		fst, err := fdb.GetFileStat(stale)
+		require.NoError(t, err)
+		assert.NotNil(t, fst, "cancelled scan deleted entry")
+	}
+
+	require.NoError(t, tsw.ScanDirContext(context.Background(), dir, ScanOptions{}))
+	fst, err := fdb.GetFileStat(stale)
+	require.NoError(t, err)
+	assert.Nil(t, fst, "complete scan didn't delete stale entry")
+}
+
+func BenchmarkScanDir(b *testing.B) {
+	dir := b.TempDir()
+	ndirs, nfiles := genTree(b, dir, 3, 6, 20)
+	b.Logf("generated tree with %d dirs and %d files", ndirs, nfiles)
+
+	for _, workers := range []int{1, 4, 16} {
+		name := "serial"
+		if workers > 1 {
+			name = fmt.Sprintf("parallel-%d", workers)
+		}
+		b.Run(name, func(b *testing.B) {
+			fdb := tmpStore(b)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := newTreeScanner(fdb, dir, ScanOptions{Workers: workers}).scan(context.Background()); err != nil {
+					b.Fatal(err.Error())
+				}
+			}
+		})
+	}
+}
+
+func TestTreeScanner_ExtMIME(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string][]byte{
+		"a.PNG":   testFileHeaders[0],
+		"b.png":   testFileHeaders[0],
+		"c.zip":   testFileHeaders[1],
+		"d.txt":   testFileHeaders[4],
+		"noext":   testFileHeaders[3],
+		".hidden": testFileHeaders[4],
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), content, 0644))
+	}
+
+	fdb := tmpStore(t)
+	for _, incremental := range []bool{false, true} { // the incremental scan reuses the stored MIME types
+		require.NoError(t, newTreeScanner(fdb, dir, ScanOptions{Incremental: incremental}).scan(context.Background()))
+
+		byExt, err := fdb.FTStatsSumWith([]string{dir + "/*"}, types.SumOptions{GroupBy: types.GroupByExt})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]uint{"png": 2, "zip": 1, "txt": 1, "": 2, "total": 6}, fileCounts(byExt))
+
+		byMIME, err := fdb.FTStatsSumWith([]string{dir + "/*"}, types.SumOptions{GroupBy: types.GroupByMIME})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]uint{"image/png": 2, "application/zip": 1, "application/pdf": 1, types.UnknownMIME: 2, "total": 6}, fileCounts(byMIME))
+
+		byClass, err := fdb.FTStatsSumWith([]string{dir + "/*"}, types.SumOptions{GroupBy: types.GroupByClass})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]uint{"dir": 1, "image": 2, "application": 2, "other": 2, "total": 7}, fileCounts(byClass))
+	}
+}
+
+func TestTreeScanner_Hardlinks(t *testing.T) {
+	dir := t.TempDir()
+	content := append(append([]byte{}, testFileHeaders[0]...), make([]byte, 1000)...)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.png"), content, 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "backup"), 0755))
+	require.NoError(t, os.Link(filepath.Join(dir, "a.png"), filepath.Join(dir, "backup", "a.png")))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "backup", "b.png"), content, 0644)) // a copy, not a link
+
+	fdb := tmpStore(t)
+	require.NoError(t, newTreeScanner(fdb, dir, ScanOptions{}).scan(context.Background()))
+
+	fst, err := fdb.GetFileStat(filepath.Join(dir, "backup", "a.png"))
+	require.NoError(t, err)
+	require.NotNil(t, fst)
+	assert.Equal(t, uint64(2), fst.Nlink)
+
+	fts, err := fdb.FTStatsSumWith([]string{dir + "/*"}, types.SumOptions{Unique: true})
+	require.NoError(t, err)
+	size := uint64(len(content))
+	assert.Equal(t, 3*size, fts["image"].NumBytes)
+	assert.Equal(t, 2*size, fts["image"].UniqueBytes)
+	assert.Equal(t, uint(3), fts["image"].FileCount)
+
+	// within the scope of the backup dir, its link is unique
+	fts, err = fdb.FTStatsSumWith([]string{dir + "/backup/*"}, types.SumOptions{Unique: true})
+	require.NoError(t, err)
+	assert.Equal(t, 2*size, fts["image"].UniqueBytes)
+}
+
+func TestTreeScanner_Allocated(t *testing.T) {
+	dir := t.TempDir()
+	sparse := filepath.Join(dir, "sparse.img")
+	fh, err := os.Create(sparse)
+	require.NoError(t, err)
+	require.NoError(t, fh.Truncate(64<<20))
+	require.NoError(t, fh.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "full"), make([]byte, 64<<10), 0644))
+
+	fdb := tmpStore(t)
+	require.NoError(t, newTreeScanner(fdb, dir, ScanOptions{}).scan(context.Background()))
+
+	fst, err := fdb.GetFileStat(sparse)
+	require.NoError(t, err)
+	require.NotNil(t, fst)
+	assert.Equal(t, uint64(64<<20), fst.NumBytes)
+	assert.Less(t, fst.AllocBytes, fst.NumBytes, "sparse file")
+
+	fts, err := fdb.FTStatsSumWith([]string{dir + "/*"}, types.SumOptions{Allocated: true})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(64<<20+64<<10), fts["total"].NumBytes)
+	assert.Less(t, fts["total"].AllocBytes, fts["total"].NumBytes)
+	assert.GreaterOrEqual(t, fts["total"].AllocBytes, uint64(64<<10), "the non-sparse file is allocated")
+}
+
+func fileCounts(fts types.FileTypeStats) map[string]uint {
+	counts := make(map[string]uint)
+	for k, s := range fts {
+		counts[k] = s.FileCount
+	}
+	return counts
+}
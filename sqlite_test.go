@@ -0,0 +1,174 @@
+//go:build cgo
+
+package filetypestats
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Rainc1oud/filetypestats/ftsdb"
+	"github.com/Rainc1oud/filetypestats/store"
+	"github.com/Rainc1oud/filetypestats/types"
+	"github.com/Rainc1oud/filetypestats/utils"
+	"github.com/rjeczalik/notify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the tests of the features only the sqlite store has, which need cgo
+
+func init() {
+	testStores["sqlite"] = func(t testing.TB) store.Store { return tmpDB(t) }
+}
+
+func tmpDB(t testing.TB) *ftsdb.FileTypeStatsDB {
+	fdb, err := ftsdb.New(filepath.Join(t.TempDir(), "testdb.sqlite"), true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(fdb.Close)
+	return fdb
+}
+
+func TestTreeStatsWatcher_Snapshots(t *testing.T) {
+	dir := t.TempDir()
+	fdb := tmpDB(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file.txt"), []byte("plain text"), 0644))
+	snapshots := func() []types.Snapshot {
+		snaps, err := fdb.Snapshots(dir, time.Time{}, time.Time{})
+		require.NoError(t, err)
+		return snaps
+	}
+
+	// every complete scan takes a snapshot
+	tsw, err := NewTreeStatsWatcher(nil, fdb)
+	require.NoError(t, err)
+	require.NoError(t, tsw.ScanDir(dir))
+	snaps := snapshots()
+	require.Len(t, snaps, 1)
+	assert.Equal(t, uint(1), snaps[0].Stats["other"].FileCount)
+	assert.Equal(t, uint64(10), snaps[0].Stats["other"].NumBytes)
+
+	require.NoError(t, tsw.AddWatch(dir)) // scans asynchronously
+	assert.Eventually(t, func() bool { return len(snapshots()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	var errs []error
+	var errmu sync.Mutex
+	tsw.SetErrorHandler(func(_ notify.EventInfo, err error) {
+		errmu.Lock()
+		errs = append(errs, err)
+		errmu.Unlock()
+	})
+	tsw.SetSnapshotInterval(20 * time.Millisecond)
+	assert.Eventually(t, func() bool { return len(snapshots()) >= 5 }, 5*time.Second, 10*time.Millisecond)
+	tsw.SetSnapshotInterval(0)
+	n := len(snapshots())
+	time.Sleep(100 * time.Millisecond)
+	assert.LessOrEqual(t, len(snapshots()), n+1, "periodic snapshots didn't stop") // one may have been in progress
+	errmu.Lock()
+	assert.Empty(t, errs)
+	errmu.Unlock()
+}
+
+func TestTreeStatsWatcher_MemStore(t *testing.T) {
+	dir := t.TempDir()
+	genTree(t, filepath.Join(dir, "tree"), 2, 2, 5)
+	mem := store.NewMemStore()
+	tsw := startWatch(t, dir, mem, nil)
+
+	// the scan gives the same totals as with the sqlite store
+	fdb := tmpDB(t)
+	sqlTsw, err := NewTreeStatsWatcher(nil, fdb)
+	require.NoError(t, err)
+	require.NoError(t, sqlTsw.ScanDir(dir))
+	for _, paths := range [][]string{{dir + "/*"}, {dir + "/tree/"}, {dir + "/tree/*/file00?"}} {
+		want, err := fdb.FTStatsSum(paths)
+		require.NoError(t, err)
+		got, err := mem.FTStatsSum(paths)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, "FTStatsSum(%v)", paths)
+	}
+
+	// events update the store
+	inStore := func(path string, size uint64) func() bool {
+		return func() bool {
+			fst, err := mem.GetFileStat(path)
+			return err == nil && fst != nil && fst.NumBytes == size
+		}
+	}
+	created := filepath.Join(dir, "created.txt")
+	require.NoError(t, os.WriteFile(created, []byte("12345"), 0644))
+	assert.Eventually(t, inStore(created, 5), eventTimeout, 20*time.Millisecond, "created file not in store")
+	moved := filepath.Join(dir, "tree", "moved.txt")
+	require.NoError(t, os.Rename(created, moved))
+	assert.Eventually(t, inStore(moved, 5), eventTimeout, 20*time.Millisecond, "moved file not in store")
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "tree")))
+	assert.Eventually(t, func() bool {
+		fts, err := mem.FTStatsSum([]string{dir + "/*"})
+		return err == nil && fts["total"] != nil && fts["total"].FileCount == 1 // only dir itself is left
+	}, eventTimeout, 20*time.Millisecond, "removed tree still in store")
+
+	// the features of the sqlite store are reported as unsupported
+	assert.Error(t, tsw.SnapshotAll())
+	assert.Error(t, tsw.ScanDirContext(context.Background(), dir, ScanOptions{Dedup: true}))
+}
+
+// TestWalkStats_FTStatsSum checks that WalkStats sums like FTStatsSum of the sqlite store, paths included
+func TestWalkStats_FTStatsSum(t *testing.T) {
+	dir := t.TempDir()
+	genTree(t, filepath.Join(dir, "a"), 2, 2, 4)
+	genTree(t, filepath.Join(dir, "b[1]"), 1, 3, 3)
+	fdb := tmpDB(t)
+	require.NoError(t, newTreeScanner(fdb, dir, ScanOptions{}).scan(context.Background()))
+
+	stats, err := WalkStats(context.Background(), []string{dir}, WalkOptions{PerDir: true})
+	require.NoError(t, err)
+	want, err := fdb.FTStatsSum([]string{utils.GlobEscape(dir) + "/*"})
+	require.NoError(t, err)
+	assert.Equal(t, want, stats.Total)
+	ndirs := 0
+	for p := range dbPaths(t, fdb, dir) {
+		if !strings.HasSuffix(p, "/") {
+			continue
+		}
+		ndirs++
+		want, err := fdb.FTStatsSum([]string{utils.GlobEscape(p) + "*"})
+		require.NoError(t, err)
+		assert.Equal(t, want, stats.Dirs[p], "dir %s", p)
+	}
+	assert.Len(t, stats.Dirs, ndirs)
+
+	stats, err = WalkStats(context.Background(), []string{filepath.Join(dir, "a", "dir00"), filepath.Join(dir, "b[1]")}, WalkOptions{})
+	require.NoError(t, err)
+	want, err = fdb.FTStatsSum([]string{utils.GlobEscape(dir) + "/a/dir00/*", utils.GlobEscape(dir) + "/b[[]1]/*"})
+	require.NoError(t, err)
+	assert.Equal(t, want, stats.Total)
+}
+
+func TestWalkFileTypeStatsDB(t *testing.T) {
+	dir := t.TempDir()
+	genTree(t, filepath.Join(dir, "a"), 1, 2, 3)
+	dbfile := filepath.Join(t.TempDir(), "fts.db")
+
+	stats, err := WalkFileTypeStatsDB([]string{filepath.Join(dir, "a")}, dbfile)
+	require.NoError(t, err)
+	want, err := WalkStats(context.Background(), []string{filepath.Join(dir, "a")}, WalkOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, want.Total, stats)
+
+	// a file and a dir deleted between two runs on the same DB are not counted anymore
+	require.NoError(t, os.Remove(filepath.Join(dir, "a", "file000")))
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "a", "dir01")))
+	before := stats
+	stats, err = WalkFileTypeStatsDB([]string{filepath.Join(dir, "a")}, dbfile)
+	require.NoError(t, err)
+	want, err = WalkStats(context.Background(), []string{filepath.Join(dir, "a")}, WalkOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, want.Total, stats)
+	assert.Less(t, stats["total"].FileCount, before["total"].FileCount)
+}
@@ -0,0 +1,306 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Rainc1oud/filetypestats/types"
+	"github.com/Rainc1oud/filetypestats/utils"
+)
+
+// MemStore is a Store which keeps all records in memory, e.g. for tests or short-lived scans
+// It returns the same results as the sqlite store, but every query scans all records
+type MemStore struct {
+	mu    sync.RWMutex
+	files map[string]*memEntry
+	cats  map[string]bool
+}
+
+type memEntry struct {
+	fst     types.FileStat
+	updated int64 // unix time (ns), like fileinfo.updated
+}
+
+var _ Store = (*MemStore)(nil)
+
+// NewMemStore returns an empty MemStore
+func NewMemStore() *MemStore {
+	m := &MemStore{
+		files: make(map[string]*memEntry),
+		cats:  make(map[string]bool),
+	}
+	for _, c := range types.FClassNames() {
+		m.cats[c] = true
+	}
+	return m
+}
+
+// normalised returns fst as the sqlite store would return it after storing it
+func normalised(fst *types.FileStat) types.FileStat {
+	n := *fst
+	n.FileCount, n.UniqueBytes = 1, 0
+	n.Ext = types.FileExt(n.Path)
+	if n.FType == "dir" {
+		n.FileCount, n.Ext, n.MIME, n.Nlink = 0, "", "", 0
+	}
+	if n.ModTime.IsZero() { // no metadata, the allocated size is unknown
+		n.AllocBytes = n.NumBytes
+	} else {
+		n.ModTime = time.Unix(0, n.ModTime.UnixNano())
+	}
+	return n
+}
+
+// upsert stores fst, m.mu must be held
+func (m *MemStore) upsert(fst *types.FileStat, updated int64) error {
+	if !m.cats[fst.FType] {
+		return fmt.Errorf("unknown file category %q for %s", fst.FType, fst.Path)
+	}
+	m.files[fst.Path] = &memEntry{fst: normalised(fst), updated: updated}
+	return nil
+}
+
+// deleteIf deletes all entries for which del returns true and returns their number, m.mu must be held
+func (m *MemStore) deleteIf(del func(path string, e *memEntry) bool) int64 {
+	var n int64
+	for p, e := range m.files {
+		if del(p, e) {
+			delete(m.files, p)
+			n++
+		}
+	}
+	return n
+}
+
+// underOrAt reports whether path is prefix itself or in its subtree, prefix being a dir without trailing separator
+func underOrAt(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// selected returns the entries selected by paths, sorted by path, m.mu must be held
+// With members, the members of all archives in the paths are selected instead of the expanded archives (see types.SumOptions.ArchiveMembers)
+func (m *MemStore) selected(paths []string, members bool) []*memEntry {
+	paths = utils.OptimizePathsGlob(&paths)
+	var es []*memEntry
+	for p, e := range m.files {
+		if root, expanded := m.files[p+utils.MemberSep]; members && expanded && root.fst.Archive == p {
+			continue
+		}
+		for _, pattern := range paths {
+			if (members && utils.PathPatternMatch(pattern, p)) || utils.MemberMatch(pattern, p, e.fst.Archive) {
+				es = append(es, e)
+				break
+			}
+		}
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].fst.Path < es[j].fst.Path })
+	return es
+}
+
+func (m *MemStore) GetFileStat(path string) (*types.FileStat, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	e, ok := m.files[path]
+	if !ok {
+		return nil, nil
+	}
+	fst := e.fst
+	return &fst, nil
+}
+
+func (m *MemStore) UpdateFileStat(fst *types.FileStat) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.upsert(fst, time.Now().UnixNano())
+}
+
+func (m *MemStore) UpdateFileStatMulti(fst *types.FileStat, batch *types.FTypeStatsBatch) error {
+	if !batch.Push(*fst) { // the batch is full
+		return m.CommitBatch(batch)
+	}
+	return nil
+}
+
+func (m *MemStore) CommitBatch(batch *types.FTypeStatsBatch) error {
+	if batch.IsEmpty() {
+		return nil
+	}
+	defer batch.Reset() // like the sqlite store, a failed batch is dropped
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	updated := time.Now().UnixNano()
+	for _, fst := range batch.AllElem() {
+		if err := m.upsert(&fst, updated); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) UpdateFilePath(from, to string) error {
+	isDir := strings.HasSuffix(from, "/")
+	if isDir {
+		to = utils.DirTrailSep(to)
+	}
+	if from == to {
+		return nil
+	}
+	// a dir selects its subtree, a file only itself
+	in := func(path, p string) bool { return path == p || (isDir && strings.HasPrefix(path, p)) }
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteIf(func(p string, _ *memEntry) bool { return in(p, to) && !in(p, from) })
+	updated := time.Now().UnixNano()
+	for p, e := range m.files {
+		if !in(p, from) {
+			continue
+		}
+		delete(m.files, p)
+		e.fst.Path = to + p[len(from):]
+		if e.fst.Archive != "" { // the rest of the path after the archive is kept, like by the sqlite store
+			e.fst.Archive = e.fst.Path[:len(e.fst.Path)-(len(p)-len(e.fst.Archive))]
+		}
+		e.updated = updated
+		m.files[e.fst.Path] = e
+	}
+	return nil
+}
+
+func (m *MemStore) DeleteFileStatsTree(path string) (bool, int64, error) {
+	dir := utils.DirTrailSep(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, isDir := m.files[dir]; isDir {
+		return true, m.deleteIf(func(p string, _ *memEntry) bool { return strings.HasPrefix(p, dir) }), nil
+	}
+	path = utils.JustDir(path)
+	return false, m.deleteIf(func(p string, _ *memEntry) bool { return p == path }), nil
+}
+
+func (m *MemStore) DeleteOlderThanWithPrefix(t time.Time, prefix string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteIf(func(p string, e *memEntry) bool { return e.updated < t.UnixNano() && underOrAt(p, prefix) })
+	return nil
+}
+
+func (m *MemStore) PurgeExcluded(prefix string, excluded func(path string, isDir bool, size uint64) bool) (int64, error) {
+	prefix = utils.JustDir(prefix)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var purge []string
+	for p, e := range m.files {
+		if underOrAt(p, prefix) && excluded(p, e.fst.FType == "dir", e.fst.NumBytes) {
+			purge = append(purge, p)
+		}
+	}
+	var n int64
+	for _, dp := range purge {
+		if strings.HasSuffix(dp, "/") { // dir with its subtree
+			n += m.deleteIf(func(p string, _ *memEntry) bool { return strings.HasPrefix(p, dp) })
+		} else if _, ok := m.files[dp]; ok {
+			delete(m.files, dp)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MemStore) FTStatsSum(paths []string) (types.FileTypeStats, error) {
+	return m.FTStatsSumWith(paths, types.SumOptions{})
+}
+
+// memSum accumulates one group of FTStatsSumWith
+type memSum struct {
+	count        uint
+	bytes, alloc uint64
+	ubytes       map[string][2]uint64 // per file id (see fileID): the size and allocated size
+}
+
+func (s *memSum) add(e *memEntry) {
+	s.count++
+	s.bytes += e.fst.NumBytes
+	s.alloc += e.fst.AllocBytes
+	id := fileID(&e.fst)
+	u := s.ubytes[id]
+	s.ubytes[id] = [2]uint64{max(u[0], e.fst.NumBytes), max(u[1], e.fst.AllocBytes)}
+}
+
+// fileID identifies the file of a record for the unique sums, see ftsdb.FileTypeStatsDB.FTStatsSumWith
+func fileID(fst *types.FileStat) string {
+	if fst.Nlink == 0 || fst.Inode == 0 {
+		return fst.Path
+	}
+	return fmt.Sprintf("%d:%d", fst.Device, fst.Inode)
+}
+
+func (m *MemStore) FTStatsSumWith(paths []string, opts types.SumOptions) (types.FileTypeStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sums := make(map[string]*memSum)
+	total := &memSum{ubytes: make(map[string][2]uint64)}
+	for _, e := range m.selected(paths, opts.ArchiveMembers) {
+		group := e.fst.FType
+		if opts.GroupBy != types.GroupByClass {
+			if e.fst.FType == "dir" {
+				continue
+			}
+			group = e.fst.Ext
+			if opts.GroupBy == types.GroupByMIME {
+				group = e.fst.MIME
+			}
+		}
+		s, ok := sums[group]
+		if !ok {
+			s = &memSum{ubytes: make(map[string][2]uint64)}
+			sums[group] = s
+		}
+		s.add(e)
+		total.add(e)
+	}
+	ftstats := make(types.FileTypeStats)
+	if len(sums) == 0 {
+		return ftstats, nil
+	}
+	sums["total"] = total
+	for group, s := range sums {
+		ft := &types.FTypeStat{Path: "*", FType: group, FileCount: s.count, NumBytes: s.bytes}
+		if len(paths) == 1 {
+			ft.Path = paths[0]
+			if s.count == 1 && group != "total" { // like the sqlite store, which doesn't return the path
+				ft.Path = ""
+			}
+		}
+		if opts.Unique {
+			for _, u := range s.ubytes {
+				ft.UniqueBytes += u[0]
+			}
+		}
+		if opts.Allocated {
+			ft.AllocBytes = s.alloc
+			if opts.Unique {
+				ft.AllocBytes = 0
+				for _, u := range s.ubytes {
+					ft.AllocBytes += u[1]
+				}
+			}
+		}
+		ftstats[group] = ft
+	}
+	return ftstats, nil
+}
+
+func (m *MemStore) FTDumpFileStats(paths []string) ([]types.FileStat, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	es := m.selected(paths, false)
+	fsts := make([]types.FileStat, len(es))
+	for i, e := range es {
+		fsts[i] = e.fst
+	}
+	return fsts, nil
+}
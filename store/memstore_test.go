@@ -0,0 +1,128 @@
+package store
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Rainc1oud/filetypestats/types"
+	"github.com/google/go-cmp/cmp"
+)
+
+// the equivalence with the sqlite store is tested in ftsdb, these tests run without cgo
+
+func memPaths(t *testing.T, m *MemStore, paths ...string) []string {
+	t.Helper()
+	fsts, err := m.FTDumpFileStats(paths)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ps := make([]string, len(fsts))
+	for i, fst := range fsts {
+		ps[i] = fst.Path
+	}
+	return ps
+}
+
+func memStore(t *testing.T, fsts ...types.FileStat) *MemStore {
+	t.Helper()
+	m := NewMemStore()
+	b := types.NewFTypeStatsBatch(4)
+	for i := range fsts {
+		if err := m.UpdateFileStatMulti(&fsts[i], b); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := m.CommitBatch(b); err != nil {
+		t.Fatal(err.Error())
+	}
+	return m
+}
+
+func entry(path, cat string, size uint64) types.FileStat {
+	return types.FileStat{FTypeStat: types.FTypeStat{Path: path, FType: cat, NumBytes: size}}
+}
+
+func TestMemStore_FTStatsSum(t *testing.T) {
+	m := memStore(t,
+		entry("/m/", "dir", 0), entry("/m/a.jpg", "image", 10), entry("/m/b.jpg", "image", 20),
+		entry("/m/s/", "dir", 0), entry("/m/s/c.mkv", "video", 300), entry("/m2/d.jpg", "image", 4),
+	)
+	type sums map[string][2]uint64 // count, bytes
+	tests := []struct {
+		paths []string
+		want  sums
+	}{
+		{[]string{"/m/*"}, sums{"dir": {2, 0}, "image": {2, 30}, "video": {1, 300}, "total": {5, 330}}},
+		{[]string{"/m/"}, sums{"dir": {1, 0}, "image": {2, 30}, "total": {3, 30}}},
+		{[]string{"/m*/*.jpg"}, sums{"image": {3, 34}, "total": {3, 34}}},
+		{[]string{"/m/s/*", "/m2/*", "/m/s/c.mkv"}, sums{"dir": {1, 0}, "image": {1, 4}, "video": {1, 300}, "total": {3, 304}}},
+		{[]string{"/none/*"}, sums{}},
+	}
+	for _, tt := range tests {
+		fts, err := m.FTStatsSum(tt.paths)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		got := make(sums)
+		for k, ft := range fts {
+			got[k] = [2]uint64{uint64(ft.FileCount), ft.NumBytes}
+		}
+		if !cmp.Equal(got, tt.want) {
+			t.Errorf("FTStatsSum(%v): %s", tt.paths, cmp.Diff(tt.want, got))
+		}
+	}
+}
+
+func TestMemStore_Mutations(t *testing.T) {
+	m := memStore(t,
+		entry("/m/", "dir", 0), entry("/m/a/", "dir", 0), entry("/m/a/1", "other", 1), entry("/m/a/2.zip", "archive", 2),
+		entry("/m/b/", "dir", 0), entry("/m/b/3", "other", 3), entry("/m/c", "other", 4),
+	)
+	check := func(step string, want ...string) {
+		t.Helper()
+		want = append([]string{}, want...) // not nil, like the dump
+		sort.Strings(want)
+		if got := memPaths(t, m, "/*"); !cmp.Equal(got, want) {
+			t.Errorf("after %s: %s", step, cmp.Diff(want, got))
+		}
+	}
+
+	fst, err := m.GetFileStat("/m/a/2.zip")
+	if err != nil || fst == nil || fst.Ext != "zip" || fst.FileCount != 1 || fst.AllocBytes != 2 {
+		t.Errorf("GetFileStat() = %+v, %v; want the normalised record", fst, err)
+	}
+
+	if err := m.UpdateFilePath("/m/a/", "/m/b"); err != nil {
+		t.Fatal(err.Error())
+	}
+	check("moving a dir over another", "/m/", "/m/b/", "/m/b/1", "/m/b/2.zip", "/m/c")
+
+	if err := m.UpdateFilePath("/m/c", "/m/b/1"); err != nil {
+		t.Fatal(err.Error())
+	}
+	check("moving a file over another", "/m/", "/m/b/", "/m/b/1", "/m/b/2.zip")
+
+	if n, err := m.PurgeExcluded("/m/", func(p string, isDir bool, size uint64) bool { return p == "/m/b/2.zip" }); n != 1 || err != nil {
+		t.Errorf("PurgeExcluded() = %d, %v; want 1", n, err)
+	}
+	check("purge", "/m/", "/m/b/", "/m/b/1")
+
+	if err := m.UpdateFileStat(&types.FileStat{FTypeStat: types.FTypeStat{Path: "/m/new", FType: "other"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := m.DeleteOlderThanWithPrefix(time.Now().Add(-time.Hour), "/m"); err != nil {
+		t.Fatal(err.Error())
+	}
+	check("deleting nothing older", "/m/", "/m/b/", "/m/b/1", "/m/new")
+
+	if isDir, n, err := m.DeleteFileStatsTree("/m/b"); !isDir || n != 2 || err != nil {
+		t.Errorf("DeleteFileStatsTree() = %v, %d, %v; want true, 2", isDir, n, err)
+	}
+	check("deleting a tree", "/m/", "/m/new")
+
+	if err := m.DeleteOlderThanWithPrefix(time.Now().Add(time.Hour), "/m"); err != nil {
+		t.Fatal(err.Error())
+	}
+	check("deleting all older")
+}
@@ -0,0 +1,76 @@
+// Package store defines the storage backend of the file type stats maintained by TreeStatsWatcher and read by treestatsquery.
+// ftsdb.FileTypeStatsDB is the sqlite implementation, MemStore a pure in-memory one (without cgo).
+package store
+
+import (
+	"time"
+
+	"github.com/Rainc1oud/filetypestats/types"
+)
+
+// Store holds one record per file and dir, with dirs stored with a trailing separator.
+// Paths are selected by patterns as described for ftsdb.FileTypeStatsDB.FTStatsSum.
+type Store interface {
+	// GetFileStat returns the stored record for path, or nil (without error) if path is not stored
+	GetFileStat(path string) (*types.FileStat, error)
+	// UpdateFileStat upserts the file with all its metadata
+	UpdateFileStat(fst *types.FileStat) error
+	// UpdateFileStatMulti adds fst to batch and commits the batch when it is full
+	UpdateFileStatMulti(fst *types.FileStat, batch *types.FTypeStatsBatch) error
+	// CommitBatch upserts all records of batch at once and empties it
+	CommitBatch(batch *types.FTypeStatsBatch) error
+	// UpdateFilePath moves the file, or the dir with its subtree if from has a trailing separator, replacing what was at to
+	UpdateFilePath(from, to string) error
+	// DeleteFileStatsTree deletes path (with its subtree if "path/" exists), it reports whether path was a dir and how many entries were deleted
+	DeleteFileStatsTree(path string) (isDir bool, n int64, err error)
+	// DeleteOlderThanWithPrefix deletes all entries under prefix (taken literally) not updated since t
+	DeleteOlderThanWithPrefix(t time.Time, prefix string) error
+	// PurgeExcluded deletes all entries under prefix for which excluded returns true, dirs with their subtree
+	PurgeExcluded(prefix string, excluded func(path string, isDir bool, size uint64) bool) (int64, error)
+	// FTStatsSum returns the totals per file class of the entries selected by paths
+	FTStatsSum(paths []string) (types.FileTypeStats, error)
+	// FTStatsSumWith is FTStatsSum, summed as specified by opts
+	FTStatsSumWith(paths []string, opts types.SumOptions) (types.FileTypeStats, error)
+	// FTDumpFileStats returns the records of all entries selected by paths
+	FTDumpFileStats(paths []string) ([]types.FileStat, error)
+}
+
+// Snapshotter is implemented by stores which record snapshots of the totals of a root dir
+type Snapshotter interface {
+	TakeSnapshot(root string) (*types.Snapshot, error)
+}
+
+// HashStore is implemented by stores which keep the content digests of the duplicate detection (see filetypestats.Dedup)
+type HashStore interface {
+	// DedupCandidates returns the files selected by paths grouped by size, for sizes with more than one file
+	DedupCandidates(paths []string) ([][]types.FileHash, error)
+	UpdateFileHashes(hashes []types.FileHash) error
+	// PruneFileHashes deletes the digests of files which are not stored anymore
+	PruneFileHashes() (int64, error)
+}
+
+// TopLister is implemented by stores which rank the largest files and dirs
+type TopLister interface {
+	// TopFiles returns the n largest files selected by paths and filter, largest first (n <= 0: all)
+	TopFiles(paths []string, n int, filter types.FileFilter) ([]types.FTypeStat, error)
+	// TopDirs returns the n dirs selected by paths with the most bytes of category (recursively), largest first
+	TopDirs(paths []string, n int, category string, depth int) ([]types.FTypeStat, error)
+}
+
+// SizeHistogrammer is implemented by stores which count the file sizes in buckets
+type SizeHistogrammer interface {
+	SizeHistogram(paths []string, bounds []uint64) (types.SizeHistogram, error)
+}
+
+// SnapshotReader is implemented by stores which return the recorded snapshots (see Snapshotter)
+type SnapshotReader interface {
+	// Snapshots returns the snapshots of root taken between since and until (zero: unbounded), oldest first
+	Snapshots(root string, since, until time.Time) ([]types.Snapshot, error)
+	// SnapshotDelta returns the growth per type of root from t1 to t2
+	SnapshotDelta(root string, t1, t2 time.Time) (types.FileTypeStatsDelta, error)
+}
+
+// DuplicateFinder is implemented by stores which group the identical files found by the duplicate detection (see HashStore)
+type DuplicateFinder interface {
+	Duplicates(paths []string) (types.DupGroups, error)
+}
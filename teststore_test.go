@@ -0,0 +1,27 @@
+package filetypestats
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Rainc1oud/filetypestats/store"
+)
+
+// testStores are the stores the tests can run on, selected by name with $FILETYPESTATS_TEST_STORE
+// The default is the MemStore, so the tests run without cgo; the sqlite store is added with cgo (see sqlite_test.go).
+var testStores = map[string]func(t testing.TB) store.Store{
+	"mem": func(testing.TB) store.Store { return store.NewMemStore() },
+}
+
+// tmpStore returns an empty store of the kind selected with $FILETYPESTATS_TEST_STORE
+func tmpStore(t testing.TB) store.Store {
+	name := os.Getenv("FILETYPESTATS_TEST_STORE")
+	if name == "" {
+		name = "mem"
+	}
+	newStore, ok := testStores[name]
+	if !ok {
+		t.Fatalf("unknown test store %q", name)
+	}
+	return newStore(t)
+}
@@ -2,14 +2,18 @@ package treestatsquery
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/Rainc1oud/filetypestats/ftsdb"
+	"github.com/Rainc1oud/filetypestats/store"
 	"github.com/Rainc1oud/filetypestats/types"
 )
 
 // query functions for the file info DB generated and maintained by TreeStatsWatcher
 // this is a static package (no object instantiation), since we rely on one-off on-demand queries
 // and don't need/want to hold state
+// The *DB variants work on any store.Store, the queries beyond the sums need a store which implements the respective interface
+// of package store (e.g. store.TopLister), which the sqlite store does; the others return an error
 
 // FTStatsSum returns the summary FileTypeStats for the given paths as a map of FTypeStat per File Type
 // Paths can be files or directories. The summary is counted like this for the respective path format
@@ -32,17 +36,191 @@ func FTStatsSum(dbfile string, paths []string) (types.FileTypeStats, error) {
 	return res, err
 }
 
-func FTStatsSumDB(dbconn *ftsdb.FileTypeStatsDB, paths []string) (types.FileTypeStats, error) {
-	var err error
-	if dbconn == nil {
-		err = fmt.Errorf("invalid: dbconn=nil")
-	} else if !dbconn.IsOpened {
-		err = fmt.Errorf("dbconn is not open")
-	}
-	if err != nil {
+func FTStatsSumDB(dbconn store.Store, paths []string) (types.FileTypeStats, error) {
+	if err := checkDB(dbconn); err != nil {
 		return types.FileTypeStats{}, err
 	}
 
 	res, err := dbconn.FTStatsSum(paths)
 	return res, err
 }
+
+// FTStatsSumBy returns the summary FileTypeStats for the given paths (same format as for FTStatsSum) grouped by groupBy
+// (file class, extension or MIME type, see ftsdb.FileTypeStatsDB.FTStatsSumBy)
+func FTStatsSumBy(dbfile string, paths []string, groupBy types.GroupBy) (types.FileTypeStats, error) {
+	fdb, err := ftsdb.New(dbfile, false)
+	if err != nil {
+		return types.FileTypeStats{}, err
+	}
+	defer fdb.Close()
+
+	return fdb.FTStatsSumBy(paths, groupBy)
+}
+
+func FTStatsSumByDB(dbconn store.Store, paths []string, groupBy types.GroupBy) (types.FileTypeStats, error) {
+	if err := checkDB(dbconn); err != nil {
+		return types.FileTypeStats{}, err
+	}
+	return dbconn.FTStatsSumWith(paths, types.SumOptions{GroupBy: groupBy})
+}
+
+// FTStatsSumWith returns the summary FileTypeStats for the given paths (same format as for FTStatsSum) summed as specified by opts,
+// e.g. with the unique bytes of hardlinked files (see ftsdb.FileTypeStatsDB.FTStatsSumWith)
+func FTStatsSumWith(dbfile string, paths []string, opts types.SumOptions) (types.FileTypeStats, error) {
+	fdb, err := ftsdb.New(dbfile, false)
+	if err != nil {
+		return types.FileTypeStats{}, err
+	}
+	defer fdb.Close()
+
+	return fdb.FTStatsSumWith(paths, opts)
+}
+
+func FTStatsSumWithDB(dbconn store.Store, paths []string, opts types.SumOptions) (types.FileTypeStats, error) {
+	if err := checkDB(dbconn); err != nil {
+		return types.FileTypeStats{}, err
+	}
+	return dbconn.FTStatsSumWith(paths, opts)
+}
+
+// TopFiles returns the n largest files selected by paths (same format as for FTStatsSum) and filter, largest first
+// filter selects by category and size, its zero value selects all files; n <= 0 returns all files
+func TopFiles(dbfile string, paths []string, n int, filter types.FileFilter) ([]types.FTypeStat, error) {
+	fdb, err := ftsdb.New(dbfile, false)
+	if err != nil {
+		return nil, err
+	}
+	defer fdb.Close()
+
+	return fdb.TopFiles(paths, n, filter)
+}
+
+func TopFilesDB(dbconn store.Store, paths []string, n int, filter types.FileFilter) ([]types.FTypeStat, error) {
+	tl, err := supported[store.TopLister](dbconn, "TopFiles")
+	if err != nil {
+		return nil, err
+	}
+	return tl.TopFiles(paths, n, filter)
+}
+
+// TopDirs returns the n dirs selected by paths (same format as for FTStatsSum) with the most bytes of category (recursively), largest first
+// category "" ranks by the total of all categories
+// depth > 0 only returns dirs at most depth levels below the dir part of the path, e.g. path="/my/dir/*", depth=1 => /my/dir/ and its subdirs
+func TopDirs(dbfile string, paths []string, n int, category string, depth int) ([]types.FTypeStat, error) {
+	fdb, err := ftsdb.New(dbfile, false)
+	if err != nil {
+		return nil, err
+	}
+	defer fdb.Close()
+
+	return fdb.TopDirs(paths, n, category, depth)
+}
+
+func TopDirsDB(dbconn store.Store, paths []string, n int, category string, depth int) ([]types.FTypeStat, error) {
+	tl, err := supported[store.TopLister](dbconn, "TopDirs")
+	if err != nil {
+		return nil, err
+	}
+	return tl.TopDirs(paths, n, category, depth)
+}
+
+// SizeHistogram returns the histogram of the file sizes per type for the given paths (same format as for FTStatsSum)
+// bounds are the ascending bucket bounds, nil gives one bucket per power of 2 (see ftsdb.FileTypeStatsDB.SizeHistogram)
+func SizeHistogram(dbfile string, paths []string, bounds []uint64) (types.SizeHistogram, error) {
+	fdb, err := ftsdb.New(dbfile, false)
+	if err != nil {
+		return nil, err
+	}
+	defer fdb.Close()
+
+	return fdb.SizeHistogram(paths, bounds)
+}
+
+func SizeHistogramDB(dbconn store.Store, paths []string, bounds []uint64) (types.SizeHistogram, error) {
+	sh, err := supported[store.SizeHistogrammer](dbconn, "SizeHistogram")
+	if err != nil {
+		return nil, err
+	}
+	return sh.SizeHistogram(paths, bounds)
+}
+
+// Snapshots returns the snapshots of the dir root taken between since and until (zero: unbounded), oldest first
+func Snapshots(dbfile string, root string, since, until time.Time) ([]types.Snapshot, error) {
+	fdb, err := ftsdb.New(dbfile, false)
+	if err != nil {
+		return nil, err
+	}
+	defer fdb.Close()
+
+	return fdb.Snapshots(root, since, until)
+}
+
+func SnapshotsDB(dbconn store.Store, root string, since, until time.Time) ([]types.Snapshot, error) {
+	sr, err := supported[store.SnapshotReader](dbconn, "Snapshots")
+	if err != nil {
+		return nil, err
+	}
+	return sr.Snapshots(root, since, until)
+}
+
+// SnapshotDelta returns the growth per type of the dir root from t1 to t2 according to its snapshots
+func SnapshotDelta(dbfile string, root string, t1, t2 time.Time) (types.FileTypeStatsDelta, error) {
+	fdb, err := ftsdb.New(dbfile, false)
+	if err != nil {
+		return nil, err
+	}
+	defer fdb.Close()
+
+	return fdb.SnapshotDelta(root, t1, t2)
+}
+
+func SnapshotDeltaDB(dbconn store.Store, root string, t1, t2 time.Time) (types.FileTypeStatsDelta, error) {
+	sr, err := supported[store.SnapshotReader](dbconn, "SnapshotDelta")
+	if err != nil {
+		return nil, err
+	}
+	return sr.SnapshotDelta(root, t1, t2)
+}
+
+// Duplicates returns the groups of identical files for the given paths (same format as for FTStatsSum), largest waste first
+// The result is only as recent as the last dedup pass (see filetypestats.Dedup)
+func Duplicates(dbfile string, paths []string) (types.DupGroups, error) {
+	fdb, err := ftsdb.New(dbfile, false)
+	if err != nil {
+		return nil, err
+	}
+	defer fdb.Close()
+
+	return fdb.Duplicates(paths)
+}
+
+func DuplicatesDB(dbconn store.Store, paths []string) (types.DupGroups, error) {
+	df, err := supported[store.DuplicateFinder](dbconn, "Duplicates")
+	if err != nil {
+		return nil, err
+	}
+	return df.Duplicates(paths)
+}
+
+// supported returns dbconn as the interface I of the query, or an error if it isn't valid or doesn't implement I
+func supported[I any](dbconn store.Store, query string) (I, error) {
+	var none I
+	if err := checkDB(dbconn); err != nil {
+		return none, err
+	}
+	i, ok := dbconn.(I)
+	if !ok {
+		return none, fmt.Errorf("%s is unsupported by %T", query, dbconn)
+	}
+	return i, nil
+}
+
+func checkDB(dbconn store.Store) error {
+	fdb, isSqlite := dbconn.(*ftsdb.FileTypeStatsDB)
+	if dbconn == nil || (isSqlite && fdb == nil) {
+		return fmt.Errorf("invalid: dbconn=nil")
+	} else if isSqlite && !fdb.IsOpened {
+		return fmt.Errorf("dbconn is not open")
+	}
+	return nil
+}
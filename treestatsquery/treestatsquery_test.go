@@ -0,0 +1,38 @@
+package treestatsquery
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Rainc1oud/filetypestats/store"
+	"github.com/Rainc1oud/filetypestats/types"
+)
+
+func TestQueriesDB_Unsupported(t *testing.T) {
+	m := store.NewMemStore()
+	if err := m.UpdateFileStat(&types.FileStat{FTypeStat: types.FTypeStat{Path: "/m/f", FType: "video", NumBytes: 3}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got, err := FTStatsSumDB(m, []string{"/m/*"}); err != nil || got["total"].FileCount != 1 {
+		t.Errorf("FTStatsSumDB() = %v, %v", got, err)
+	}
+
+	// the queries the store doesn't implement fail clearly instead of requiring the sqlite store
+	queries := map[string]func() error{
+		"TopFiles":      func() error { _, err := TopFilesDB(m, []string{"/m/*"}, 1, types.FileFilter{}); return err },
+		"TopDirs":       func() error { _, err := TopDirsDB(m, []string{"/m/*"}, 1, "", 0); return err },
+		"SizeHistogram": func() error { _, err := SizeHistogramDB(m, []string{"/m/*"}, nil); return err },
+		"Snapshots":     func() error { _, err := SnapshotsDB(m, "/m", time.Time{}, time.Time{}); return err },
+		"SnapshotDelta": func() error { _, err := SnapshotDeltaDB(m, "/m", time.Time{}, time.Now()); return err },
+		"Duplicates":    func() error { _, err := DuplicatesDB(m, []string{"/m/*"}); return err },
+	}
+	for name, query := range queries {
+		if err := query(); err == nil || !strings.Contains(err.Error(), name+" is unsupported by *store.MemStore") {
+			t.Errorf("%sDB() error = %v", name, err)
+		}
+	}
+	if _, err := TopFilesDB(nil, nil, 1, types.FileFilter{}); err == nil {
+		t.Error("TopFilesDB(nil) didn't fail")
+	}
+}
@@ -1,21 +1,20 @@
 package filetypestats
 
-// TODO: allow to optionally only do direct scan, without db or inotify, to supersede legacy code
-
 import (
+	"context"
 	"fmt"
-	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/Rainc1oud/filetype"
-	"github.com/Rainc1oud/filetypestats/ftsdb"
+	"github.com/Rainc1oud/filetypestats/exclude"
 	"github.com/Rainc1oud/filetypestats/notifywatch"
+	"github.com/Rainc1oud/filetypestats/store"
 	"github.com/Rainc1oud/filetypestats/types"
 	"github.com/Rainc1oud/filetypestats/utils"
 	ggu "github.com/Rainc1oud/gogenutils"
-	"github.com/karrick/godirwalk"
 	"github.com/rjeczalik/notify"
 	"golang.org/x/sys/unix"
 )
@@ -24,39 +23,91 @@ var defaultNotifyEvents = []notify.Event{notify.InCreate, notify.InModify, notif
 
 const pathInfoBatchSize = 200
 
-type tMoveInfo struct {
-	From string
-	To   string
+// DefaultRescanDelay is the time to wait after an event queue overflow before rescanning the affected dir
+// Every further overflow within this time postpones the rescan, so a bulk copy causes only one rescan when it's done
+const DefaultRescanDelay = 10 * time.Second
+
+// removedDirsTTL is how long a removed dir is remembered to skip the remove events of its children
+const removedDirsTTL = 10 * time.Second
+
+// tRemovedDirs maps recently removed dirs (with trailing separator) to the time of their removal
+// A recursive delete produces remove events for all children, which can arrive after the dir's own event
+// (e.g. from the watches of subdirs) and are redundant, because the dir was removed with its whole subtree
+type tRemovedDirs map[string]time.Time
+
+func (rd tRemovedDirs) add(dir string, now time.Time) {
+	for d, t := range rd { // expire old entries
+		if now.Sub(t) > removedDirsTTL {
+			delete(rd, d)
+		}
+	}
+	rd[utils.DirTrailSep(dir)] = now
+}
+
+// covers reports whether path is (under) a recently removed dir
+func (rd tRemovedDirs) covers(path string) bool {
+	p := utils.DirTrailSep(path)
+	for d, t := range rd {
+		if strings.HasPrefix(p, d) && time.Since(t) <= removedDirsTTL {
+			return true
+		}
+	}
+	return false
+}
+
+// forget drops the removed dirs containing path or under path, because path (re)appeared
+func (rd tRemovedDirs) forget(path string) {
+	p := utils.DirTrailSep(path)
+	for d := range rd {
+		if strings.HasPrefix(p, d) || strings.HasPrefix(d, p) {
+			delete(rd, d)
+		}
+	}
 }
-type tMoveMap map[uint32]*tMoveInfo
+
 type TreeStatsWatcher struct {
-	TDirMonitors     // embed this map, because a TreeStatsWatcher is just TDirMonitors with added state
+	*TDirMonitors    // embed the registry, because a TreeStatsWatcher is just TDirMonitors with added state
 	lastScanDuration time.Duration
-	moves            tMoveMap
-	ftsDB            *ftsdb.FileTypeStatsDB
+	moves            *movePairer
+	removed          tRemovedDirs
+	db               store.Store
 	eventHandler     notifywatch.NotifyHandlerFun
+	errorHandler     notifywatch.NotifyErrorFun
 	wg               *sync.WaitGroup
-	batchBuffer      *types.FTypeStatsBatch // as TSW attribute and not instantiated in e.g. Scan() because it's probably less load on GC
+	evmu             *sync.Mutex // serialises event handling and the handling of expired moves
+	mu               *sync.Mutex // guards lastScanDuration and the settings below
+	scanOpts         ScanOptions
+	rescanDelay      time.Duration
+	overflowBacklog  int
+	stopSnapshots    chan struct{} // stops the periodic snapshots, nil if not running
 }
 
 // NewTreeStatsWatcher is the top level constructor featuring:
 //   - a recursive watcher and scanner for all files in the given param dirs
-//   - a sqlite DB session (param database: file name)
+//   - a store for the file stats (param db), normally the sqlite *ftsdb.FileTypeStatsDB
 //
 // An instance is always returned, even if an error occurred
 // dirs will be trimmed of trailing suffixes and evaluated recursively
 // If dirs is empty, you can add watches later with AddWatch() or AddDir()
-func NewTreeStatsWatcher(dirs []string, dbconn *ftsdb.FileTypeStatsDB) (*TreeStatsWatcher, error) {
+func NewTreeStatsWatcher(dirs []string, db store.Store) (*TreeStatsWatcher, error) {
 	tsw := &TreeStatsWatcher{
-		*NewDirMonitors(),
+		NewDirMonitors(),
 		time.Duration(0),
-		make(tMoveMap),
-		dbconn,
 		nil,
+		make(tRemovedDirs),
+		db,
+		nil,
+		notifywatch.StderrErrorHandler,
 		&sync.WaitGroup{},
-		types.NewFTypeStatsBatch(pathInfoBatchSize),
+		&sync.Mutex{},
+		&sync.Mutex{},
+		ScanOptions{},
+		DefaultRescanDelay,
+		notifywatch.DefaultOverflowBacklog,
+		nil,
 	}
 	tsw.eventHandler = tsw.onFileChanged // set default event handler
+	tsw.moves = newMovePairer(DefaultMoveTimeout, tsw.onMoveExpired)
 	err := tsw.AddWatch(dirs...)
 	return tsw, err // always return a valid watcher instance, we can add dirs and use other features later
 }
@@ -67,12 +118,103 @@ func NewTreeStatsWatcher(dirs []string, dbconn *ftsdb.FileTypeStatsDB) (*TreeSta
 func (tsw *TreeStatsWatcher) AddWatch(dirs ...string) error {
 	errs := ggu.NewErrors()
 	for _, d := range dirs {
-		tsw.AddDir(d, true, tsw.onFileChanged, defaultNotifyEvents...) // TBC: do we need to make this configurable on a higher level?
+		if m := tsw.AddDir(d, true, tsw.eventHandler, defaultNotifyEvents...); m != nil { // TBC: do we need to make this configurable on a higher level?
+			tsw.mu.Lock()
+			m.SetErrorHandler(tsw.errorHandler)
+			tsw.setOverflowHandler(d, m)
+			tsw.mu.Unlock()
+		}
 		errs.AddIf(tsw.ScanDirAsync(d))
 	}
 	return errs.Err()
 }
 
+// SetErrorHandler sets the sink receiving errors from the event handler for all current and future watches,
+// running watches included (nil: notifywatch.StderrErrorHandler, the default)
+// Errors from handling moves in or out of the tree are reported after the move timeout, with a nil event
+func (tsw *TreeStatsWatcher) SetErrorHandler(errorHandler notifywatch.NotifyErrorFun) {
+	if errorHandler == nil {
+		errorHandler = notifywatch.StderrErrorHandler
+	}
+	tsw.mu.Lock()
+	defer tsw.mu.Unlock()
+	tsw.errorHandler = errorHandler
+	tsw.each(func(_ string, m *TDirMonitor) {
+		m.SetErrorHandler(errorHandler)
+	})
+}
+
+// SetMoveTimeout sets how long the first half of a move waits for its second half (<= 0: DefaultMoveTimeout)
+// After the timeout, a path moved away is deleted and a path moved in is scanned
+func (tsw *TreeStatsWatcher) SetMoveTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultMoveTimeout
+	}
+	tsw.moves.setTimeout(timeout)
+}
+
+// SetOverflowRescan configures the overflow handling for all current and future watches
+// A watch is considered overflowed when backlog events are queued (<= 0: notifywatch.DefaultOverflowBacklog),
+// the affected dir is then rescanned incrementally after delay (<= 0: DefaultRescanDelay)
+// Running watches apply it from their next event on
+func (tsw *TreeStatsWatcher) SetOverflowRescan(delay time.Duration, backlog int) {
+	if delay <= 0 {
+		delay = DefaultRescanDelay
+	}
+	tsw.mu.Lock()
+	defer tsw.mu.Unlock()
+	tsw.rescanDelay = delay
+	tsw.overflowBacklog = backlog
+	tsw.each(func(d string, m *TDirMonitor) {
+		tsw.setOverflowHandler(d, m)
+	})
+}
+
+// setOverflowHandler sets the overflow handler of m, the caller must hold tsw.mu
+func (tsw *TreeStatsWatcher) setOverflowHandler(dir string, m *TDirMonitor) {
+	m.SetOverflowHandler(func() { tsw.onOverflow(dir) }, tsw.overflowBacklog)
+}
+
+// onOverflow is called when events for dir got lost
+// It marks dir dirty and schedules an incremental rescan, so the DB converges again without intervention
+func (tsw *TreeStatsWatcher) onOverflow(dir string) {
+	tsw.Overflow(dir)
+	tsw.scheduleRescan(dir)
+}
+
+// scheduleRescan (re)starts the rescan timer for dir
+func (tsw *TreeStatsWatcher) scheduleRescan(dir string) {
+	tsw.mu.Lock()
+	delay := tsw.rescanDelay
+	tsw.mu.Unlock()
+	tsw.withMonitor(dir, func(m *TDirMonitor) {
+		if m.rescanTimer != nil {
+			m.rescanTimer.Reset(delay)
+			return
+		}
+		m.rescanTimer = time.AfterFunc(delay, func() { tsw.rescan(dir) })
+	})
+}
+
+// rescan does the incremental rescan of dir after an overflow
+func (tsw *TreeStatsWatcher) rescan(dir string) {
+	running := false
+	if !tsw.withMonitor(dir, func(m *TDirMonitor) {
+		if running = m.scanRunning(); !running {
+			m.rescanPending = false
+		}
+	}) {
+		return
+	}
+	if running { // the running scan may have passed the paths of the lost events already
+		tsw.scheduleRescan(dir)
+		return
+	}
+	opts := tsw.scanOptions()
+	opts.Incremental = true
+	_ = tsw.ScanDirContext(context.Background(), dir, opts) // an interrupted scan leaves dir dirty, which is all we can do here
+}
+
 // WatchAll starts all registered dirs with the notify watcher (ignoring already started ones)
 func (tsw *TreeStatsWatcher) WatchAll() error {
 	errs := ggu.NewErrors()
@@ -86,9 +228,10 @@ func (tsw *TreeStatsWatcher) WatchAll() error {
 // StopAll stops all registered dirs with the notify watcher
 func (tsw *TreeStatsWatcher) StopWatchAll() error {
 	errs := ggu.NewErrors()
-	for _, v := range tsw.TDirMonitors {
-		errs.AddIf(v.Stop())
-	}
+	tsw.each(func(_ string, m *TDirMonitor) {
+		errs.AddIf(m.Stop())
+	})
+	tsw.moves.reset()
 	return errs.Err()
 }
 
@@ -102,19 +245,38 @@ func (tsw *TreeStatsWatcher) ScanAllSync() error {
 			errs.AddIf(fmt.Errorf("error [%s]: %s", d, err.Error()))
 		}
 	}
+	tsw.mu.Lock()
 	tsw.lastScanDuration = time.Since(tb)
-	// tsw.ftsDB.DeleteOlderThan(tsw.lastScanStarted) // delete all entries from before the scan (i.e. not updated during the scan, because this means they were deleted)
+	tsw.mu.Unlock()
+	// tsw.db.DeleteOlderThan(tsw.lastScanStarted) // delete all entries from before the scan (i.e. not updated during the scan, because this means they were deleted)
 	return errs.Err()
 }
 
+// SetScanOptions sets the options used by all following scans
+func (tsw *TreeStatsWatcher) SetScanOptions(opts ScanOptions) {
+	tsw.mu.Lock()
+	defer tsw.mu.Unlock()
+	tsw.scanOpts = opts
+}
+
+func (tsw *TreeStatsWatcher) scanOptions() ScanOptions {
+	tsw.mu.Lock()
+	defer tsw.mu.Unlock()
+	return tsw.scanOpts
+}
+
 // ScanDirAsync scans dir asynchronously
-// TODO: add channel to make interuption possible?
 func (tsw *TreeStatsWatcher) ScanDirAsync(dir string) error {
+	return tsw.ScanDirAsyncContext(context.Background(), dir, tsw.scanOptions())
+}
+
+// ScanDirAsyncContext scans dir asynchronously, the scan can be interrupted by cancelling ctx or with CancelScan(dir)
+func (tsw *TreeStatsWatcher) ScanDirAsyncContext(ctx context.Context, dir string, opts ScanOptions) error {
 	if tsw.ScanRunning(dir) {
 		return fmt.Errorf("warning: skipping scan of %s because it is already running", dir)
 	}
 	go func() {
-		tsw.ScanDir(dir)
+		tsw.ScanDirContext(ctx, dir, opts)
 	}()
 	return nil
 }
@@ -122,119 +284,297 @@ func (tsw *TreeStatsWatcher) ScanDirAsync(dir string) error {
 // scanDir scans the given dir recursively and updates the database
 // This can take a long time (minutes to hours) to complete
 func (tsw *TreeStatsWatcher) ScanDir(dir string) error {
+	return tsw.ScanDirContext(context.Background(), dir, tsw.scanOptions())
+}
 
-	if tsw.ScanRunning(dir) {
+// ScanDirContext scans the given dir recursively with opts and updates the database
+// The scan can be interrupted by cancelling ctx or with CancelScan(dir), in which case ctx.Err() is returned.
+// Entries that were not updated are only deleted from the database after a complete scan,
+// so an interrupted or failed scan (e.g. a batch that couldn't be written) never deletes entries for files it didn't reach.
+// After a complete scan the duplicates are hashed if opts.Dedup is set, and a snapshot of dir is taken (see ftsdb.FileTypeStatsDB.TakeSnapshot),
+// if the store supports them (see store.HashStore and store.Snapshotter).
+func (tsw *TreeStatsWatcher) ScanDirContext(ctx context.Context, dir string, opts ScanOptions) error {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if !tsw.scanStartIdle(dir, cancel) {
 		return fmt.Errorf("warning: skipping scan of %s because it is already running", dir)
 	}
 
-	tsw.ScanStart(dir)
-
-	err := godirwalk.Walk(dir, &godirwalk.Options{
-		AllowNonDirectory: true,
-		Callback: func(osPathname string, de *godirwalk.Dirent) error {
-			var (
-				err   error = nil
-				fi    fs.FileInfo
-				ftype string
-			)
-
-			if de.IsDir() {
-				ftype = "dir"
-				tsw.ftsDB.UpdateFileStatsMulti(osPathname+"/", ftype, 0, tsw.batchBuffer) // add / to make filtering more consistent in SELECT queries
-			} else if de.IsRegular() {
-				fi, err = os.Stat(osPathname)
-				if err == nil {
-					if ftype, err = filetype.FileClass(osPathname); err == nil {
-						tsw.ftsDB.UpdateFileStatsMulti(osPathname, ftype, uint64(fi.Size()), tsw.batchBuffer)
-						return nil
-					}
+	if opts.Exclude == nil {
+		opts.Exclude = tsw.excludeRules(dir)
+	}
+	tstart := time.Now()
+
+	err := newTreeScanner(tsw.db, dir, opts).scan(ctx)
+	if err == nil {
+		err = tsw.db.DeleteOlderThanWithPrefix(tstart, dir)
+	}
+	if err != nil || ctx.Err() != nil {
+		tsw.ScanAbort(dir)
+		return err
+	}
+	tsw.ScanFinish(dir)
+
+	if opts.Dedup {
+		hs, ok := tsw.db.(store.HashStore)
+		if !ok {
+			return fmt.Errorf("%T doesn't support duplicate detection", tsw.db)
+		}
+		if err := Dedup(ctx, hs, []string{utils.GlobEscape(utils.JustDir(dir)) + "/*"}); err != nil {
+			return err
+		}
+	}
+	if snap, ok := tsw.db.(store.Snapshotter); ok {
+		_, err = snap.TakeSnapshot(dir)
+	}
+	return err
+}
+
+// SnapshotAll takes a snapshot of all registered dirs, except those being scanned (they get one when their scan completes)
+func (tsw *TreeStatsWatcher) SnapshotAll() error {
+	snap, ok := tsw.db.(store.Snapshotter)
+	if !ok {
+		return fmt.Errorf("%T doesn't support snapshots", tsw.db)
+	}
+	errs := ggu.NewErrors()
+	for _, d := range tsw.Dirs() {
+		if tsw.ScanRunning(d) {
+			continue
+		}
+		if _, err := snap.TakeSnapshot(d); err != nil {
+			errs.AddIf(fmt.Errorf("error [%s]: %s", d, err.Error()))
+		}
+	}
+	return errs.Err()
+}
+
+// SetSnapshotInterval takes snapshots of all registered dirs every interval (see SnapshotAll), interval <= 0 stops it
+// Errors are passed to the error handler (see SetErrorHandler) with a nil event
+func (tsw *TreeStatsWatcher) SetSnapshotInterval(interval time.Duration) {
+	tsw.mu.Lock()
+	defer tsw.mu.Unlock()
+	if tsw.stopSnapshots != nil {
+		close(tsw.stopSnapshots)
+		tsw.stopSnapshots = nil
+	}
+	if interval <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	tsw.stopSnapshots = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := tsw.SnapshotAll(); err != nil {
+					tsw.reportError(err)
 				}
 			}
+		}
+	}()
+}
 
-			if err != nil {
-				fmt.Fprint(os.Stderr, err.Error())
-			}
-			return nil
-		},
-		Unsorted: true, // (optional) set true for faster yet non-deterministic enumeration (see godoc)
-		ErrorCallback: func(s string, e error) godirwalk.ErrorAction {
-			// fmt.Fprintf(os.Stderr, "warning: %s reading %s\n", e.Error(), s)
-			return godirwalk.SkipNode
-		},
-	})
+// SetExcludeRules sets the exclusion rules for the watched root dir and purges all entries they exclude from the DB
+// Patterns are relative to root, see package exclude for the syntax
+// Note that excluded dirs are still watched by notify (which doesn't support exclusions), but their events are ignored
+func (tsw *TreeStatsWatcher) SetExcludeRules(root string, opts exclude.Options) error {
+	rules, err := exclude.New(root, opts)
+	if err != nil {
+		return err
+	}
+	if !tsw.withMonitor(root, func(m *TDirMonitor) { m.excludeRules = rules }) {
+		return fmt.Errorf("can't set exclude rules for %s, it is not watched", root)
+	}
+	_, err = tsw.db.PurgeExcluded(root, rules.Excluded)
+	return err
+}
 
-	tsw.ftsDB.CommitBatch(tsw.batchBuffer) // commit any "in-flight" batch
-	tsw.ftsDB.DeleteOlderThanWithPrefix(tsw.ScanStarted(dir), dir)
-	tsw.ScanFinish(dir)
+// excludeRules returns the exclusion rules of the watched root containing path
+func (tsw *TreeStatsWatcher) excludeRules(path string) *exclude.Rules {
+	return tsw.excludeRulesFor(path)
+}
 
+// eventFTStat returns the FileStat for path, or nil without error if path is excluded
+func (tsw *TreeStatsWatcher) eventFTStat(path string) (*types.FileStat, error) {
+	fi, err := os.Lstat(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	if tsw.excludeRules(path).Excluded(path, fi.IsDir(), uint64(fi.Size())) {
+		return nil, nil
+	}
+	return fileInfoFTStat(path, fi)
 }
 
 // onFileChanged is the inotify event handler passed to the notify watcher
 // for now we handle create, remove, write (this is like modify but guaranteed on all platforms)
 func (tsw *TreeStatsWatcher) onFileChanged(eventInfo *notify.EventInfo) error {
-	cookie := (*eventInfo).Sys().(*unix.InotifyEvent).Cookie // this is a kind of hash to relate the From event to the To event
-	minfo, ok := tsw.moves[cookie]
-	if !ok {
-		minfo = &tMoveInfo{}
-		tsw.moves[cookie] = minfo
-	}
+	tsw.evmu.Lock()
+	defer tsw.evmu.Unlock()
+	path := (*eventInfo).Path()
 	switch (*eventInfo).Event() {
 	case notify.InCreate, notify.InModify:
-		if minfo.From == "" && minfo.To == "" { // only execute create if not already moving
-			if fts, err := getFTStat((*eventInfo).Path()); err == nil {
-				return tsw.ftsDB.UpdateFileStats(fts.Path, fts.FType, fts.NumBytes)
+		tsw.removed.forget(path)
+		if fst, err := tsw.eventFTStat(path); err == nil {
+			if fst == nil { // excluded
+				return nil
 			}
+			if err := tsw.db.UpdateFileStat(fst); err != nil || !expandable(fst.MIME) {
+				return err
+			}
+			return tsw.deleteMembers(path)
 		} // any stat errors are simply ignored
-	case notify.InMovedFrom:
-		minfo.From = (*eventInfo).Path()
-	case notify.InMovedTo:
-		minfo.To = (*eventInfo).Path()
-	case notify.Remove: // TODO: it is a real problem that we don't know whether it is a dir or a file?
-		if minfo.From == "" && minfo.To == "" { // only execute remove if not already moving
-			return tsw.ftsDB.DeleteFileStats((*eventInfo).Path())
+	case notify.InMovedFrom, notify.InMovedTo:
+		cookie := (*eventInfo).Sys().(*unix.InotifyEvent).Cookie // this is a kind of hash to relate the From event to the To event
+		var minfo tMoveInfo
+		var paired bool
+		if (*eventInfo).Event() == notify.InMovedFrom {
+			minfo, paired = tsw.moves.from(cookie, path)
+		} else {
+			tsw.removed.forget(path)
+			minfo, paired = tsw.moves.to(cookie, path)
+		}
+		if !paired { // we're in the middle of a move op, continue and await the second event (or the timeout)
+			return nil
 		}
+		return tsw.onMove(minfo)
+	case notify.Remove:
+		return tsw.onRemove(path)
 	}
+	return fmt.Errorf("unhandled event %v for %s", eventInfo, (*eventInfo).Path())
+}
 
-	if cookie != 0 && minfo.From != "" && minfo.To != "" {
-		// verrry important to make sure that a dir gets a trailing /, otherwise a file with a similar naome (or all dirs starting with the same name) would also be renamed in the DB!
-		// since we have no way to find out from the event whether the target is a dir, we have to stat it
-		fi, err := os.Lstat(minfo.To)
-		if err != nil {
-			return fmt.Errorf("couldn't get file info for moved target %s in event %v, not handling move", minfo.To, eventInfo)
-		}
-		if fi.IsDir() {
-			minfo.From = utils.DirTrailSep(minfo.From)
-			minfo.To = utils.DirTrailSep(minfo.To)
-		}
-		// log.Printf("updating DB for file move %s -> %s", minfo.From, minfo.To) // FIXME: uncontrolled logging
-		err = tsw.ftsDB.UpdateFilePath(minfo.From, minfo.To)
-		delete(tsw.moves, cookie)
+// onMove updates the DB for a move within the tree
+func (tsw *TreeStatsWatcher) onMove(minfo tMoveInfo) error {
+	// verrry important to make sure that a dir gets a trailing /, otherwise a file with a similar naome (or all dirs starting with the same name) would also be renamed in the DB!
+	// since we have no way to find out from the event whether the target is a dir, we have to stat it
+	fi, err := os.Lstat(minfo.To)
+	if err != nil {
+		return fmt.Errorf("couldn't get file info for moved target %s, not handling move from %s", minfo.To, minfo.From)
+	}
+	if tsw.excludeRules(minfo.From).Excluded(minfo.From, fi.IsDir(), uint64(fi.Size())) { // came out of hiding, like a move in
+		return tsw.scanSubtree(minfo.To)
+	}
+	if fi.IsDir() {
+		minfo.From = utils.DirTrailSep(minfo.From)
+		minfo.To = utils.DirTrailSep(minfo.To)
+	}
+	if tsw.excludeRules(minfo.To).Excluded(minfo.To, fi.IsDir(), uint64(fi.Size())) { // moved out of sight
+		return tsw.onRemove(utils.JustDir(minfo.From))
+	}
+	// log.Printf("updating DB for file move %s -> %s", minfo.From, minfo.To) // FIXME: uncontrolled logging
+	if err := tsw.db.UpdateFilePath(minfo.From, minfo.To); err != nil || fi.IsDir() {
+		return err
+	}
+	// the members of an archive move with it (those of the archives in a dir are moved with the dir)
+	if expanded, err := tsw.expanded(minfo.From); !expanded {
+		return err
+	}
+	return tsw.db.UpdateFilePath(FSPath(minfo.From, ".")+"/", FSPath(minfo.To, ".")+"/")
+}
+
+// onMoveExpired handles the half of a move which wasn't paired in time
+// A path moved out of the tree is deleted recursively, a path moved into the tree is scanned
+func (tsw *TreeStatsWatcher) onMoveExpired(minfo tMoveInfo) {
+	tsw.evmu.Lock()
+	defer tsw.evmu.Unlock()
+	var err error
+	if minfo.From != "" {
+		err = tsw.onRemove(minfo.From)
+	} else {
+		err = tsw.scanSubtree(minfo.To)
+	}
+	if err != nil {
+		tsw.reportError(err)
+	}
+}
+
+// reportError passes an error which isn't caused by a specific event to the error handler
+func (tsw *TreeStatsWatcher) reportError(err error) {
+	tsw.mu.Lock()
+	errorHandler := tsw.errorHandler
+	tsw.mu.Unlock()
+	errorHandler(nil, err)
+}
+
+// scanSubtree adds path to the DB, with everything under it if it's a dir, without deleting anything
+func (tsw *TreeStatsWatcher) scanSubtree(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
 		return err
 	}
-	if minfo.From != "" || minfo.To != "" { // we're in the middle of a move op, continue and await the second event
+	rules := tsw.excludeRules(path)
+	if rules.Excluded(path, fi.IsDir(), uint64(fi.Size())) {
 		return nil
 	}
-	return fmt.Errorf("unhandled event %v for %s", eventInfo, (*eventInfo).Path())
+	opts := tsw.scanOptions()
+	opts.Progress = nil
+	opts.Exclude = rules
+	return newTreeScanner(tsw.db, path, opts).scan(context.Background())
+}
+
+// onRemove deletes path from the DB, with its whole subtree if it was a dir
+// If a scan is running, the tree is rescanned afterwards, because the scan may store path again (see removedWhileScanning)
+// The event doesn't tell whether path was a dir, but the DB knows: dirs are stored with a trailing separator
+// Remove events for paths under a dir which was just removed are skipped
+func (tsw *TreeStatsWatcher) onRemove(path string) error {
+	if tsw.removed.covers(path) {
+		return nil
+	}
+	isDir, _, err := tsw.db.DeleteFileStatsTree(path)
+	if dir, scanning := tsw.removedWhileScanning(path); scanning {
+		tsw.scheduleRescan(dir)
+	}
+	if err == nil && isDir {
+		tsw.removed.add(path, time.Now())
+	} else if err == nil {
+		err = tsw.deleteMembers(path)
+	}
+	return err
+}
+
+// deleteMembers deletes the members of the archive path if it was expanded, they are restored by the next scan (see ArchiveOptions)
+func (tsw *TreeStatsWatcher) deleteMembers(path string) error {
+	if expanded, err := tsw.expanded(path); !expanded {
+		return err
+	}
+	_, _, err := tsw.db.DeleteFileStatsTree(FSPath(path, "."))
+	return err
+}
+
+// expanded reports whether the members of the archive path are stored, i.e. its root dir is stored as its member,
+// and not a dir on the filesystem with the same path (named like the archive followed by "!")
+func (tsw *TreeStatsWatcher) expanded(path string) (bool, error) {
+	if !tsw.scanOptions().Archives.Expand {
+		return false, nil
+	}
+	root, err := tsw.db.GetFileStat(FSPath(path, ".") + "/")
+	return err == nil && root != nil && root.Archive == filepath.Clean(path), err
 }
 
 // StartWatcher starts the dir watcher in the background (or returns an error if not available)
 func (tsw *TreeStatsWatcher) StartWatcher(dir string) error {
-	w, ok := tsw.TDirMonitors[dir]
-	if !ok {
+	var w *TDirMonitor
+	started := false
+	if !tsw.withMonitor(dir, func(m *TDirMonitor) {
+		w, started = m, m.watchStarted
+		m.watchStarted = true
+	}) {
 		return fmt.Errorf("refusing to start non-existing watcher for %s", dir)
 	}
-	if w.IsWatching() { // avoid starting a watcher that is already watching
+	if started { // avoid starting a watcher that is already watching
 		return fmt.Errorf("refusing to start already running watcher for %s", dir)
 	}
 	tsw.wg.Add(1)
 	go func() { // we can do without passing wg because it's a pointer we don't change?
 		_ = w.Watch() // TODO: error handling?
+		tsw.forget(dir, w)
 		tsw.wg.Done()
-		delete(tsw.TDirMonitors, dir)
 	}()
 	return nil
 }
@@ -242,7 +582,7 @@ func (tsw *TreeStatsWatcher) StartWatcher(dir string) error {
 // StopWatcher stops and removes the watcher for dir
 // (The DirMonitor is removed entirely, because we have no way to re-start a stopped watcher, so its existence becomes meaningless after stopping)
 func (tsw *TreeStatsWatcher) StopWatcher(dir string) error {
-	w, ok := tsw.TDirMonitors[dir]
+	w, ok := tsw.Get(dir)
 	if !ok {
 		return fmt.Errorf("refusing to stop non-existing watcher for %s", dir)
 	}
@@ -253,11 +593,13 @@ func (tsw *TreeStatsWatcher) StopWatcher(dir string) error {
 }
 
 func (tsw *TreeStatsWatcher) ScanDurationLast() time.Duration {
+	tsw.mu.Lock()
 	sd := tsw.lastScanDuration
-	for _, v := range tsw.TDirMonitors { // if a single dir scan duration was longer than the last full scan, we use the largest value
-		if sd < v.dlastscan {
-			sd = v.dlastscan
+	tsw.mu.Unlock()
+	tsw.each(func(_ string, m *TDirMonitor) { // if a single dir scan duration was longer than the last full scan, we use the largest value
+		if sd < m.dlastscan {
+			sd = m.dlastscan
 		}
-	}
+	})
 	return sd
 }
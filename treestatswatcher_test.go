@@ -0,0 +1,519 @@
+package filetypestats
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Rainc1oud/filetypestats/exclude"
+	"github.com/Rainc1oud/filetypestats/notifywatch"
+	"github.com/Rainc1oud/filetypestats/store"
+	"github.com/Rainc1oud/filetypestats/types"
+	"github.com/rjeczalik/notify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+const eventTimeout = 5 * time.Second
+
+// scanTimeout bounds the initial scans, which take much longer than an event for the large trees, especially with -race
+const scanTimeout = 2 * time.Minute
+
+// dbPaths returns all paths in the DB under dir with their info
+func dbPaths(t testing.TB, fdb store.Store, dir string) map[string]types.FTypeStat {
+	fsts, err := fdb.FTDumpFileStats([]string{dir + "/*"})
+	require.NoError(t, err)
+	m := make(map[string]types.FTypeStat, len(fsts))
+	for _, fst := range fsts {
+		m[fst.Path] = fst.FTypeStat
+	}
+	return m
+}
+
+// startWatch returns a watching TreeStatsWatcher for dir after the initial scan has finished
+func startWatch(t *testing.T, dir string, fdb store.Store, errorHandler notifywatch.NotifyErrorFun) *TreeStatsWatcher {
+	tsw, err := NewTreeStatsWatcher([]string{dir}, fdb)
+	require.NoError(t, err)
+	tsw.SetErrorHandler(errorHandler)
+	require.Eventually(t, func() bool { return !tsw.ScanFinished(dir).IsZero() }, scanTimeout, 10*time.Millisecond, "initial scan didn't finish")
+	require.NoError(t, tsw.StartWatcher(dir))
+	require.Eventually(t, func() bool { m, ok := tsw.Get(dir); return ok && m.IsWatching() }, eventTimeout, 10*time.Millisecond, "watcher didn't start")
+	t.Cleanup(func() { tsw.StopWatchAll() })
+	return tsw
+}
+
+func TestTreeStatsWatcher_Events(t *testing.T) {
+	dir := t.TempDir()
+	fdb := tmpStore(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "existing.txt"), []byte("scanned before watching"), 0644))
+
+	handlerErrs := make(chan error, 100)
+	startWatch(t, dir, fdb, func(ei notify.EventInfo, err error) {
+		select {
+		case handlerErrs <- err:
+		default:
+		}
+	})
+
+	inDB := func(path string, size uint64) func() bool {
+		return func() bool {
+			ft, ok := dbPaths(t, fdb, dir)[path]
+			return ok && ft.NumBytes == size
+		}
+	}
+	notInDB := func(path string) func() bool {
+		return func() bool {
+			_, ok := dbPaths(t, fdb, dir)[path]
+			return !ok
+		}
+	}
+
+	existing := filepath.Join(dir, "existing.txt")
+	assert.Eventually(t, inDB(existing, 23), eventTimeout, 20*time.Millisecond, "scanned file not in DB")
+
+	// create
+	created := filepath.Join(dir, "created.txt")
+	require.NoError(t, os.WriteFile(created, []byte("12345"), 0644))
+	assert.Eventually(t, inDB(created, 5), eventTimeout, 20*time.Millisecond, "created file not in DB")
+
+	// modify
+	f, err := os.OpenFile(created, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString("67890")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.Eventually(t, inDB(created, 10), eventTimeout, 20*time.Millisecond, "modified file size not updated in DB")
+
+	// move
+	moved := filepath.Join(dir, "moved.txt")
+	require.NoError(t, os.Rename(created, moved))
+	assert.Eventually(t, inDB(moved, 10), eventTimeout, 20*time.Millisecond, "moved file not in DB")
+	assert.Eventually(t, notInDB(created), eventTimeout, 20*time.Millisecond, "moved file still in DB under old name")
+
+	// remove
+	require.NoError(t, os.Remove(moved))
+	assert.Eventually(t, notInDB(moved), eventTimeout, 20*time.Millisecond, "removed file still in DB")
+
+	// the existing file is untouched by all this
+	assert.True(t, inDB(existing, 23)())
+
+	select {
+	case err := <-handlerErrs:
+		t.Logf("handler reported error (not fatal): %s", err.Error())
+	default:
+	}
+}
+
+func TestTreeStatsWatcher_ScanDirMetadata(t *testing.T) {
+	dir := t.TempDir()
+	fdb := tmpStore(t)
+	fpath := filepath.Join(dir, "file.txt")
+	require.NoError(t, os.WriteFile(fpath, []byte("some content"), 0600))
+	mtime := time.Date(2021, 1, 2, 3, 4, 5, 600, time.Local)
+	require.NoError(t, os.Chtimes(fpath, mtime, mtime))
+
+	tsw, err := NewTreeStatsWatcher(nil, fdb)
+	require.NoError(t, err)
+	require.NoError(t, tsw.ScanDir(dir))
+
+	fi, err := os.Lstat(fpath)
+	require.NoError(t, err)
+	st := fi.Sys().(*syscall.Stat_t)
+
+	fst, err := fdb.GetFileStat(fpath)
+	require.NoError(t, err)
+	require.NotNil(t, fst)
+	assert.Equal(t, "other", fst.FType)
+	assert.Equal(t, uint64(12), fst.NumBytes)
+	assert.True(t, mtime.Equal(fst.ModTime), "mtime %v != %v", fst.ModTime, mtime)
+	assert.Equal(t, uint64(st.Ino), fst.Inode)
+	assert.Equal(t, uint64(st.Dev), fst.Device)
+	assert.Equal(t, st.Uid, fst.Uid)
+	assert.Equal(t, st.Gid, fst.Gid)
+	assert.Equal(t, fs.FileMode(0600), fst.Mode)
+
+	dst, err := fdb.GetFileStat(dir + "/")
+	require.NoError(t, err)
+	require.NotNil(t, dst)
+	assert.Equal(t, "dir", dst.FType)
+	assert.True(t, dst.Mode.IsDir())
+}
+
+func TestTreeStatsWatcher_ScanDirIncremental(t *testing.T) {
+	dir := t.TempDir()
+	fdb := tmpStore(t)
+	fpath := filepath.Join(dir, "file.txt")
+	require.NoError(t, os.WriteFile(fpath, []byte("plain text"), 0644))
+
+	tsw, err := NewTreeStatsWatcher(nil, fdb)
+	require.NoError(t, err)
+	tsw.SetScanOptions(ScanOptions{Incremental: true})
+	require.NoError(t, tsw.ScanDir(dir))
+	fst, err := fdb.GetFileStat(fpath)
+	require.NoError(t, err)
+	require.NotNil(t, fst)
+	assert.Equal(t, "other", fst.FType)
+
+	// fake a different stored type: if the rescan reuses it, we know the content wasn't sniffed
+	fst.FType = "video"
+	require.NoError(t, fdb.UpdateFileStat(fst))
+	require.NoError(t, tsw.ScanDir(dir))
+	fst, err = fdb.GetFileStat(fpath)
+	require.NoError(t, err)
+	assert.Equal(t, "video", fst.FType, "unchanged file was re-classified")
+
+	// a modified file is re-classified
+	require.NoError(t, os.WriteFile(fpath, []byte("plain text, but longer"), 0644))
+	require.NoError(t, tsw.ScanDir(dir))
+	fst, err = fdb.GetFileStat(fpath)
+	require.NoError(t, err)
+	assert.Equal(t, "other", fst.FType, "modified file was not re-classified")
+	assert.Equal(t, uint64(22), fst.NumBytes)
+
+	// a full scan always re-classifies
+	fst.FType = "video"
+	require.NoError(t, fdb.UpdateFileStat(fst))
+	tsw.SetScanOptions(ScanOptions{})
+	require.NoError(t, tsw.ScanDir(dir))
+	fst, err = fdb.GetFileStat(fpath)
+	require.NoError(t, err)
+	assert.Equal(t, "other", fst.FType)
+}
+
+// failingStore fails the writes of failPath, or all commits with failCommit
+type failingStore struct {
+	store.Store
+	failPath   string
+	failCommit bool
+}
+
+func (s *failingStore) UpdateFileStatMulti(fst *types.FileStat, batch *types.FTypeStatsBatch) error {
+	if fst.Path == s.failPath {
+		return fmt.Errorf("can't write %s", fst.Path)
+	}
+	return s.Store.UpdateFileStatMulti(fst, batch)
+}
+
+func (s *failingStore) CommitBatch(batch *types.FTypeStatsBatch) error {
+	if s.failCommit {
+		return fmt.Errorf("can't commit the batch")
+	}
+	return s.Store.CommitBatch(batch)
+}
+
+func TestTreeStatsWatcher_ScanDirWriteErrors(t *testing.T) {
+	dir := t.TempDir()
+	fdb := tmpStore(t)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(name), 0644))
+	}
+	ws := &failingStore{Store: fdb}
+	tsw, err := NewTreeStatsWatcher(nil, ws)
+	require.NoError(t, err)
+	require.NoError(t, tsw.ScanDir(dir))
+	require.Len(t, dbPaths(t, fdb, dir), 3)
+
+	// a failed scan doesn't delete the entries it didn't refresh
+	ws.failPath = filepath.Join(dir, "b.txt")
+	assert.ErrorContains(t, tsw.ScanDir(dir), "can't write")
+	assert.Len(t, dbPaths(t, fdb, dir), 3)
+	ws.failPath, ws.failCommit = "", true
+	assert.ErrorContains(t, tsw.ScanDir(dir), "can't commit")
+	assert.Len(t, dbPaths(t, fdb, dir), 3)
+}
+
+// fakeEvent is a notify.EventInfo to call the event handler directly
+type fakeEvent struct {
+	event  notify.Event
+	path   string
+	cookie uint32
+}
+
+func (e fakeEvent) Event() notify.Event { return e.event }
+func (e fakeEvent) Path() string        { return e.path }
+func (e fakeEvent) Sys() interface{}    { return &unix.InotifyEvent{Cookie: e.cookie} }
+
+func sendEvent(tsw *TreeStatsWatcher, event notify.Event, path string, cookie uint32) error {
+	var ei notify.EventInfo = fakeEvent{event, path, cookie}
+	return tsw.onFileChanged(&ei)
+}
+
+func TestTreeStatsWatcher_ExcludeRules(t *testing.T) {
+	dir := t.TempDir()
+	fdb := tmpStore(t)
+	for path, size := range map[string]int{
+		"a.txt":                  10,
+		"@eaDir/thumb.jpg":       10,
+		".git/config":            10,
+		"sub/node_modules/x.js":  10,
+		"sub/keep.txt":           10,
+		"sub/big.bin":            200,
+		"sub/@eaDir/another.jpg": 10,
+	} {
+		p := filepath.Join(dir, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, make([]byte, size), 0644))
+	}
+	included := []string{dir + "/", dir + "/a.txt", dir + "/sub/", dir + "/sub/keep.txt"}
+
+	tsw, err := NewTreeStatsWatcher(nil, fdb)
+	require.NoError(t, err)
+	require.NotNil(t, tsw.AddDir(dir, true, tsw.eventHandler, defaultNotifyEvents...))
+	require.NoError(t, tsw.ScanDir(dir))
+	assert.Len(t, dbPaths(t, fdb, dir), 13, "scan without exclusions is incomplete")
+
+	// setting the rules purges the DB
+	require.NoError(t, tsw.SetExcludeRules(dir, exclude.Options{
+		Patterns:      []string{"@eaDir", "node_modules/"},
+		ExcludeHidden: true,
+		MaxSize:       100,
+	}))
+	assertIncluded := func(msg string) {
+		got := dbPaths(t, fdb, dir)
+		assert.Len(t, got, len(included), msg)
+		for _, p := range included {
+			assert.Contains(t, got, p, msg)
+		}
+	}
+	assertIncluded("after purge")
+
+	// scans skip excluded paths
+	for _, workers := range []int{0, 4} {
+		_, _, err = fdb.DeleteFileStatsTree(dir)
+		require.NoError(t, err)
+		require.NoError(t, tsw.ScanDirContext(context.Background(), dir, ScanOptions{Workers: workers}))
+		assertIncluded(fmt.Sprintf("after scan with %d workers", workers))
+	}
+
+	// events for excluded paths are ignored
+	newExcluded := filepath.Join(dir, "sub", "@eaDir", "new.jpg")
+	require.NoError(t, os.WriteFile(newExcluded, []byte("x"), 0644))
+	require.NoError(t, sendEvent(tsw, notify.InCreate, newExcluded, 0))
+	newIncluded := filepath.Join(dir, "sub", "new.txt")
+	require.NoError(t, os.WriteFile(newIncluded, []byte("x"), 0644))
+	require.NoError(t, sendEvent(tsw, notify.InCreate, newIncluded, 0))
+	got := dbPaths(t, fdb, dir)
+	assert.NotContains(t, got, newExcluded)
+	assert.Contains(t, got, newIncluded)
+}
+
+func TestTreeStatsWatcher_OverflowRescan(t *testing.T) {
+	dir := t.TempDir()
+	fdb := tmpStore(t)
+	tsw, err := NewTreeStatsWatcher(nil, fdb)
+	require.NoError(t, err)
+	require.NotNil(t, tsw.AddDir(dir, true, tsw.eventHandler, defaultNotifyEvents...))
+	require.NoError(t, tsw.ScanDir(dir))
+	assert.False(t, tsw.IsDirty(dir))
+
+	// files whose events got lost
+	_, nfiles := genTree(t, filepath.Join(dir, "copied"), 1, 3, 5)
+	tsw.SetOverflowRescan(100*time.Millisecond, 0)
+	tsw.onOverflow(dir)
+	tsw.onOverflow(dir) // debounced into the same rescan
+	assert.True(t, tsw.IsDirty(dir))
+	status := tsw.Status()
+	assert.Equal(t, uint64(2), status.Overflows)
+	assert.False(t, status.OverflowLast.IsZero())
+
+	assert.Eventually(t, func() bool {
+		return len(dbPaths(t, fdb, dir)) == 1+4+nfiles && !tsw.IsDirty(dir)
+	}, 5*time.Second, 20*time.Millisecond, "rescan after overflow didn't complete")
+}
+
+func TestRemovedDirs(t *testing.T) {
+	rd := make(tRemovedDirs)
+	now := time.Now()
+	rd.add("/w/old", now.Add(-2*removedDirsTTL))
+	rd.add("/w/a", now)
+	assert.Len(t, rd, 1, "expired entry not dropped")
+
+	assert.True(t, rd.covers("/w/a"))
+	assert.True(t, rd.covers("/w/a/b/c"))
+	assert.False(t, rd.covers("/w/ab"))
+	assert.False(t, rd.covers("/w"))
+
+	rd.forget("/w/a/new") // the removed dir was re-created
+	assert.False(t, rd.covers("/w/a/b"))
+}
+
+// fsPaths returns all paths under dir in the format of the DB (dirs with trailing separator)
+func fsPaths(t testing.TB, dir string) map[string]bool {
+	m := make(map[string]bool)
+	require.NoError(t, filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			path += "/"
+		}
+		m[path] = true
+		return nil
+	}))
+	return m
+}
+
+func TestTreeStatsWatcher_RemoveTree(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping removal of a large tree in short mode")
+	}
+	dir := t.TempDir()
+	fdb := tmpStore(t)
+	big := filepath.Join(dir, "big")
+	for d := 0; d < 10; d++ {
+		sub := filepath.Join(big, fmt.Sprintf("dir%02d", d))
+		require.NoError(t, os.MkdirAll(sub, 0755))
+		for f := 0; f < 1000; f++ {
+			require.NoError(t, os.WriteFile(filepath.Join(sub, fmt.Sprintf("file%04d", f)), []byte("x"), 0644))
+		}
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "keep.txt"), []byte("keep"), 0644))
+
+	tsw := startWatch(t, dir, fdb, nil)
+	tsw.SetOverflowRescan(500*time.Millisecond, 0) // if events get lost, don't wait long for the rescan
+	require.Len(t, dbPaths(t, fdb, dir), 1+1+10+10000+1)
+
+	require.NoError(t, os.RemoveAll(big))
+	want := fsPaths(t, dir)
+	assert.Eventually(t, func() bool {
+		got := dbPaths(t, fdb, dir)
+		if len(got) != len(want) {
+			return false
+		}
+		for p := range got {
+			if !want[p] {
+				return false
+			}
+		}
+		return true
+	}, 60*time.Second, 100*time.Millisecond, "DB doesn't match the filesystem after removing a large tree")
+	t.Logf("event queue overflows during removal: %d", tsw.Status().Overflows)
+}
+
+func TestTreeStatsWatcher_MoveInOut(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "watched")
+	outside := filepath.Join(base, "outside")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "leaving", "sub"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(outside, "coming", "sub"), 0755))
+	for _, p := range []string{
+		filepath.Join(dir, "leaving.txt"),
+		filepath.Join(dir, "leaving", "a.txt"),
+		filepath.Join(dir, "leaving", "sub", "b.txt"),
+		filepath.Join(outside, "coming.txt"),
+		filepath.Join(outside, "coming", "c.txt"),
+		filepath.Join(outside, "coming", "sub", "d.txt"),
+	} {
+		require.NoError(t, os.WriteFile(p, []byte("moving"), 0644))
+	}
+	fdb := tmpStore(t)
+	tsw := startWatch(t, dir, fdb, nil)
+	tsw.SetMoveTimeout(100 * time.Millisecond)
+	require.Len(t, dbPaths(t, fdb, dir), 6)
+
+	require.NoError(t, os.Rename(filepath.Join(dir, "leaving.txt"), filepath.Join(outside, "left.txt")))
+	require.NoError(t, os.Rename(filepath.Join(dir, "leaving"), filepath.Join(outside, "left")))
+	require.NoError(t, os.Rename(filepath.Join(outside, "coming.txt"), filepath.Join(dir, "came.txt")))
+	require.NoError(t, os.Rename(filepath.Join(outside, "coming"), filepath.Join(dir, "came")))
+
+	want := fsPaths(t, dir)
+	assert.Eventually(t, func() bool {
+		got := dbPaths(t, fdb, dir)
+		if len(got) != len(want) {
+			return false
+		}
+		for p := range got {
+			if !want[p] {
+				return false
+			}
+		}
+		return true
+	}, eventTimeout, 20*time.Millisecond, "DB doesn't match the filesystem after moves in and out of the tree")
+	assert.Eventually(t, func() bool { return tsw.moves.len() == 0 }, eventTimeout, 20*time.Millisecond, "unpaired moves left")
+}
+
+// TestTreeStatsWatcher_Concurrent exercises the watcher from many goroutines, it is meant to be run with -race
+func TestTreeStatsWatcher_Concurrent(t *testing.T) {
+	base := t.TempDir()
+	fdb := tmpStore(t)
+	tsw, err := NewTreeStatsWatcher(nil, fdb)
+	require.NoError(t, err)
+	tsw.SetMoveTimeout(20 * time.Millisecond)
+	tsw.SetOverflowRescan(50*time.Millisecond, 0)
+	t.Cleanup(func() { tsw.StopWatchAll() })
+
+	dirs := make([]string, 4)
+	for i := range dirs {
+		dirs[i] = filepath.Join(base, fmt.Sprintf("root%d", i))
+		genTree(t, dirs[i], 1, 2, 5)
+	}
+
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		for i := range dirs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				f(i)
+			}(i)
+		}
+	}
+	run(func(i int) { // add, scan and watch
+		tsw.AddWatch(dirs[i])
+		tsw.SetErrorHandler(func(notify.EventInfo, error) {})
+		for j := 0; j < 3; j++ {
+			tsw.ScanDirContext(context.Background(), dirs[i], ScanOptions{Workers: 2, Incremental: j%2 == 1})
+		}
+		tsw.StartWatcher(dirs[i])
+	})
+	run(func(i int) { // concurrent events, real and simulated
+		for j := 0; j < 20; j++ {
+			p := filepath.Join(dirs[i], fmt.Sprintf("new%02d", j))
+			os.WriteFile(p, []byte("x"), 0644)
+			sendEvent(tsw, notify.InCreate, p, 0)
+			if j%3 == 0 {
+				os.Rename(p, p+".moved")
+				sendEvent(tsw, notify.InMovedFrom, p, uint32(1000*i+j))
+				sendEvent(tsw, notify.InMovedTo, p+".moved", uint32(1000*i+j))
+			}
+			if j%5 == 0 {
+				tsw.onOverflow(dirs[i])
+			}
+		}
+	})
+	run(func(i int) { // status readers and settings writers
+		for j := 0; j < 50; j++ {
+			tsw.Status()
+			tsw.IsDirty(dirs[i])
+			tsw.ScanRunning(dirs[i])
+			tsw.ScanDurationLast()
+			tsw.Dirs()
+			tsw.SetScanOptions(ScanOptions{Workers: j % 3})
+			tsw.CancelScan(dirs[(i+1)%len(dirs)])
+		}
+	})
+	wg.Wait()
+
+	// the tree converges after all the commotion
+	tsw.StopWatchAll()
+	// the stopped watchers forget their dirs asynchronously, which cancels their scans
+	require.Eventually(t, func() bool { return len(tsw.Dirs()) == 0 }, eventTimeout, 10*time.Millisecond, "watchers didn't stop")
+	for _, dir := range dirs {
+		require.NoError(t, tsw.ScanDirContext(context.Background(), dir, ScanOptions{}))
+	}
+	for _, dir := range dirs {
+		want := fsPaths(t, dir)
+		got := dbPaths(t, fdb, dir)
+		assert.Len(t, got, len(want), dir)
+		for p := range want {
+			assert.Contains(t, got, p)
+		}
+	}
+}
@@ -2,6 +2,10 @@ package types
 
 import (
 	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/Rainc1oud/gogenutils"
 )
@@ -25,11 +29,203 @@ type FTypeStat struct {
 	FType     string
 	NumBytes  uint64
 	FileCount uint
+	// UniqueBytes are the bytes counting every hardlinked file (inode) only once,
+	// only set when requested with SumOptions.Unique, NumBytes are then the apparent bytes
+	UniqueBytes uint64
+	// AllocBytes are the allocated (on-disk) bytes (st_blocks*512), like du without --apparent-size
+	// Set for file records, for sums only when requested with SumOptions.Allocated
+	AllocBytes uint64
 }
 
+// FileStat is the full record of one file (or dir) as stored in the DB: the FTypeStat plus the file's metadata
+// Fields that are not available (e.g. on platforms without inodes) are left at their zero value
+type FileStat struct {
+	FTypeStat
+	Ext     string // see FileExt, "" for dirs
+	MIME    string // the detected MIME type, UnknownMIME if it couldn't be detected, "" for dirs and if not detected (yet)
+	ModTime time.Time
+	Inode   uint64
+	Device  uint64
+	Nlink   uint64 // number of hardlinks, 0 for dirs
+	Uid     uint32
+	Gid     uint32
+	Mode    fs.FileMode
+	Archive string // the path of the archive (or fs.FS prefix) the entry is a member of, "" for an entry on the filesystem
+}
+
+// NewFileStat returns a FileStat with the metadata taken from fi (normally from os.Lstat())
+func NewFileStat(path, ftype string, fi fs.FileInfo) *FileStat {
+	fst := &FileStat{
+		FTypeStat: FTypeStat{Path: path, FType: ftype, FileCount: 1},
+		ModTime:   fi.ModTime(),
+		Mode:      fi.Mode(),
+	}
+	if fi.IsDir() {
+		fst.FileCount = 0
+	} else {
+		fst.NumBytes = uint64(fi.Size())
+		fst.Ext = FileExt(path)
+	}
+	fileStatSys(fst, fi)
+	return fst
+}
+
+// UnknownMIME is the MIME type of files whose type couldn't be detected
+const UnknownMIME = "application/octet-stream"
+
+// FileExt returns the lower case extension of the file name in path without the dot, or "" if it has none
+// A leading dot (hidden file) doesn't start an extension
+func FileExt(path string) string {
+	base := strings.TrimLeft(filepath.Base(path), ".")
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(base), "."))
+}
+
+// Unchanged reports whether f and other describe the same, unmodified file content (same size, mtime and inode)
+func (f *FileStat) Unchanged(other *FileStat) bool {
+	return f.NumBytes == other.NumBytes && f.ModTime.Equal(other.ModTime) && f.Inode == other.Inode && !f.ModTime.IsZero()
+}
+
+// GroupBy is the property by which FileTypeStats are grouped
+type GroupBy int
+
+const (
+	GroupByClass GroupBy = iota // the file class (FTypeStat.FType), the default
+	GroupByExt                  // the file extension (FileStat.Ext)
+	GroupByMIME                 // the detected MIME type (FileStat.MIME)
+)
+
+// SumOptions control how FTStatsSumWith sums the files, the zero value is the same as FTStatsSum
+type SumOptions struct {
+	GroupBy GroupBy
+	// Unique counts every inode only once within the query scope and reports those bytes in FTypeStat.UniqueBytes
+	// (hardlinked files are otherwise counted for every path)
+	Unique bool
+	// Allocated also sums the allocated bytes into FTypeStat.AllocBytes, with Unique counting every inode once
+	// Files with unknown allocated size (stored by older versions) count with their apparent size
+	Allocated bool
+	// ArchiveMembers counts the members of the expanded archives in the selected paths instead of the archive files themselves,
+	// otherwise the members are only counted by paths inside their archive (see ftsdb.FileTypeStatsDB.FTStatsSum)
+	ArchiveMembers bool
+}
+
+// FileFilter selects files by category and size, the zero value selects all files
+type FileFilter struct {
+	Categories []string // only files of these categories, all if empty
+	MinSize    uint64   // only files of at least MinSize bytes
+	MaxSize    uint64   // only files of at most MaxSize bytes, no limit if 0
+}
+
+// SizeBucket counts the files with Lower <= size < Upper, Upper is 0 for the last bucket, which has no upper bound
+type SizeBucket struct {
+	Lower     uint64
+	Upper     uint64
+	FileCount uint
+	NumBytes  uint64
+}
+
+// SizeHistogram is a map from type (same as FTypeStat.FType, and "total") to its size buckets in ascending order
+type SizeHistogram map[string][]SizeBucket
+
 // FileTypeStats is a map from type (same as FTypeStat.FType) to FTypeStat
 type FileTypeStats map[string]*FTypeStat
 
+// FileHash holds the content digests of a file, valid as long as its size and mtime are unchanged
+// Partial is the digest of the first part of the file, Full of the whole file, "" if not computed
+type FileHash struct {
+	Path    string
+	Size    uint64
+	ModTime time.Time
+	Partial string
+	Full    string
+}
+
+// DupGroup is a group of files with identical content
+type DupGroup struct {
+	Hash   string // the full content digest
+	FType  string
+	Size   uint64 // of each file
+	Paths  []string
+	Copies int // the number of distinct files (inodes), hardlinks to the same file don't waste space
+}
+
+// Wasted returns the bytes which could be saved by keeping only one copy
+func (g *DupGroup) Wasted() uint64 {
+	if g.Copies < 2 {
+		return 0
+	}
+	return g.Size * uint64(g.Copies-1)
+}
+
+// DupGroups are the duplicate groups found in a tree
+type DupGroups []DupGroup
+
+// WastedByType returns the wasted bytes per type (and "total"), FileCount is the number of redundant copies
+func (gs DupGroups) WastedByType() FileTypeStats {
+	fts := make(FileTypeStats)
+	for _, g := range gs {
+		if g.Copies < 2 {
+			continue
+		}
+		for _, t := range []string{g.FType, "total"} {
+			st, ok := fts[t]
+			if !ok {
+				st = &FTypeStat{Path: "*", FType: t}
+				fts[t] = st
+			}
+			st.FileCount += uint(g.Copies - 1)
+			st.NumBytes += g.Wasted()
+		}
+	}
+	return fts
+}
+
+// Snapshot holds the totals per type (including "total") of a root dir at the time the snapshot was taken
+type Snapshot struct {
+	ID    int64
+	Root  string
+	Taken time.Time
+	Stats FileTypeStats
+}
+
+// FTypeStatDelta is the change of the totals of one type between two snapshots
+type FTypeStatDelta struct {
+	FType     string
+	NumBytes  int64
+	FileCount int64
+}
+
+// FileTypeStatsDelta is a map from type (same as FTypeStat.FType) to FTypeStatDelta
+type FileTypeStatsDelta map[string]*FTypeStatDelta
+
+// Delta returns the changes per type from s to the later snapshot, types missing in one of them count as 0
+// A nil s counts as empty, so the delta is the whole of later
+func (s *Snapshot) Delta(later *Snapshot) FileTypeStatsDelta {
+	delta := make(FileTypeStatsDelta)
+	get := func(ftype string) *FTypeStatDelta {
+		d, ok := delta[ftype]
+		if !ok {
+			d = &FTypeStatDelta{FType: ftype}
+			delta[ftype] = d
+		}
+		return d
+	}
+	if later != nil {
+		for t, st := range later.Stats {
+			d := get(t)
+			d.NumBytes += int64(st.NumBytes)
+			d.FileCount += int64(st.FileCount)
+		}
+	}
+	if s != nil {
+		for t, st := range s.Stats {
+			d := get(t)
+			d.NumBytes -= int64(st.NumBytes)
+			d.FileCount -= int64(st.FileCount)
+		}
+	}
+	return delta
+}
+
 func FileTypeStatsToString(self *FileTypeStats) { self.ToString() }
 func (f *FileTypeStats) ToString() string {
 	s := ""
@@ -44,13 +240,13 @@ func (f *FileTypeStats) ToString() string {
 // FTypeStatsBatch is a "stack like" buffer with a pointer to the next free slot
 type FTypeStatsBatch struct {
 	cap     int
-	ftStats []FTypeStat
+	ftStats []FileStat
 }
 
 func NewFTypeStatsBatch(capacity int) *FTypeStatsBatch {
 	return &FTypeStatsBatch{
 		cap:     capacity,
-		ftStats: make([]FTypeStat, 0, capacity),
+		ftStats: make([]FileStat, 0, capacity),
 	}
 }
 
@@ -64,15 +260,15 @@ func (fb *FTypeStatsBatch) IsEmpty() bool {
 
 // Push pushes an item in the buffer and returns false if the buffer is full
 // (For convenience false will still handle the current pushif possible, it's just the last one possible, so flushing should be handled by the user)
-func (fb *FTypeStatsBatch) Push(elem FTypeStat) bool {
+func (fb *FTypeStatsBatch) Push(elem FileStat) bool {
 	fb.ftStats = append(fb.ftStats, elem)
 	return !fb.IsFull()
 }
 
-func (fb *FTypeStatsBatch) AllElem() []FTypeStat {
+func (fb *FTypeStatsBatch) AllElem() []FileStat {
 	return fb.ftStats[:]
 }
 
 func (fb *FTypeStatsBatch) Reset() {
-	fb.ftStats = make([]FTypeStat, 0, fb.cap)
+	fb.ftStats = make([]FileStat, 0, fb.cap)
 }
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package types
+
+import (
+	"io/fs"
+)
+
+// fileStatSys only sets the allocated size to the apparent size on platforms without unix file metadata
+func fileStatSys(fst *FileStat, fi fs.FileInfo) {
+	fst.AllocBytes = fst.NumBytes
+}
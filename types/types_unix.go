@@ -0,0 +1,24 @@
+//go:build unix
+
+package types
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileStatSys fills the platform specific fields of fst from fi.Sys()
+func fileStatSys(fst *FileStat, fi fs.FileInfo) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		fst.Inode = uint64(st.Ino)
+		fst.Device = uint64(st.Dev)
+		if !fi.IsDir() { // the link count of dirs is their number of subdirs, and dirs count without bytes
+			fst.Nlink = uint64(st.Nlink)
+			fst.AllocBytes = uint64(st.Blocks) * 512 // st_blocks is always in 512 byte units
+		}
+		fst.Uid = st.Uid
+		fst.Gid = st.Gid
+	} else { // e.g. from an fs.FS, without unix file metadata, like on other platforms
+		fst.AllocBytes = fst.NumBytes
+	}
+}
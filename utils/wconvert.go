@@ -3,6 +3,7 @@ package utils
 import (
 	"path/filepath"
 	"strings"
+	"unicode/utf8"
 
 	ggu "github.com/Rainc1oud/gogenutils"
 )
@@ -68,3 +69,117 @@ func StringSliceApply(slice []string, fun func(string) string) []string {
 func OptimizePathsGlob(paths *[]string) []string {
 	return *ggu.StringSliceUniq(paths)
 }
+
+// GlobEscape returns path with all sqlite GLOB meta characters quoted, so it matches only itself literally
+func GlobEscape(path string) string {
+	var sb strings.Builder
+	for i := 0; i < len(path); i++ { // byte-wise, file names are not necessarily valid UTF-8
+		switch c := path[i]; c {
+		case '*', '?', '[':
+			sb.WriteByte('[')
+			sb.WriteByte(c)
+			sb.WriteByte(']')
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// GlobMatch reports whether s matches the sqlite GLOB pattern (case sensitive, with the wildcards *, ? and [...]),
+// so that paths can be selected without sqlite the same way the ftsdb queries do
+func GlobMatch(pattern, s string) bool {
+	for pattern != "" {
+		c, n := utf8.DecodeRuneInString(pattern)
+		switch c {
+		case '*':
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+			for i := 0; ; {
+				if GlobMatch(pattern, s[i:]) {
+					return true
+				}
+				if i == len(s) {
+					return false
+				}
+				_, m := utf8.DecodeRuneInString(s[i:])
+				i += m
+			}
+		case '?':
+			if s == "" {
+				return false
+			}
+			_, m := utf8.DecodeRuneInString(s)
+			s, pattern = s[m:], pattern[n:]
+		case '[':
+			if s == "" {
+				return false
+			}
+			r, m := utf8.DecodeRuneInString(s)
+			rest, ok := matchGlobClass(pattern[n:], r)
+			if !ok {
+				return false
+			}
+			s, pattern = s[m:], rest
+		default:
+			if !strings.HasPrefix(s, pattern[:n]) {
+				return false
+			}
+			s, pattern = s[n:], pattern[n:]
+		}
+	}
+	return s == ""
+}
+
+// matchGlobClass matches r against the character class at the start of pattern (after the "["),
+// it returns the pattern after the class and whether r is in it; an unterminated class never matches
+func matchGlobClass(pattern string, r rune) (string, bool) {
+	negate := strings.HasPrefix(pattern, "^")
+	if negate {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for first := true; pattern != ""; first = false {
+		lo, n := utf8.DecodeRuneInString(pattern)
+		if lo == ']' && !first {
+			return pattern[n:], matched != negate
+		}
+		pattern = pattern[n:]
+		if len(pattern) > 1 && pattern[0] == '-' && pattern[1] != ']' { // range
+			hi, m := utf8.DecodeRuneInString(pattern[1:])
+			matched = matched || (lo <= r && r <= hi)
+			pattern = pattern[1+m:]
+		} else {
+			matched = matched || lo == r
+		}
+	}
+	return "", false
+}
+
+// MemberSep separates the path of an archive (or another tree scanned into the DB as members of path) from the paths of its members,
+// e.g. "archive.zip!/inner/path"
+// The separator only builds the member paths, whether an entry is a member is stored with it (see types.FileStat.Archive),
+// since a dir on the filesystem may have a name ending in "!" too
+const MemberSep = "!/"
+
+// MemberMatch reports whether the entry path, a member of archive ("" for an entry on the filesystem), is selected by pattern:
+// archive members are only selected by patterns inside their archive, i.e. by those which don't select the archive itself
+func MemberMatch(pattern, path, archive string) bool {
+	return PathPatternMatch(pattern, path) && (archive == "" || !PathPatternMatch(pattern, archive))
+}
+
+// PathPatternMatch reports whether path is selected by the path pattern as described for ftsdb.FileTypeStatsDB.FTStatsSum:
+// "dir/*" selects the dir and its subtree, "dir/" the dir and its direct entries, anything else the matching files or dirs themselves
+// Archive members are selected like any other path, see MemberMatch for the selection of FTStatsSum
+func PathPatternMatch(pattern, path string) bool {
+	switch {
+	case strings.HasSuffix(pattern, "/*"): // recursive directory
+		return GlobMatch(pattern, path)
+	case strings.HasSuffix(pattern, "/"): // specific directory or directory pattern
+		return GlobMatch(pattern+"*", path) && !GlobMatch(pattern+"*/*", path)
+	default: // exact file path or file pattern
+		return GlobMatch(pattern, path) && !GlobMatch(pattern+"/*", path)
+	}
+}
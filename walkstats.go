@@ -0,0 +1,139 @@
+package filetypestats
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Rainc1oud/filetypestats/types"
+	"github.com/Rainc1oud/filetypestats/utils"
+	"github.com/Rainc1oud/gogenutils"
+)
+
+// WalkOptions control WalkStats
+// Of the ScanOptions, Incremental, Dedup and Archives have no effect, since nothing is stored
+type WalkOptions struct {
+	ScanOptions
+	// PerDir also returns the recursive totals of every dir, down to DirDepth levels below its root (0: all dirs)
+	PerDir   bool
+	DirDepth int
+}
+
+// TreeStats are the totals of a WalkStats, in the same form as FTStatsSum returns them from the DB
+type TreeStats struct {
+	Total types.FileTypeStats            // over all roots, like FTStatsSum for "root/*" of all roots (with escaped glob characters)
+	Dirs  map[string]types.FileTypeStats // per dir (with trailing separator), like FTStatsSum for "dir/*", nil without WalkOptions.PerDir
+}
+
+// WalkStats scans the trees under roots once, without DB or watcher, and returns their totals aggregated in memory
+// Roots under other roots are scanned only once. If ctx is cancelled, the totals of what was scanned so far are returned with ctx.Err().
+func WalkStats(ctx context.Context, roots []string, opts WalkOptions) (*TreeStats, error) {
+	agg := &statsAggregator{
+		perDir: opts.PerDir,
+		depth:  opts.DirDepth,
+		total:  make(map[string]*types.FTypeStat),
+		dirs:   make(map[string]map[string]*types.FTypeStat),
+	}
+	roots = gogenutils.FilterCommonRootDirs(roots)
+	opts.Archives = ArchiveOptions{} // the totals are those of the files in the trees, like FTStatsSum
+	var err error
+	for _, root := range roots {
+		agg.root = utils.DirTrailSep(filepath.Clean(root))
+		if err = newTreeScanner(agg, root, opts.ScanOptions).scan(ctx); err != nil {
+			break
+		}
+	}
+
+	ts := &TreeStats{Total: make(types.FileTypeStats)}
+	switch len(roots) {
+	case 0:
+	case 1:
+		ts.Total = sumStats(agg.total, utils.GlobEscape(utils.DirTrailSep(filepath.Clean(roots[0])))+"*")
+	default:
+		ts.Total = sumStats(agg.total, "*")
+	}
+	if opts.PerDir {
+		ts.Dirs = make(map[string]types.FileTypeStats, len(agg.dirs))
+		for dir, sums := range agg.dirs {
+			ts.Dirs[dir] = sumStats(sums, utils.GlobEscape(dir)+"*")
+		}
+	}
+	return ts, err
+}
+
+// statsAggregator is the scanSink of WalkStats, it sums the scanned entries instead of storing them
+type statsAggregator struct {
+	mu     sync.Mutex
+	root   string // of the running scan, with trailing separator
+	perDir bool
+	depth  int
+	total  map[string]*types.FTypeStat
+	dirs   map[string]map[string]*types.FTypeStat
+}
+
+func (a *statsAggregator) GetFileStat(path string) (*types.FileStat, error) {
+	return nil, nil // nothing is stored, so every file is classified
+}
+
+func (a *statsAggregator) FTDumpFileStats(paths []string) ([]types.FileStat, error) {
+	return nil, nil
+}
+
+func (a *statsAggregator) UpdateFileStatMulti(fst *types.FileStat, batch *types.FTypeStatsBatch) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	addStat(a.total, fst)
+	if !a.perDir {
+		return nil
+	}
+	dir := fst.Path // a dir counts in itself, a file in its parent
+	if !strings.HasSuffix(dir, "/") {
+		dir = dir[:strings.LastIndex(dir, "/")+1]
+	}
+	for ; strings.HasPrefix(dir, a.root); dir = utils.DirTrailSep(filepath.Dir(strings.TrimSuffix(dir, "/"))) {
+		if a.depth <= 0 || strings.Count(dir[len(a.root):], "/") <= a.depth {
+			sums, ok := a.dirs[dir]
+			if !ok {
+				sums = make(map[string]*types.FTypeStat)
+				a.dirs[dir] = sums
+			}
+			addStat(sums, fst)
+		}
+		if dir == a.root || dir == "/" {
+			break
+		}
+	}
+	return nil
+}
+
+func (a *statsAggregator) CommitBatch(batch *types.FTypeStatsBatch) error {
+	return nil
+}
+
+// addStat counts fst in its class and the total of sums
+func addStat(sums map[string]*types.FTypeStat, fst *types.FileStat) {
+	for _, class := range []string{fst.FType, "total"} {
+		s, ok := sums[class]
+		if !ok {
+			s = &types.FTypeStat{FType: class}
+			sums[class] = s
+		}
+		s.FileCount++ // dirs are counted too, like in FTStatsSum
+		s.NumBytes += fst.NumBytes
+	}
+}
+
+// sumStats returns sums as FileTypeStats for the path pattern ("*" for several patterns), with the same paths as FTStatsSum returns
+func sumStats(sums map[string]*types.FTypeStat, pattern string) types.FileTypeStats {
+	fts := make(types.FileTypeStats, len(sums))
+	for class, s := range sums {
+		ft := *s
+		ft.Path = pattern
+		if ft.FileCount == 1 && class != "total" && pattern != "*" { // FTStatsSum doesn't return the path of single entries
+			ft.Path = ""
+		}
+		fts[class] = &ft
+	}
+	return fts
+}
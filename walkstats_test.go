@@ -0,0 +1,72 @@
+package filetypestats
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/Rainc1oud/filetypestats/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalkStats(t *testing.T) {
+	dir := t.TempDir()
+	genTree(t, filepath.Join(dir, "a"), 2, 2, 4)    // 7 dirs with an image, a zip, an mp3 and a pdf each
+	genTree(t, filepath.Join(dir, "b[1]"), 1, 3, 3) // 4 dirs with an image, a zip and an mp3 each
+	// the counts and bytes per class (zips are application files), see genTree for the sizes
+	var (
+		a = map[string][2]uint64{"dir": {7, 0}, "image": {7, 7 * 8}, "application": {14, 7 * (21 + 59)}, "audio": {7, 7 * 37}, "total": {35, 7 * 125}}
+		b = map[string][2]uint64{"dir": {4, 0}, "image": {4, 4 * 8}, "application": {4, 4 * 21}, "audio": {4, 4 * 37}, "total": {16, 4 * 66}}
+		// a/dir00 has 3 of the dirs of a
+		aDir00 = map[string][2]uint64{"dir": {3, 0}, "image": {3, 3 * 8}, "application": {6, 3 * (21 + 59)}, "audio": {3, 3 * 37}, "total": {15, 3 * 125}}
+		all    = map[string][2]uint64{"dir": {1 + 7 + 4, 0}}
+	)
+	for class, s := range a {
+		if class != "dir" {
+			all[class] = [2]uint64{s[0] + b[class][0], s[1] + b[class][1]}
+		}
+	}
+	all["total"] = [2]uint64{all["total"][0] + 1, all["total"][1]}
+
+	for _, workers := range []int{1, 4} {
+		stats, err := WalkStats(context.Background(), []string{dir}, WalkOptions{ScanOptions: ScanOptions{Workers: workers}, PerDir: true})
+		require.NoError(t, err)
+		assert.Equal(t, all, classSums(stats.Total), "workers %d", workers)
+		assert.Equal(t, utils.GlobEscape(dir)+"/*", stats.Total["total"].Path)
+
+		assert.Len(t, stats.Dirs, 12)
+		assert.Equal(t, a, classSums(stats.Dirs[dir+"/a/"]))
+		assert.Equal(t, b, classSums(stats.Dirs[dir+"/b[1]/"]))
+		assert.Equal(t, utils.GlobEscape(dir)+"/b[[]1]/*", stats.Dirs[dir+"/b[1]/"]["total"].Path)
+		assert.Equal(t, aDir00, classSums(stats.Dirs[dir+"/a/dir00/"]))
+		leaf := dir + "/a/dir00/dir01/"
+		assert.Equal(t, map[string][2]uint64{"dir": {1, 0}, "image": {1, 8}, "application": {2, 21 + 59}, "audio": {1, 37}, "total": {5, 125}},
+			classSums(stats.Dirs[leaf]))
+		assert.Empty(t, stats.Dirs[leaf]["image"].Path, "single entries have no path, like in FTStatsSum")
+	}
+
+	// nested roots are scanned once, the depth limits the dirs
+	stats, err := WalkStats(context.Background(), []string{filepath.Join(dir, "a"), dir + "/", filepath.Join(dir, "b[1]")},
+		WalkOptions{PerDir: true, DirDepth: 1})
+	require.NoError(t, err)
+	assert.Equal(t, all, classSums(stats.Total))
+	assert.Len(t, stats.Dirs, 3) // dir, a and b[1]
+	assert.Equal(t, b, classSums(stats.Dirs[dir+"/b[1]/"]))
+
+	// several roots and no breakdown
+	stats, err = WalkStats(context.Background(), []string{filepath.Join(dir, "a", "dir00"), filepath.Join(dir, "b[1]")}, WalkOptions{})
+	require.NoError(t, err)
+	want := make(map[string][2]uint64)
+	for class, s := range aDir00 {
+		want[class] = [2]uint64{s[0] + b[class][0], s[1] + b[class][1]}
+	}
+	assert.Equal(t, want, classSums(stats.Total))
+	assert.Equal(t, "*", stats.Total["total"].Path)
+	assert.Nil(t, stats.Dirs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = WalkStats(ctx, []string{dir}, WalkOptions{})
+	assert.ErrorIs(t, err, context.Canceled)
+}